@@ -0,0 +1,155 @@
+package bench
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"payment/fsm"
+)
+
+type nopProcessor struct{}
+
+func (nopProcessor) ExitOldState(from, to fsm.State) error { return nil }
+
+func (nopProcessor) EnterNewState(to fsm.State, event fsm.Event) error { return nil }
+
+func nopAction(from fsm.State, event fsm.Event, to fsm.State) error { return nil }
+
+var (
+	benchStates = map[fsm.State]string{
+		fsm.StateWaitPay:     "待支付",
+		fsm.StateWaitConfirm: "待确认",
+		fsm.StatePayied:      "已支付",
+		fsm.StateCanceled:    "已取消",
+	}
+	benchTransitions = map[fsm.State]map[fsm.Event]fsm.Transition{
+		fsm.StateWaitPay: {
+			fsm.EventPay:        {From: fsm.StateWaitPay, Event: fsm.EventPay, To: fsm.StateWaitConfirm, Action: nopAction},
+			fsm.EventPayConfirm: {From: fsm.StateWaitPay, Event: fsm.EventPayConfirm, To: fsm.StatePayied, Action: nopAction},
+			fsm.EventCancel:     {From: fsm.StateWaitPay, Event: fsm.EventCancel, To: fsm.StateCanceled, Action: nopAction},
+		},
+		fsm.StateWaitConfirm: {
+			fsm.EventPayConfirm: {From: fsm.StateWaitConfirm, Event: fsm.EventPayConfirm, To: fsm.StatePayied, Action: nopAction},
+		},
+	}
+)
+
+// mapMachine 未冻结的状态机，使用 map 查询转变器
+func mapMachine() *fsm.StateMachine {
+	m := fsm.NewStateMachine().
+		SetStart(fsm.StateWaitPay).
+		SetEnd([]fsm.State{fsm.StatePayied, fsm.StateCanceled}).
+		SetStates(benchStates).
+		SetTransitions(benchTransitions).
+		SetOptions(fsm.Options{Processor: nopProcessor{}, Quiet: true})
+	return m
+}
+
+// compiledMachine 冻结的状态机，使用预编译转变器表
+func compiledMachine() *fsm.StateMachine {
+	m := fsm.NewBuilder(fsm.MainMachineName).
+		States(benchStates).
+		Start(fsm.StateWaitPay).
+		End(fsm.StatePayied, fsm.StateCanceled).
+		Options(fsm.Options{Processor: nopProcessor{}, Quiet: true}).
+		From(fsm.StateWaitPay).On(fsm.EventPay).To(fsm.StateWaitConfirm).Do(nopAction).
+		From(fsm.StateWaitPay).On(fsm.EventPayConfirm).To(fsm.StatePayied).Do(nopAction).
+		From(fsm.StateWaitPay).On(fsm.EventCancel).To(fsm.StateCanceled).Do(nopAction).
+		From(fsm.StateWaitConfirm).On(fsm.EventPayConfirm).To(fsm.StatePayied).Do(nopAction).
+		MustBuild()
+	return m
+}
+
+/** baselineMachine 预编译之前的流转实现，作为对比基准
+* 1. 每次流转查询 states map、线性扫描结束状态、两层 map 查询转变器
+* 2. 加排他锁后依次执行处理器与动作，忽略错误
+**/
+type baselineMachine struct {
+	locker      sync.Mutex
+	states      map[fsm.State]string
+	end         []fsm.State
+	transitions map[fsm.State]map[fsm.Event]fsm.Transition
+	processor   fsm.EventProcessor
+}
+
+func (m *baselineMachine) isEnd(state fsm.State) bool {
+	for _, s := range m.end {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *baselineMachine) Run(from fsm.State, event fsm.Event) (fsm.State, error) {
+	if _, ok := m.states[from]; !ok {
+		return 0, fmt.Errorf("旧状态不存在：%d", from)
+	}
+	if m.isEnd(from) {
+		return 0, fmt.Errorf("已到最终状态，无法流转")
+	}
+	transition, ok := m.transitions[from][event]
+	if !ok {
+		return 0, fmt.Errorf("未设置事件转换器")
+	}
+	to := transition.To
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	_ = m.processor.ExitOldState(from, to)
+	if transition.Processor != nil {
+		_ = transition.Processor.ExitOldState(from, to)
+	}
+	_ = transition.Action(from, event, to)
+	_ = m.processor.EnterNewState(to, event)
+	if transition.Processor != nil {
+		_ = transition.Processor.EnterNewState(to, event)
+	}
+	return to, nil
+}
+
+func BenchmarkRunBaseline(b *testing.B) {
+	m := &baselineMachine{
+		states:      benchStates,
+		end:         []fsm.State{fsm.StatePayied, fsm.StateCanceled},
+		transitions: benchTransitions,
+		processor:   nopProcessor{},
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Run(fsm.StateWaitConfirm, fsm.EventPayConfirm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkRun(b *testing.B, m *fsm.StateMachine) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Run(fsm.StateWaitConfirm, fsm.EventPayConfirm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRunMap(b *testing.B) {
+	benchmarkRun(b, mapMachine())
+}
+
+func BenchmarkRunCompiled(b *testing.B) {
+	benchmarkRun(b, compiledMachine())
+}
+
+func benchmarkIsEnd(b *testing.B, m *fsm.StateMachine) {
+	for i := 0; i < b.N; i++ {
+		m.Graph.IsEnd(fsm.State(i % 4))
+	}
+}
+
+func BenchmarkIsEndMap(b *testing.B) {
+	benchmarkIsEnd(b, mapMachine())
+}
+
+func BenchmarkIsEndCompiled(b *testing.B) {
+	benchmarkIsEnd(b, compiledMachine())
+}
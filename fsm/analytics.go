@@ -0,0 +1,391 @@
+package fsm
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tealeg/xlsx"
+)
+
+/** 流转历史统计分析
+* 1. 只统计当前状态机成功的流转记录，失败、权限拒绝的记录忽略
+* 2. 同一实例的记录按时间排序，实例从第一条记录的旧状态开始，依次经过每条记录的新状态
+* 3. 停留时长：从进入状态到离开状态的时间；实例的第一个状态没有进入时间，不统计停留时长，
+*    仍停留在当前状态的实例同样不统计
+* 4. 漏斗：按顺序经过路径上各状态的实例数（不要求相邻），转化率相对路径第一个状态
+**/
+type Analytics struct {
+	machine  *StateMachine
+	entities []string
+	records  map[string][]TransitionRecord
+}
+
+// Analyze 使用流转记录创建统计分析，记录可以来自 MemoryHistory.Records 或其它历史存储的导出
+func (s *StateMachine) Analyze(records []TransitionRecord) *Analytics {
+	a := &Analytics{
+		machine: s,
+		records: make(map[string][]TransitionRecord),
+	}
+	for _, r := range records {
+		if r.Machine != s.Name() || r.Error != "" || r.Denied {
+			continue
+		}
+		if _, ok := a.records[r.EntityID]; !ok {
+			a.entities = append(a.entities, r.EntityID)
+		}
+		a.records[r.EntityID] = append(a.records[r.EntityID], r)
+	}
+	sort.Strings(a.entities)
+	for _, records := range a.records {
+		sort.SliceStable(records, func(i, j int) bool { return records[i].At.Before(records[j].At) })
+	}
+	return a
+}
+
+// Entities 参与统计的实例数量
+func (a *Analytics) Entities() int {
+	return len(a.entities)
+}
+
+// path 实例依次经过的状态，状态不变的流转不重复计入
+func (a *Analytics) path(id string) []State {
+	records := a.records[id]
+	if len(records) == 0 {
+		return nil
+	}
+	path := []State{records[0].From}
+	for _, r := range records {
+		if r.To != path[len(path)-1] {
+			path = append(path, r.To)
+		}
+	}
+	return path
+}
+
+// DwellStat 状态停留时长统计
+type DwellStat struct {
+	State State         `json:"state" desc:"状态"`
+	Count int           `json:"count" desc:"样本数"`
+	Min   time.Duration `json:"min" desc:"最短"`
+	Mean  time.Duration `json:"mean" desc:"平均"`
+	P50   time.Duration `json:"p50" desc:"中位数"`
+	P90   time.Duration `json:"p90" desc:"90 分位"`
+	P99   time.Duration `json:"p99" desc:"99 分位"`
+	Max   time.Duration `json:"max" desc:"最长"`
+}
+
+// dwells 各状态的停留时长样本，已排序
+func (a *Analytics) dwells() map[State][]time.Duration {
+	dwells := make(map[State][]time.Duration)
+	for _, id := range a.entities {
+		records := a.records[id]
+		state, entered := records[0].From, time.Time{}
+		for _, r := range records {
+			if r.To == state {
+				continue
+			}
+			if !entered.IsZero() {
+				dwells[state] = append(dwells[state], r.At.Sub(entered))
+			}
+			state, entered = r.To, r.At
+		}
+	}
+	for _, samples := range dwells {
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	}
+	return dwells
+}
+
+// percentile 最近秩法计算分位数，samples 已排序
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(samples))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(samples) {
+		rank = len(samples)
+	}
+	return samples[rank-1]
+}
+
+// Dwell 单个状态的停留时长分位数，p 取值 0~100
+func (a *Analytics) Dwell(state State, p float64) (time.Duration, bool) {
+	samples := a.dwells()[state]
+	return percentile(samples, p), len(samples) > 0
+}
+
+// DwellTimes 各状态的停留时长统计，按状态排序
+func (a *Analytics) DwellTimes() []DwellStat {
+	dwells := a.dwells()
+	stats := make([]DwellStat, 0, len(dwells))
+	for state, samples := range dwells {
+		var total time.Duration
+		for _, d := range samples {
+			total += d
+		}
+		stats = append(stats, DwellStat{
+			State: state,
+			Count: len(samples),
+			Min:   samples[0],
+			Mean:  total / time.Duration(len(samples)),
+			P50:   percentile(samples, 50),
+			P90:   percentile(samples, 90),
+			P99:   percentile(samples, 99),
+			Max:   samples[len(samples)-1],
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].State < stats[j].State })
+	return stats
+}
+
+// TransitionStat 流转次数统计，Percent 为占旧状态全部流转的百分比
+type TransitionStat struct {
+	From    State   `json:"from" desc:"旧状态"`
+	Event   Event   `json:"event" desc:"事件"`
+	To      State   `json:"to" desc:"新状态"`
+	Count   int     `json:"count" desc:"次数"`
+	Percent float64 `json:"percent" desc:"占比"`
+}
+
+// Transitions 各转变器的流转次数，按旧状态、次数排序
+func (a *Analytics) Transitions() []TransitionStat {
+	counts := make(map[TransitionStat]int)
+	totals := make(map[State]int)
+	for _, id := range a.entities {
+		for _, r := range a.records[id] {
+			counts[TransitionStat{From: r.From, Event: r.Event, To: r.To}]++
+			totals[r.From]++
+		}
+	}
+	stats := make([]TransitionStat, 0, len(counts))
+	for stat, count := range counts {
+		stat.Count = count
+		stat.Percent = percent(count, totals[stat.From])
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Event != b.Event {
+			return a.Event < b.Event
+		}
+		return a.To < b.To
+	})
+	return stats
+}
+
+// FunnelStep 漏斗的一步，Rate 为相对第一步的转化率，StepRate 为相对上一步的转化率
+type FunnelStep struct {
+	State    State   `json:"state" desc:"状态"`
+	Count    int     `json:"count" desc:"实例数"`
+	Rate     float64 `json:"rate" desc:"总转化率"`
+	StepRate float64 `json:"step_rate" desc:"单步转化率"`
+}
+
+// Funnel 沿路径的转化漏斗，例如 Funnel(StateWaitPay, StateWaitConfirm, StatePayied)
+func (a *Analytics) Funnel(path ...State) []FunnelStep {
+	steps := make([]FunnelStep, len(path))
+	for i, state := range path {
+		steps[i].State = state
+	}
+	for _, id := range a.entities {
+		matched := 0
+		for _, state := range a.path(id) {
+			if matched < len(path) && state == path[matched] {
+				steps[matched].Count++
+				matched++
+			}
+		}
+	}
+	for i := range steps {
+		previous := steps[0].Count
+		if i > 0 {
+			previous = steps[i-1].Count
+		}
+		steps[i].Rate = percent(steps[i].Count, steps[0].Count)
+		steps[i].StepRate = percent(steps[i].Count, previous)
+	}
+	return steps
+}
+
+// SequenceStat 事件序列统计，Percent 为占全部实例的百分比
+type SequenceStat struct {
+	Events  []Event `json:"events" desc:"事件序列"`
+	Count   int     `json:"count" desc:"实例数"`
+	Percent float64 `json:"percent" desc:"占比"`
+}
+
+// Sequences 最常见的事件序列，top <= 0 时返回全部
+func (a *Analytics) Sequences(top int) []SequenceStat {
+	counts := make(map[string]*SequenceStat)
+	var keys []string
+	for _, id := range a.entities {
+		events := make([]Event, 0, len(a.records[id]))
+		for _, r := range a.records[id] {
+			events = append(events, r.Event)
+		}
+		key := joinEvents(events)
+		if _, ok := counts[key]; !ok {
+			counts[key] = &SequenceStat{Events: events}
+			keys = append(keys, key)
+		}
+		counts[key].Count++
+	}
+	stats := make([]SequenceStat, 0, len(keys))
+	for _, key := range keys {
+		stat := *counts[key]
+		stat.Percent = percent(stat.Count, len(a.entities))
+		stats = append(stats, stat)
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return joinEvents(stats[i].Events) < joinEvents(stats[j].Events)
+	})
+	if top > 0 && len(stats) > top {
+		stats = stats[:top]
+	}
+	return stats
+}
+
+func joinEvents(events []Event) string {
+	names := make([]string, len(events))
+	for i, event := range events {
+		names[i] = string(event)
+	}
+	return strings.Join(names, " -> ")
+}
+
+// percent 百分比，保留两位小数
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(n)*10000/float64(total)) / 100
+}
+
+// AnalyticsReport 统计报表，用于导出
+type AnalyticsReport struct {
+	Machine     string           `json:"machine"`
+	Entities    int              `json:"entities"`
+	Dwell       []DwellStat      `json:"dwell"`
+	Transitions []TransitionStat `json:"transitions"`
+	Funnel      []FunnelStep     `json:"funnel"`
+	Sequences   []SequenceStat   `json:"sequences"`
+}
+
+// Report 生成报表，funnel 为漏斗路径，top 为事件序列数量
+func (a *Analytics) Report(funnel []State, top int) AnalyticsReport {
+	return AnalyticsReport{
+		Machine:     a.machine.Name(),
+		Entities:    a.Entities(),
+		Dwell:       a.DwellTimes(),
+		Transitions: a.Transitions(),
+		Funnel:      a.Funnel(funnel...),
+		Sequences:   a.Sequences(top),
+	}
+}
+
+// reportTable 报表中的一张表，单元格为 string、int 或 float64
+type reportTable struct {
+	Name   string
+	Header []string
+	Rows   [][]interface{}
+}
+
+// tables 报表按表格展开，状态与事件使用状态机语言下的名称，停留时长以秒为单位
+func (a *Analytics) tables(r AnalyticsReport) []reportTable {
+	desc := a.machine.GetStateDesc
+	seconds := func(d time.Duration) float64 { return math.Round(d.Seconds()*1000) / 1000 }
+	dwell := reportTable{
+		Name:   "停留时长",
+		Header: []string{"状态", "样本数", "最短(秒)", "平均(秒)", "P50(秒)", "P90(秒)", "P99(秒)", "最长(秒)"},
+	}
+	for _, s := range r.Dwell {
+		dwell.Rows = append(dwell.Rows, []interface{}{desc(s.State), s.Count,
+			seconds(s.Min), seconds(s.Mean), seconds(s.P50), seconds(s.P90), seconds(s.P99), seconds(s.Max)})
+	}
+	transitions := reportTable{
+		Name:   "流转次数",
+		Header: []string{"旧状态", "事件", "新状态", "次数", "占比(%)"},
+	}
+	for _, s := range r.Transitions {
+		transitions.Rows = append(transitions.Rows, []interface{}{desc(s.From), a.machine.GetEventDesc(s.Event), desc(s.To), s.Count, s.Percent})
+	}
+	funnel := reportTable{
+		Name:   "转化漏斗",
+		Header: []string{"状态", "实例数", "总转化率(%)", "单步转化率(%)"},
+	}
+	for _, s := range r.Funnel {
+		funnel.Rows = append(funnel.Rows, []interface{}{desc(s.State), s.Count, s.Rate, s.StepRate})
+	}
+	sequences := reportTable{
+		Name:   "事件序列",
+		Header: []string{"事件序列", "实例数", "占比(%)"},
+	}
+	for _, s := range r.Sequences {
+		events := make([]Event, len(s.Events))
+		for i, event := range s.Events {
+			events[i] = Event(a.machine.GetEventDesc(event))
+		}
+		sequences.Rows = append(sequences.Rows, []interface{}{joinEvents(events), s.Count, s.Percent})
+	}
+	return []reportTable{dwell, transitions, funnel, sequences}
+}
+
+// WriteCSV 导出 CSV，各表之间空一行，每张表第一行为表名
+func (a *Analytics) WriteCSV(w io.Writer, r AnalyticsReport) error {
+	cw := csv.NewWriter(w)
+	for i, table := range a.tables(r) {
+		if i > 0 {
+			cw.Write(nil)
+		}
+		cw.Write([]string{table.Name})
+		cw.Write(table.Header)
+		for _, row := range table.Rows {
+			record := make([]string, len(row))
+			for j, v := range row {
+				record[j] = fmt.Sprint(v)
+			}
+			cw.Write(record)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteXLSX 导出 xlsx，每张表一个工作表
+func (a *Analytics) WriteXLSX(w io.Writer, r AnalyticsReport) error {
+	file := xlsx.NewFile()
+	for _, table := range a.tables(r) {
+		sheet, err := file.AddSheet(table.Name)
+		if err != nil {
+			return fmt.Errorf("创建工作表失败：%s：%w", table.Name, err)
+		}
+		header := sheet.AddRow()
+		for _, name := range table.Header {
+			header.AddCell().SetString(name)
+		}
+		for _, values := range table.Rows {
+			row := sheet.AddRow()
+			for _, v := range values {
+				row.AddCell().SetValue(v)
+			}
+		}
+	}
+	return file.Write(w)
+}
@@ -0,0 +1,99 @@
+package fsm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tealeg/xlsx"
+)
+
+func TestAnalytics(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	var records []TransitionRecord
+	add := func(id string, minutes int, from State, event Event, to State) {
+		records = append(records, TransitionRecord{
+			Machine:  MainMachineName,
+			EntityID: id,
+			From:     from,
+			Event:    event,
+			To:       to,
+			At:       start.Add(time.Duration(minutes) * time.Minute),
+		})
+	}
+	// 三单支付成功，一单取消，一单停留在待确认
+	add("1", 0, StateWaitPay, EventPay, StateWaitConfirm)
+	add("1", 10, StateWaitConfirm, EventPayConfirm, StatePayied)
+	add("2", 0, StateWaitPay, EventPay, StateWaitConfirm)
+	add("2", 20, StateWaitConfirm, EventPayConfirm, StatePayied)
+	add("3", 0, StateWaitPay, EventPay, StateWaitConfirm)
+	add("3", 30, StateWaitConfirm, EventPayConfirm, StatePayied)
+	add("4", 0, StateWaitPay, EventCancel, StateCanceled)
+	add("5", 0, StateWaitPay, EventPay, StateWaitConfirm)
+	records = append(records,
+		TransitionRecord{Machine: MainMachineName, EntityID: "5", From: StateWaitConfirm, Event: EventPayConfirm, To: StateWaitConfirm, Error: "超时", At: start.Add(time.Hour)},
+		TransitionRecord{Machine: SubMachineName, EntityID: "1", From: StateSubWaitPay, Event: EventSubPay, To: StateSubWaitShip, At: start},
+	)
+
+	a := MainStateMachine.Analyze(records)
+	if a.Entities() != 5 {
+		t.Fatalf("实例数错误：%d", a.Entities())
+	}
+
+	if p50, ok := a.Dwell(StateWaitConfirm, 50); !ok || p50 != 20*time.Minute {
+		t.Fatalf("待确认停留时长中位数错误：%v", p50)
+	}
+	dwell := a.DwellTimes()
+	if len(dwell) != 1 || dwell[0].Count != 3 || dwell[0].Min != 10*time.Minute ||
+		dwell[0].Mean != 20*time.Minute || dwell[0].P99 != 30*time.Minute {
+		t.Fatalf("停留时长统计错误：%+v", dwell)
+	}
+
+	transitions := a.Transitions()
+	if len(transitions) != 3 || transitions[0].Event != EventPay || transitions[0].Count != 4 || transitions[0].Percent != 80 ||
+		transitions[1].Event != EventCancel || transitions[1].Percent != 20 {
+		t.Fatalf("流转次数统计错误：%+v", transitions)
+	}
+
+	funnel := a.Funnel(StateWaitPay, StateWaitConfirm, StatePayied)
+	if funnel[0].Count != 5 || funnel[1].Count != 4 || funnel[1].Rate != 80 ||
+		funnel[2].Count != 3 || funnel[2].Rate != 60 || funnel[2].StepRate != 75 {
+		t.Fatalf("漏斗统计错误：%+v", funnel)
+	}
+	if canceled := a.Funnel(StateWaitPay, StateCanceled); canceled[1].Rate != 20 {
+		t.Fatalf("取消漏斗统计错误：%+v", canceled)
+	}
+
+	sequences := a.Sequences(2)
+	if len(sequences) != 2 || sequences[0].Count != 3 || sequences[0].Percent != 60 ||
+		joinEvents(sequences[0].Events) != "pay -> pay_confirm" {
+		t.Fatalf("事件序列统计错误：%+v", sequences)
+	}
+
+	report := a.Report([]State{StateWaitPay, StateWaitConfirm, StatePayied}, 5)
+	var csv bytes.Buffer
+	if err := a.WriteCSV(&csv, report); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"停留时长\n", "待确认(1),3,600,1200,1200,1800,1800,1800\n", "待支付(0),支付,待确认(1),4,80\n", "支付 -> 支付确认,3,60\n"} {
+		if !strings.Contains(csv.String(), want) {
+			t.Fatalf("CSV 缺少：%q\n%s", want, csv.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := a.WriteXLSX(&buf, report); err != nil {
+		t.Fatal(err)
+	}
+	file, err := xlsx.OpenBinary(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Sheets) != 4 || file.Sheets[2].Name != "转化漏斗" {
+		t.Fatalf("工作表错误：%d", len(file.Sheets))
+	}
+	if cell := file.Sheets[2].Rows[3].Cells[1]; cell.Value != "3" {
+		t.Fatalf("漏斗工作表错误：%q", cell.Value)
+	}
+}
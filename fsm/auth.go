@@ -0,0 +1,178 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// 内置角色，RoleAuthorizer 默认把权限当作角色匹配
+const (
+	RoleSystem       = "system"        // 系统，例如支付回调
+	RoleCSSupervisor = "cs_supervisor" // 客服主管
+)
+
+// Actor 触发事件的操作人
+type Actor struct {
+	ID    string   `json:"id" desc:"操作人ID"`
+	Roles []string `json:"roles" desc:"角色"`
+}
+
+func (a Actor) String() string {
+	if a.ID == "" {
+		return "匿名"
+	}
+	return fmt.Sprintf("%s[%s]", a.ID, strings.Join(a.Roles, ","))
+}
+
+// HasRole 是否拥有角色
+func (a Actor) HasRole(role string) bool {
+	for _, r := range a.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// WithActor 设置触发事件的操作人
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+// ActorFrom 获取上下文中的操作人
+func ActorFrom(ctx context.Context) (Actor, bool) {
+	actor, ok := ctx.Value(actorKey).(Actor)
+	return actor, ok
+}
+
+// ErrPermissionDenied 操作人无权触发事件，使用 errors.Is 判断
+var ErrPermissionDenied = errors.New("无权触发事件")
+
+// PermissionError 权限拒绝错误，包含操作人与缺少的权限
+type PermissionError struct {
+	Machine     string
+	Actor       Actor
+	Event       Event
+	Permissions []string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s：状态机：%s，操作人：%s，事件：%s，需要权限：%s",
+		ErrPermissionDenied, e.Machine, e.Actor, e.Event, strings.Join(e.Permissions, ","))
+}
+
+func (e *PermissionError) Unwrap() error {
+	return ErrPermissionDenied
+}
+
+// Authorizer 判断操作人是否拥有全部权限
+type Authorizer interface {
+	Authorize(ctx context.Context, actor Actor, permissions []string) bool
+}
+
+// RoleAuthorizer 角色 -> 权限，操作人的角色与权限同名时同样视为拥有该权限
+type RoleAuthorizer map[string][]string
+
+func (r RoleAuthorizer) Authorize(ctx context.Context, actor Actor, permissions []string) bool {
+	for _, permission := range permissions {
+		if !r.granted(actor, permission) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r RoleAuthorizer) granted(actor Actor, permission string) bool {
+	for _, role := range actor.Roles {
+		if role == permission {
+			return true
+		}
+		for _, p := range r[role] {
+			if p == permission || p == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DefaultAuthorizer 未设置 Authorizer 时使用，权限即角色
+var DefaultAuthorizer Authorizer = RoleAuthorizer{}
+
+func (s *StateMachine) authorizer() Authorizer {
+	if s.options.Authorizer != nil {
+		return s.options.Authorizer
+	}
+	return DefaultAuthorizer
+}
+
+// Permissions 事件与转变器声明的权限
+func (g *StateGraph) Permissions(from State, event Event) []string {
+	permissions := append([]string(nil), g.permissions[event]...)
+	if transition, ok := g.transition(from, event); ok {
+		permissions = append(permissions, transition.Permissions...)
+	}
+	return permissions
+}
+
+// authorize 检查上下文中的操作人是否可以触发转变器，未声明权限时直接通过
+func (s *StateMachine) authorize(ctx context.Context, transition *Transition) error {
+	eventPermissions := s.Graph.permissions[transition.Event]
+	if len(eventPermissions) == 0 && len(transition.Permissions) == 0 {
+		return nil
+	}
+	actor, _ := ActorFrom(ctx)
+	authorizer := s.authorizer()
+	for _, permissions := range [][]string{eventPermissions, transition.Permissions} {
+		if len(permissions) > 0 && !authorizer.Authorize(ctx, actor, permissions) {
+			return &PermissionError{
+				Machine:     s.Name(),
+				Actor:       actor,
+				Event:       transition.Event,
+				Permissions: s.Graph.Permissions(transition.From, transition.Event),
+			}
+		}
+	}
+	return nil
+}
+
+// RunAs 以操作人身份执行状态流转
+func (s *StateMachine) RunAs(ctx context.Context, actor Actor, from State, event Event) (State, error) {
+	return s.RunContext(WithActor(ctx, actor), from, event)
+}
+
+// AvailableEventsFor 当前状态下操作人有权触发且守卫通过的事件
+func (s *StateMachine) AvailableEventsFor(ctx context.Context, actor Actor, state State) []Event {
+	return s.AvailableEventsContext(WithActor(ctx, actor), state)
+}
+
+// auditDenied 权限拒绝写入流转历史，通过 Fire 执行时与流转记录一起在保存或事务结束后写入，回滚时同样写入
+func (s *StateMachine) auditDenied(ctx context.Context, from State, event Event, err error) {
+	actor, _ := ActorFrom(ctx)
+	r := TransitionRecord{
+		Machine: s.Name(),
+		From:    from,
+		Event:   event,
+		To:      from,
+		Actor:   actor.ID,
+		Denied:  true,
+		Error:   err.Error(),
+		At:      time.Now(),
+	}
+	if inst, ok := InstanceFrom(ctx); ok {
+		r.EntityID = inst.ID
+	}
+	if s.options.History == nil {
+		log.Printf("权限拒绝：%s\n", r.Error)
+		return
+	}
+	if buffer, ok := commitFrom(ctx); ok {
+		buffer.addRecord(s, r)
+		return
+	}
+	s.writeHistory(ctx, r)
+}
@@ -0,0 +1,90 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var (
+	customerActor   = Actor{ID: "u1001", Roles: []string{"customer"}}
+	supervisorActor = Actor{ID: "cs01", Roles: []string{RoleCSSupervisor}}
+	systemActor     = Actor{ID: "callback", Roles: []string{RoleSystem}}
+)
+
+/** authMachine 带权限的主订单状态机，实例 1001 已创建
+* 1. 支付确认需要系统角色
+* 2. 取消转变器需要 order:cancel 权限，用户角色拥有该权限
+**/
+func authMachine(t *testing.T) (*StateMachine, *MemoryHistory) {
+	t.Helper()
+	history := NewMemoryHistory()
+	m := mainBuilder().
+		Options(Options{
+			Processor:  testProcessor{},
+			Store:      NewMemoryStore(),
+			History:    history,
+			Authorizer: RoleAuthorizer{"customer": {"order:cancel"}},
+			Quiet:      true,
+		}).
+		Require(EventPayConfirm, RoleSystem).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).Do(nop).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Require("order:cancel").Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+		MustBuild()
+	if _, err := m.Start(context.Background(), "1001"); err != nil {
+		t.Fatal(err)
+	}
+	return m, history
+}
+
+func TestAuthorizationBuiltin(t *testing.T) {
+	ctx := context.Background()
+	events := AfterSaleStateMachine.AvailableEventsFor(ctx, customerActor, StateAfterSaleWaitReview)
+	if len(events) != 0 {
+		t.Fatalf("用户可用事件错误：%v", events)
+	}
+	events = AfterSaleStateMachine.AvailableEventsFor(ctx, supervisorActor, StateAfterSaleWaitReview)
+	if !reflect.DeepEqual(events, []Event{EventAfterSalePass, EventAfterSaleReject}) {
+		t.Fatalf("客服主管可用事件错误：%v", events)
+	}
+	_, err := AfterSaleStateMachine.RunAs(ctx, customerActor, StateAfterSaleWaitReview, EventAfterSalePass)
+	var denied *PermissionError
+	if !errors.Is(err, ErrPermissionDenied) || !errors.As(err, &denied) || denied.Actor.ID != "u1001" {
+		t.Fatalf("用户不能审核售后：%v", err)
+	}
+}
+
+func TestAuthorizationAvailable(t *testing.T) {
+	ctx := context.Background()
+	m, _ := authMachine(t)
+	if events := m.AvailableEventsFor(ctx, customerActor, StateWaitPay); len(events) != 2 {
+		t.Fatalf("转变器权限通过角色授权：%v", events)
+	}
+	if events := m.AvailableEventsFor(ctx, Actor{}, StateWaitPay); !reflect.DeepEqual(events, []Event{EventPay}) {
+		t.Fatalf("匿名用户可用事件错误：%v", events)
+	}
+}
+
+func TestAuthorizationFire(t *testing.T) {
+	ctx := context.Background()
+	m, history := authMachine(t)
+	if _, err := m.Fire(WithActor(ctx, customerActor), "1001", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Fire(WithActor(ctx, customerActor), "1001", EventPayConfirm); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("用户不能确认支付：%v", err)
+	}
+	if _, err := m.Fire(WithActor(ctx, systemActor), "1001", EventPayConfirm); err != nil {
+		t.Fatal(err)
+	}
+
+	records := history.Records()
+	if len(records) != 3 || !records[1].Denied || records[1].Actor != "u1001" || records[1].To != StateWaitConfirm {
+		t.Fatalf("权限拒绝应写入流转历史：%+v", records)
+	}
+	if records[0].Denied || records[2].Denied || records[2].Actor != "callback" {
+		t.Fatalf("流转历史错误：%+v", records)
+	}
+}
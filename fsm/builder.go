@@ -0,0 +1,452 @@
+package fsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/** 状态机构建器
+* 1. 通过 Builder 声明状态、开始状态、结束状态以及转变器
+* 2. 转变器使用 From(x).On(e).To(y).Do(fn) 声明，旧状态只写一次
+* 3. Build 时统一校验，校验通过后返回冻结的状态机，运行期间不可再修改
+**/
+type Builder struct {
+	name        string
+	start       State
+	hasStart    bool
+	end         []State
+	states      map[State]string
+	transitions map[State]map[Event]Transition
+	permissions map[Event][]string
+	composites  map[State]Composite
+	deferred    map[State][]Event
+	slas        map[State]time.Duration
+	labels      map[Locale]Labels
+	payloads    map[Event]json.RawMessage
+	options     Options
+	listeners   []builderListener
+	errs        []error
+}
+
+type builderListener struct {
+	processor EventProcessor
+	options   ListenerOptions
+}
+
+func NewBuilder(name string) *Builder {
+	return &Builder{
+		name:        name,
+		states:      make(map[State]string),
+		transitions: make(map[State]map[Event]Transition),
+		permissions: make(map[Event][]string),
+		composites:  make(map[State]Composite),
+		deferred:    make(map[State][]Event),
+		slas:        make(map[State]time.Duration),
+		labels:      make(map[Locale]Labels),
+		payloads:    make(map[Event]json.RawMessage),
+	}
+}
+
+// State 声明状态
+func (b *Builder) State(state State, name string) *Builder {
+	if _, ok := b.states[state]; ok {
+		b.errs = append(b.errs, fmt.Errorf("状态重复声明：%d", state))
+	}
+	b.states[state] = name
+	return b
+}
+
+// States 批量声明状态
+func (b *Builder) States(states map[State]string) *Builder {
+	for state, name := range states {
+		b.State(state, name)
+	}
+	return b
+}
+
+// Start 开始状态
+func (b *Builder) Start(state State) *Builder {
+	b.start = state
+	b.hasStart = true
+	return b
+}
+
+// End 结束状态
+func (b *Builder) End(states ...State) *Builder {
+	b.end = append(b.end, states...)
+	return b
+}
+
+// Composite 声明复合状态，复合状态及其子状态都需要通过 State 声明
+func (b *Builder) Composite(state State, initial State, children ...State) *Builder {
+	if _, ok := b.composites[state]; ok {
+		b.errs = append(b.errs, fmt.Errorf("复合状态重复声明：%d", state))
+	}
+	b.composites[state] = Composite{Initial: initial, Children: children}
+	return b
+}
+
+// Defer 状态可以延迟的事件，实例进入可以处理它的状态后重新投递
+func (b *Builder) Defer(state State, events ...Event) *Builder {
+	b.deferred[state] = append(b.deferred[state], events...)
+	return b
+}
+
+// SLA 状态停留时长 SLA，超过后由 SLAMonitor 告警
+func (b *Builder) SLA(state State, sla time.Duration) *Builder {
+	b.slas[state] = sla
+	return b
+}
+
+// Labels 一种语言的状态与事件名称，声明的语言需要覆盖全部状态与事件
+func (b *Builder) Labels(locale Locale, labels Labels) *Builder {
+	if _, ok := b.labels[locale]; ok {
+		b.errs = append(b.errs, fmt.Errorf("语言重复声明：%s", locale))
+	}
+	b.labels[locale] = labels
+	return b
+}
+
+// Payload 事件参数的 JSON Schema，导出给前端使用
+func (b *Builder) Payload(event Event, schema json.RawMessage) *Builder {
+	if !json.Valid(schema) {
+		b.errs = append(b.errs, fmt.Errorf("事件参数的 JSON Schema 格式错误：%s", event))
+	}
+	b.payloads[event] = schema
+	return b
+}
+
+// Require 事件所需权限，对所有触发该事件的转变器生效
+func (b *Builder) Require(event Event, permissions ...string) *Builder {
+	b.permissions[event] = append(b.permissions[event], permissions...)
+	return b
+}
+
+// Processor 状态机默认处理器
+func (b *Builder) Processor(processor EventProcessor) *Builder {
+	b.options.Processor = processor
+	return b
+}
+
+// Options 状态机运行配置，会覆盖之前通过 Processor 设置的处理器
+func (b *Builder) Options(options Options) *Builder {
+	b.options = options
+	return b
+}
+
+// Listener 状态机监听器，按声明顺序执行
+func (b *Builder) Listener(processor EventProcessor, options ListenerOptions) *Builder {
+	if processor == nil {
+		b.errs = append(b.errs, fmt.Errorf("监听器不能为空：%s", options.Name))
+	}
+	b.listeners = append(b.listeners, builderListener{processor: processor, options: options})
+	return b
+}
+
+// From 开始声明一个转变器
+func (b *Builder) From(from State) *TransitionBuilder {
+	return &TransitionBuilder{builder: b, from: from}
+}
+
+// TransitionBuilder 转变器构建器，Do 结束声明并返回 Builder
+type TransitionBuilder struct {
+	builder     *Builder
+	from        State
+	event       Event
+	to          State
+	hasTo       bool
+	processor   EventProcessor
+	retry       *RetryPolicy
+	permissions []string
+	history     HistoryKind
+	fallback    map[State]State
+	guard       Guard
+	raises      []Event
+}
+
+// On 触发事件
+func (t *TransitionBuilder) On(event Event) *TransitionBuilder {
+	t.event = event
+	return t
+}
+
+// To 新状态
+func (t *TransitionBuilder) To(to State) *TransitionBuilder {
+	t.to = to
+	t.hasTo = true
+	return t
+}
+
+// ToHistory 新状态为复合状态的历史伪状态，返回进入复合状态前的状态
+func (t *TransitionBuilder) ToHistory(composite State, kind HistoryKind) *TransitionBuilder {
+	t.history = kind
+	return t.To(composite)
+}
+
+// Fallback 历史伪状态没有记录时（不带实例的 Run、记录历史之前保存的实例），从 from 返回 to
+func (t *TransitionBuilder) Fallback(from, to State) *TransitionBuilder {
+	if t.fallback == nil {
+		t.fallback = make(map[State]State)
+	}
+	t.fallback[from] = to
+	return t
+}
+
+// With 转变器处理器
+func (t *TransitionBuilder) With(processor EventProcessor) *TransitionBuilder {
+	t.processor = processor
+	return t
+}
+
+// Retry 动作失败时的重试策略
+func (t *TransitionBuilder) Retry(policy RetryPolicy) *TransitionBuilder {
+	t.retry = &policy
+	return t
+}
+
+// Require 转变器所需权限，与事件的权限同时生效
+func (t *TransitionBuilder) Require(permissions ...string) *TransitionBuilder {
+	t.permissions = append(t.permissions, permissions...)
+	return t
+}
+
+// When 转变器守卫，返回 false 时拒绝流转
+func (t *TransitionBuilder) When(guard Guard) *TransitionBuilder {
+	t.guard = guard
+	return t
+}
+
+// Raises 声明动作可能通过 Raise 产生的后续事件，试运行据此推演后续流转
+func (t *TransitionBuilder) Raises(events ...Event) *TransitionBuilder {
+	t.raises = append(t.raises, events...)
+	return t
+}
+
+// Do 转变器动作，结束当前转变器的声明
+func (t *TransitionBuilder) Do(action Action) *Builder {
+	return t.done(Transition{Action: action}, action == nil)
+}
+
+// DoContext 转变器上下文动作，结束当前转变器的声明
+func (t *TransitionBuilder) DoContext(action ContextAction) *Builder {
+	return t.done(Transition{ContextAction: action}, action == nil)
+}
+
+func (t *TransitionBuilder) done(transition Transition, noAction bool) *Builder {
+	b := t.builder
+	switch {
+	case t.event == "":
+		b.errs = append(b.errs, fmt.Errorf("转变器缺少事件：%d", t.from))
+	case !t.hasTo:
+		b.errs = append(b.errs, fmt.Errorf("转变器缺少新状态：%d -(%s)->", t.from, t.event))
+	case noAction:
+		b.errs = append(b.errs, fmt.Errorf("转变器缺少动作：%d -(%s)-> %d", t.from, t.event, t.to))
+	}
+	if _, ok := b.transitions[t.from][t.event]; ok {
+		b.errs = append(b.errs, fmt.Errorf("转变器重复声明：%d -(%s)->", t.from, t.event))
+	}
+	if b.transitions[t.from] == nil {
+		b.transitions[t.from] = make(map[Event]Transition)
+	}
+	transition.From = t.from
+	transition.Event = t.event
+	transition.To = t.to
+	transition.Processor = t.processor
+	transition.Retry = t.retry
+	transition.Permissions = t.permissions
+	transition.History = t.history
+	transition.Fallback = t.fallback
+	transition.Guard = t.guard
+	transition.Raises = t.raises
+	b.transitions[t.from][t.event] = transition
+	return b
+}
+
+// validate 校验状态机定义
+func (b *Builder) validate() error {
+	errs := append([]error(nil), b.errs...)
+	if b.name == "" {
+		errs = append(errs, fmt.Errorf("状态机名称不能为空"))
+	}
+	if len(b.states) == 0 {
+		errs = append(errs, fmt.Errorf("状态机没有声明状态"))
+	}
+	if !b.hasStart {
+		errs = append(errs, fmt.Errorf("状态机没有设置开始状态"))
+	} else if _, ok := b.states[b.start]; !ok {
+		errs = append(errs, fmt.Errorf("开始状态未声明：%d", b.start))
+	}
+	end := make(map[State]bool, len(b.end))
+	for _, state := range b.end {
+		if _, ok := b.states[state]; !ok {
+			errs = append(errs, fmt.Errorf("结束状态未声明：%d", state))
+		}
+		if end[state] {
+			errs = append(errs, fmt.Errorf("结束状态重复：%d", state))
+		}
+		end[state] = true
+	}
+	parents := make(map[State]State)
+	for state, composite := range b.composites {
+		if _, ok := b.states[state]; !ok {
+			errs = append(errs, fmt.Errorf("复合状态未声明：%d", state))
+		}
+		if end[state] {
+			errs = append(errs, fmt.Errorf("复合状态不能是结束状态：%d", state))
+		}
+		initial := false
+		for _, child := range composite.Children {
+			if _, ok := b.states[child]; !ok {
+				errs = append(errs, fmt.Errorf("子状态未声明：%d", child))
+			}
+			if parent, ok := parents[child]; ok {
+				errs = append(errs, fmt.Errorf("子状态 %d 同时属于复合状态 %d 与 %d", child, parent, state))
+			}
+			parents[child] = state
+			initial = initial || child == composite.Initial
+		}
+		if !initial {
+			errs = append(errs, fmt.Errorf("复合状态的初始状态不是其子状态：%d", state))
+		}
+	}
+	for state := range b.composites {
+		for parent, ok := parents[state]; ok; parent, ok = parents[parent] {
+			if parent == state {
+				errs = append(errs, fmt.Errorf("复合状态循环嵌套：%d", state))
+				break
+			}
+		}
+	}
+	for state := range b.deferred {
+		if _, ok := b.states[state]; !ok {
+			errs = append(errs, fmt.Errorf("延迟事件的状态未声明：%d", state))
+		}
+	}
+	for state, sla := range b.slas {
+		if _, ok := b.states[state]; !ok {
+			errs = append(errs, fmt.Errorf("SLA 的状态未声明：%d", state))
+		}
+		if sla <= 0 {
+			errs = append(errs, fmt.Errorf("SLA 必须大于 0：%d", state))
+		}
+	}
+	for event := range b.payloads {
+		declared := false
+		for _, events := range b.transitions {
+			_, ok := events[event]
+			declared = declared || ok
+		}
+		if !declared {
+			errs = append(errs, fmt.Errorf("事件参数的事件没有转变器：%s", event))
+		}
+	}
+	for from, events := range b.transitions {
+		if _, ok := b.states[from]; !ok {
+			errs = append(errs, fmt.Errorf("转变器旧状态未声明：%d", from))
+		}
+		if end[from] {
+			errs = append(errs, fmt.Errorf("结束状态不能再流转：%d", from))
+		}
+		for event, transition := range events {
+			if _, ok := b.states[transition.To]; !ok {
+				errs = append(errs, fmt.Errorf("转变器新状态未声明：%d -(%s)-> %d", from, event, transition.To))
+			}
+			if _, ok := b.composites[transition.To]; transition.History != NoHistory && !ok {
+				errs = append(errs, fmt.Errorf("历史伪状态的目标不是复合状态：%d -(%s)-> %d", from, event, transition.To))
+			}
+			for state, to := range transition.Fallback {
+				_, okFrom := b.states[state]
+				_, okTo := b.states[to]
+				if transition.History == NoHistory || !okFrom || !okTo {
+					errs = append(errs, fmt.Errorf("历史伪状态的 Fallback 错误：%d -(%s)-> %d：%d -> %d", from, event, transition.To, state, to))
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	g := b.graph()
+	for _, missing := range g.MissingLabels() {
+		errs = append(errs, errors.New(missing.String()))
+	}
+	// 所有状态都必须可以从开始状态到达，复合状态的任一子状态可达即视为可达
+	reachable := map[State]bool{}
+	for _, state := range append(g.ReachableFrom(b.start), b.start) {
+		for s, ok := state, true; ok; s, ok = g.parents[s] {
+			reachable[s] = true
+		}
+	}
+	for state := range b.states {
+		if !reachable[state] {
+			errs = append(errs, fmt.Errorf("状态无法从开始状态到达：%d", state))
+		}
+	}
+	// 非结束状态必须可以离开，子状态可以通过所属复合状态的转变器离开；复合状态只能停留在子状态，不检查
+	for state := range b.states {
+		if _, ok := b.composites[state]; ok || end[state] {
+			continue
+		}
+		leavable := false
+		for s, ok := state, true; ok && !leavable; s, ok = g.parents[s] {
+			leavable = len(b.transitions[s]) > 0
+		}
+		if !leavable {
+			errs = append(errs, fmt.Errorf("非结束状态没有可以离开的转变器：%d", state))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// graph 使用当前声明生成状态机，用于校验
+func (b *Builder) graph() *StateGraph {
+	m := NewStateMachine().
+		SetStart(b.start).
+		SetEnd(b.end).
+		SetStates(b.states).
+		SetTransitions(b.transitions).
+		SetComposites(b.composites).
+		SetPermissions(b.permissions)
+	for locale, labels := range b.labels {
+		m.SetLabels(locale, labels)
+	}
+	return m.Graph
+}
+
+// Build 校验定义并返回冻结的状态机，校验失败时返回所有错误
+func (b *Builder) Build() (*StateMachine, error) {
+	if err := b.validate(); err != nil {
+		return nil, fmt.Errorf("状态机定义错误：%s：%w", b.name, err)
+	}
+	m := NewStateMachine().
+		SetName(b.name).
+		SetStart(b.start).
+		SetEnd(b.end).
+		SetStates(b.states).
+		SetTransitions(b.transitions).
+		SetPermissions(b.permissions).
+		SetComposites(b.composites).
+		SetDeferred(b.deferred).
+		SetSLA(b.slas)
+	for locale, labels := range b.labels {
+		m.SetLabels(locale, labels)
+	}
+	m.SetPayloadSchemas(b.payloads)
+	m.options = b.options
+	for _, l := range b.listeners {
+		m.AddListener(l.processor, l.options)
+	}
+	m.Graph.freeze()
+	return m, nil
+}
+
+// MustBuild Build 失败时 panic，用于包初始化
+func (b *Builder) MustBuild() *StateMachine {
+	m, err := b.Build()
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
@@ -0,0 +1,122 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuilderValidate(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		build func() *Builder
+		want  string
+	}{
+		{
+			name: "undeclared_to",
+			build: func() *Builder {
+				return mainFlow().From(StateWaitConfirm).On(EventCancel).To(State(9)).Do(nop)
+			},
+			want: "转变器新状态未声明：1 -(cancel)-> 9",
+		},
+		{
+			name: "undeclared_from",
+			build: func() *Builder {
+				return mainFlow().From(State(9)).On(EventCancel).To(StateCanceled).Do(nop)
+			},
+			want: "转变器旧状态未声明：9",
+		},
+		{
+			name: "undeclared_start",
+			build: func() *Builder {
+				return NewBuilder(MainMachineName).States(mainStates).Start(State(9))
+			},
+			want: "开始状态未声明：9",
+		},
+		{
+			name: "duplicate_transition",
+			build: func() *Builder {
+				return mainFlow().From(StateWaitPay).On(EventPay).To(StatePayied).Do(nop)
+			},
+			want: "转变器重复声明：0 -(pay)->",
+		},
+		{
+			name: "fallback_without_history",
+			build: func() *Builder {
+				return mainFlow().From(StateWaitConfirm).On(EventCancel).To(StateCanceled).Fallback(StateWaitConfirm, StateWaitPay).Do(nop)
+			},
+			want: "历史伪状态的 Fallback 错误：1 -(cancel)-> 3：1 -> 0",
+		},
+		{
+			name: "duplicate_state",
+			build: func() *Builder {
+				return mainFlow().State(StateWaitPay, "wait_pay")
+			},
+			want: "状态重复声明：0",
+		},
+		{
+			name: "missing_action",
+			build: func() *Builder {
+				return mainFlow().From(StateWaitConfirm).On(EventCancel).To(StateCanceled).Do(nil)
+			},
+			want: "转变器缺少动作：1 -(cancel)-> 3",
+		},
+		{
+			name: "unreachable",
+			build: func() *Builder {
+				return mainFlow().State(State(9), "orphan").End(State(9))
+			},
+			want: "状态无法从开始状态到达：9",
+		},
+		{
+			name: "dead_end",
+			build: func() *Builder {
+				return NewBuilder(MainMachineName).
+					States(mainStates).
+					Start(StateWaitPay).
+					End(StateCanceled).
+					From(StateWaitPay).On(EventPay).To(StateWaitConfirm).Do(nop).
+					From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+					From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop)
+			},
+			want: "非结束状态没有可以离开的转变器：2",
+		},
+		{
+			name: "end_transition",
+			build: func() *Builder {
+				return mainFlow().From(StateCanceled).On(EventPay).To(StateWaitPay).Do(nop)
+			},
+			want: "结束状态不能再流转：3",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := c.build().Build()
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("应返回 %q：%v", c.want, err)
+			}
+		})
+	}
+}
+
+func TestBuilderCompositeChildLeavesByParent(t *testing.T) {
+	_, err := NewBuilder(SubMachineName).
+		States(map[State]string{0: "new", 1: "fulfil", 2: "picking", 3: "done"}).
+		Composite(1, 2, 2).
+		Start(0).
+		End(3).
+		From(0).On("start").To(1).Do(nop).
+		From(1).On("ship").To(3).Do(nop).
+		Build()
+	if err != nil {
+		t.Fatalf("子状态可以通过复合状态的转变器离开：%v", err)
+	}
+}
+
+func TestBuilderAllErrors(t *testing.T) {
+	_, err := mainFlow().
+		From(StateWaitPay).On(EventPay).To(StatePayied).Do(nop).
+		From(StateWaitConfirm).On(EventCancel).To(State(9)).Do(nop).
+		Build()
+	if err == nil || !strings.Contains(err.Error(), "转变器重复声明") || !strings.Contains(err.Error(), "转变器新状态未声明") {
+		t.Fatalf("应返回所有错误：%v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package fsm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Selector 选择批量操作的实例
+type Selector func(ctx context.Context, m *StateMachine) ([]Instance, error)
+
+// SelectInState 选择处于状态且进入时间早于 before 的实例，状态存储需要实现 StateQuerier
+func SelectInState(state State, before time.Time) Selector {
+	return func(ctx context.Context, m *StateMachine) ([]Instance, error) {
+		querier, ok := m.options.Store.(StateQuerier)
+		if !ok {
+			return nil, fmt.Errorf("状态机的状态存储不支持按状态查询：%s", m.Name())
+		}
+		return querier.FindInState(ctx, m.Name(), state, before)
+	}
+}
+
+// SelectIDs 按实体ID选择实例，实例不存在时返回错误
+func SelectIDs(ids ...string) Selector {
+	return func(ctx context.Context, m *StateMachine) ([]Instance, error) {
+		if m.options.Store == nil {
+			return nil, fmt.Errorf("状态机未设置状态存储：%s", m.Name())
+		}
+		insts := make([]Instance, 0, len(ids))
+		for _, id := range ids {
+			inst, err := m.options.Store.Load(ctx, m.Name(), id)
+			if err != nil {
+				return nil, fmt.Errorf("加载实例失败：%s：%w", id, err)
+			}
+			insts = append(insts, inst)
+		}
+		return insts, nil
+	}
+}
+
+// Checkpoint 批量操作的断点，记录已成功处理的实体ID，重新执行同一任务时跳过
+type Checkpoint interface {
+	Completed(ctx context.Context, job string) (map[string]bool, error)
+	Complete(ctx context.Context, job string, id string) error
+}
+
+// MemoryCheckpoint 内存断点，用于测试及单进程内重试
+type MemoryCheckpoint struct {
+	locker sync.Mutex
+	jobs   map[string]map[string]bool
+}
+
+func NewMemoryCheckpoint() *MemoryCheckpoint {
+	return &MemoryCheckpoint{jobs: make(map[string]map[string]bool)}
+}
+
+func (m *MemoryCheckpoint) Completed(ctx context.Context, job string) (map[string]bool, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	completed := make(map[string]bool, len(m.jobs[job]))
+	for id := range m.jobs[job] {
+		completed[id] = true
+	}
+	return completed, nil
+}
+
+func (m *MemoryCheckpoint) Complete(ctx context.Context, job string, id string) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	if m.jobs[job] == nil {
+		m.jobs[job] = make(map[string]bool)
+	}
+	m.jobs[job][id] = true
+	return nil
+}
+
+// FileCheckpoint 文件断点，每个任务一个文件，每行一个实体ID，进程重启后可以继续执行；任务名称不能包含路径
+type FileCheckpoint struct {
+	Dir string `desc:"断点文件目录"`
+
+	locker sync.Mutex
+}
+
+func (f *FileCheckpoint) path(job string) (string, error) {
+	if job == "" || job == "." || strings.Contains(job, "..") || strings.ContainsAny(job, `/\`) {
+		return "", fmt.Errorf("断点任务名称无效：%q", job)
+	}
+	return filepath.Join(f.Dir, job+".checkpoint"), nil
+}
+
+func (f *FileCheckpoint) Completed(ctx context.Context, job string) (map[string]bool, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	path, err := f.path(job)
+	if err != nil {
+		return nil, err
+	}
+	completed := make(map[string]bool)
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return completed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			completed[id] = true
+		}
+	}
+	return completed, scanner.Err()
+}
+
+func (f *FileCheckpoint) Complete(ctx context.Context, job string, id string) error {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	path, err := f.path(job)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(id + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// BulkResult 单个实例的执行结果，试运行时 To 为预计的新状态
+type BulkResult struct {
+	EntityID string        `json:"entity_id"`
+	From     State         `json:"from"`
+	To       State         `json:"to"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// BulkReport 批量操作报告，成功与失败分开记录
+type BulkReport struct {
+	Job       string        `json:"job"`
+	Machine   string        `json:"machine"`
+	Event     Event         `json:"event"`
+	DryRun    bool          `json:"dry_run"`
+	Selected  int           `json:"selected" desc:"选择的实例数"`
+	Skipped   int           `json:"skipped" desc:"断点中已完成而跳过的实例数"`
+	Succeeded []BulkResult  `json:"succeeded"`
+	Failed    []BulkResult  `json:"failed"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+}
+
+/** 批量操作
+* 1. Selector 从状态存储中选择实例，对每个实例通过 Fire 执行 Event
+* 2. Concurrency 限制并发数，Rate 限制每秒执行数，等待使用 Clock，测试时可以替换
+* 3. DryRun 只检查转变器、权限与守卫并计算新状态，不执行钩子与动作，不保存实例
+* 4. 设置 Checkpoint 时，成功的实例写入断点，使用同一个 Job 重新执行时跳过，失败的实例会重试
+* 5. 上下文取消时停止派发，已派发的实例执行完成后返回报告及上下文错误
+**/
+type BulkRunner struct {
+	Machine     *StateMachine `desc:"状态机"`
+	Job         string        `desc:"任务名称，用作断点的键"`
+	Selector    Selector      `desc:"实例选择器"`
+	Event       Event         `desc:"执行的事件"`
+	Concurrency int           `desc:"并发数，默认 8"`
+	Rate        float64       `desc:"每秒执行数，0 不限制"`
+	DryRun      bool          `desc:"试运行"`
+	Checkpoint  Checkpoint    `desc:"断点"`
+	Clock       Clock         `desc:"时钟，默认 SystemClock"`
+}
+
+// Run 执行批量操作，返回的报告中成功与失败按实体ID排序
+func (b *BulkRunner) Run(ctx context.Context) (BulkReport, error) {
+	clock := b.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	report := BulkReport{
+		Job:       b.Job,
+		Machine:   b.Machine.Name(),
+		Event:     b.Event,
+		DryRun:    b.DryRun,
+		StartedAt: clock.Now(),
+	}
+	insts, err := b.Selector(ctx, b.Machine)
+	if err != nil {
+		return report, fmt.Errorf("选择实例失败：%w", err)
+	}
+	report.Selected = len(insts)
+	completed := map[string]bool{}
+	if b.Checkpoint != nil && !b.DryRun {
+		if completed, err = b.Checkpoint.Completed(ctx, b.Job); err != nil {
+			return report, fmt.Errorf("读取断点失败：%s：%w", b.Job, err)
+		}
+	}
+	pending := insts[:0:0]
+	for _, inst := range insts {
+		if !completed[inst.ID] {
+			pending = append(pending, inst)
+		}
+	}
+	report.Skipped = len(insts) - len(pending)
+
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = 8
+	}
+	var interval time.Duration
+	if b.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / b.Rate)
+	}
+	tasks := make(chan Instance)
+	results := make(chan BulkResult)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for inst := range tasks {
+				results <- b.execute(ctx, clock, inst)
+			}
+		}()
+	}
+	go func() {
+		defer close(tasks)
+		for i, inst := range pending {
+			if i > 0 && interval > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-clock.After(interval):
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case tasks <- inst:
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		if result.Error != "" {
+			report.Failed = append(report.Failed, result)
+			continue
+		}
+		report.Succeeded = append(report.Succeeded, result)
+	}
+	sortResults := func(results []BulkResult) {
+		sort.Slice(results, func(i, j int) bool { return results[i].EntityID < results[j].EntityID })
+	}
+	sortResults(report.Succeeded)
+	sortResults(report.Failed)
+	report.Duration = clock.Now().Sub(report.StartedAt)
+	return report, ctx.Err()
+}
+
+// execute 执行单个实例，成功时写入断点
+func (b *BulkRunner) execute(ctx context.Context, clock Clock, inst Instance) BulkResult {
+	start := clock.Now()
+	result := BulkResult{EntityID: inst.ID, From: inst.State}
+	var err error
+	if b.DryRun {
+		_, result.To, err = b.Machine.prepare(withInstance(ctx, &inst), inst.State, b.Event)
+	} else {
+		result.To, err = b.Machine.Fire(ctx, inst.ID, b.Event)
+		if err == nil && b.Checkpoint != nil {
+			if err = b.Checkpoint.Complete(ctx, b.Job, inst.ID); err != nil {
+				err = fmt.Errorf("写入断点失败：%w", err)
+			}
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Duration = clock.Now().Sub(start)
+	return result
+}
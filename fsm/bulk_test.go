@@ -0,0 +1,177 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingClock 等待立即返回，记录等待次数
+type countingClock struct {
+	locker sync.Mutex
+	waits  []time.Duration
+}
+
+func (c *countingClock) Now() time.Time { return time.Time{} }
+
+func (c *countingClock) After(d time.Duration) <-chan time.Time {
+	c.locker.Lock()
+	c.waits = append(c.waits, d)
+	c.locker.Unlock()
+	ch := make(chan time.Time, 1)
+	ch <- time.Time{}
+	return ch
+}
+
+/** bulkRunner 批量取消待支付订单的执行器
+* 1. 实例 1~9 待支付，实例 10 待确认
+* 2. failing 中的实例取消失败
+* 3. 并发 3，每秒 100 个，等待由 clock 记录
+**/
+func bulkRunner(t *testing.T, failing *sync.Map) (*BulkRunner, *countingClock) {
+	t.Helper()
+	ctx := context.Background()
+	cancel := func(ctx context.Context, from State, event Event, to State) error {
+		if inst, ok := InstanceFrom(ctx); ok {
+			if _, ok := failing.Load(inst.ID); ok {
+				return errors.New("库存服务不可用")
+			}
+		}
+		return nil
+	}
+	m := mainBuilder().
+		Options(Options{Processor: testProcessor{}, Store: NewMemoryStore(), Quiet: true}).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).Do(nop).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Retry(RetryPolicy{MaxAttempts: 2, RetryOn: []error{errTimeout}}).DoContext(cancel).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+		MustBuild()
+	for i := 1; i <= 10; i++ {
+		if _, err := m.Start(ctx, fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.Fire(ctx, "10", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	clock := &countingClock{}
+	return &BulkRunner{
+		Machine:     m,
+		Job:         "cancel-wait-pay",
+		Selector:    SelectInState(StateWaitPay, time.Now().Add(time.Second)),
+		Event:       EventCancel,
+		Concurrency: 3,
+		Rate:        100,
+		Checkpoint:  NewMemoryCheckpoint(),
+		Clock:       clock,
+	}, clock
+}
+
+func TestBulkRunnerDryRun(t *testing.T) {
+	ctx := context.Background()
+	runner, clock := bulkRunner(t, &sync.Map{})
+	runner.DryRun = true
+	report, err := runner.Run(ctx)
+	if err != nil || report.Selected != 9 || len(report.Succeeded) != 9 || report.Succeeded[0].To != StateCanceled {
+		t.Fatalf("试运行报告错误：%+v %v", report, err)
+	}
+	if inst, _ := runner.Machine.Options().Store.Load(ctx, MainMachineName, "1"); inst.State != StateWaitPay {
+		t.Fatalf("试运行不应修改实例：%d", inst.State)
+	}
+	if completed, _ := runner.Checkpoint.Completed(ctx, runner.Job); len(completed) != 0 {
+		t.Fatalf("试运行不应写断点：%v", completed)
+	}
+	if len(clock.waits) != 8 || clock.waits[0] != 10*time.Millisecond {
+		t.Fatalf("限流等待错误：%v", clock.waits)
+	}
+	dry := &BulkRunner{Machine: runner.Machine, Selector: SelectIDs("10"), Event: EventCancel, DryRun: true}
+	if report, _ := dry.Run(ctx); len(report.Failed) != 1 || report.Failed[0].Error != "未设置事件转换器" {
+		t.Fatalf("试运行应报告无法处理的事件：%+v", report)
+	}
+}
+
+func TestBulkRunnerRunAndResume(t *testing.T) {
+	ctx := context.Background()
+	failing := &sync.Map{}
+	failing.Store("3", true)
+	failing.Store("7", true)
+	runner, _ := bulkRunner(t, failing)
+	report, err := runner.Run(ctx)
+	if err != nil || len(report.Succeeded) != 7 || len(report.Failed) != 2 ||
+		report.Failed[0].EntityID != "3" || report.Failed[1].EntityID != "7" {
+		t.Fatalf("执行报告错误：%+v %v", report, err)
+	}
+	if inst, _ := runner.Machine.Options().Store.Load(ctx, MainMachineName, "1"); inst.State != StateCanceled {
+		t.Fatalf("实例应已取消：%d", inst.State)
+	}
+
+	// 断点续跑，只重试失败的实例
+	failing.Delete("3")
+	failing.Delete("7")
+	runner.Selector = SelectIDs("1", "2", "3", "7")
+	report, err = runner.Run(ctx)
+	if err != nil || report.Skipped != 2 || len(report.Succeeded) != 2 || len(report.Failed) != 0 {
+		t.Fatalf("断点续跑报告错误：%+v %v", report, err)
+	}
+}
+
+func TestBulkRunnerConcurrency(t *testing.T) {
+	ctx := context.Background()
+	// 前 3 个实例的取消动作必须同时进入才能通过
+	arrived, all := make(chan struct{}, 3), make(chan struct{})
+	var passed atomic.Int32
+	runner, _ := bulkRunner(t, &sync.Map{})
+	runner.Machine = mainBuilder().
+		Options(runner.Machine.Options()).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).
+		DoContext(func(ctx context.Context, from State, event Event, to State) error {
+			select {
+			case arrived <- struct{}{}:
+				if len(arrived) == 3 {
+					close(all)
+				}
+			default:
+				return nil
+			}
+			select {
+			case <-all:
+				passed.Add(1)
+			case <-time.After(time.Second):
+			}
+			return nil
+		}).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+		MustBuild()
+	runner.Job = "concurrency"
+	if report, err := runner.Run(ctx); err != nil || len(report.Succeeded) != 9 {
+		t.Fatalf("执行报告错误：%+v %v", report, err)
+	}
+	if passed.Load() != 3 {
+		t.Fatalf("不同实体应按并发数并行执行，同时进入动作的实体数：%d", passed.Load())
+	}
+}
+
+func TestBulkRunnerFileCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	file := &FileCheckpoint{Dir: t.TempDir()}
+	for _, id := range []string{"1", "2"} {
+		if err := file.Complete(ctx, "job", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if completed, err := file.Completed(ctx, "job"); err != nil || len(completed) != 2 || !completed["2"] {
+		t.Fatalf("文件断点错误：%v %v", completed, err)
+	}
+	for _, job := range []string{"", "../job", "a/b", `a\b`, ".."} {
+		if err := file.Complete(ctx, job, "1"); err == nil {
+			t.Fatalf("任务名称应被拒绝：%q", job)
+		}
+		if _, err := file.Completed(ctx, job); err == nil {
+			t.Fatalf("任务名称应被拒绝：%q", job)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// fsmgen 从状态机定义生成代码，配合 go generate 使用：
+//
+//	//go:generate go run payment/fsm/cmd/fsmgen -in suborder.yaml
+//
+// 默认输出 <定义文件名>_fsm.go 与 <定义文件名>_fsm_test.go
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"payment/fsm/gen"
+)
+
+func main() {
+	in := flag.String("in", "", "定义文件 .yaml/.yml/.json/.dot")
+	out := flag.String("out", "", "输出文件，默认 <定义文件名>_fsm.go")
+	pkg := flag.String("pkg", "", "包名，覆盖定义文件中的 package")
+	test := flag.Bool("test", true, "是否生成校验测试")
+	flag.Parse()
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	def, err := gen.Load(*in)
+	if *pkg != "" && def != nil {
+		def.Package = *pkg
+		err = def.Validate()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	code, testCode, err := gen.Generate(def)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(*in, filepath.Ext(*in)) + "_fsm.go"
+	}
+	if err := os.WriteFile(*out, code, 0o644); err != nil {
+		log.Fatal(err)
+	}
+	if *test {
+		testOut := strings.TrimSuffix(*out, ".go") + "_test.go"
+		if err := os.WriteFile(testOut, testCode, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package fsm
+
+import (
+	"context"
+	"sync"
+)
+
+/** 提交后执行的副作用
+* 1. 流转中产生的流转记录、权限拒绝记录、状态变更通知与异步监听器的调用先放入上下文中的缓冲
+* 2. Run / RunContext 没有持久化，流转（含后续事件）全部成功后发布通知、调用异步监听器，失败时丢弃
+* 3. Fire 在实例保存后写入流转记录，保存成功才发布通知、调用异步监听器；Outbox.Fire 在事务提交或回滚后处理
+* 4. 调用方通过 WithTx 自行管理事务时，使用 WithAfterCommit 在提交或回滚后处理，否则保存后即处理
+* 5. 回滚时流转记录同样写入，没有失败原因的记录标记为失败；通知与异步监听器的调用丢弃
+**/
+type commitBuffer struct {
+	locker        sync.Mutex
+	records       []pendingRecord
+	notifications []pendingNotify
+	calls         []pendingCall
+}
+
+type pendingRecord struct {
+	machine *StateMachine
+	record  TransitionRecord
+}
+
+type pendingNotify struct {
+	notifier Notifier
+	machine  *StateMachine
+	event    TransitionEvent
+}
+
+type pendingCall struct {
+	listener *listener
+	machine  string
+	call     listenerCall
+}
+
+// WithAfterCommit 暂存流转中的副作用，事务提交后调用 done(nil)，回滚后调用 done(err)
+func WithAfterCommit(ctx context.Context) (context.Context, func(err error)) {
+	buffer := &commitBuffer{}
+	ctx = context.WithValue(ctx, commitKey, buffer)
+	return ctx, func(err error) { buffer.flush(ctx, err) }
+}
+
+// withCommitBuffer 上下文中还没有缓冲时创建缓冲，返回的缓冲由调用方在成功或失败后 flush，已有缓冲时返回 nil
+func withCommitBuffer(ctx context.Context) (context.Context, *commitBuffer) {
+	if _, ok := commitFrom(ctx); ok {
+		return ctx, nil
+	}
+	buffer := &commitBuffer{}
+	return context.WithValue(ctx, commitKey, buffer), buffer
+}
+
+func commitFrom(ctx context.Context) (*commitBuffer, bool) {
+	buffer, ok := ctx.Value(commitKey).(*commitBuffer)
+	return buffer, ok
+}
+
+func (b *commitBuffer) addRecord(m *StateMachine, r TransitionRecord) {
+	b.locker.Lock()
+	b.records = append(b.records, pendingRecord{machine: m, record: r})
+	b.locker.Unlock()
+}
+
+func (b *commitBuffer) addNotify(m *StateMachine, e TransitionEvent) {
+	b.locker.Lock()
+	b.notifications = append(b.notifications, pendingNotify{notifier: m.options.Notifier, machine: m, event: e})
+	b.locker.Unlock()
+}
+
+func (b *commitBuffer) addCall(machine string, l *listener, call listenerCall) {
+	b.locker.Lock()
+	b.calls = append(b.calls, pendingCall{listener: l, machine: machine, call: call})
+	b.locker.Unlock()
+}
+
+// flush 写入流转记录，err 为空时依次发布通知、异步监听器入队，否则记录标记为失败并丢弃其余副作用；缓冲为 nil 时不处理
+func (b *commitBuffer) flush(ctx context.Context, err error) {
+	if b == nil {
+		return
+	}
+	b.locker.Lock()
+	records, notifications, calls := b.records, b.notifications, b.calls
+	b.records, b.notifications, b.calls = nil, nil, nil
+	b.locker.Unlock()
+
+	// 按状态机分组写入，同一状态机的记录一次写入
+	var machines []*StateMachine
+	grouped := map[*StateMachine][]TransitionRecord{}
+	for _, p := range records {
+		if err != nil && p.record.Error == "" {
+			p.record.Error = err.Error()
+		}
+		if _, ok := grouped[p.machine]; !ok {
+			machines = append(machines, p.machine)
+		}
+		grouped[p.machine] = append(grouped[p.machine], p.record)
+	}
+	for _, m := range machines {
+		m.writeHistory(ctx, grouped[m]...)
+	}
+	if err != nil {
+		return
+	}
+	for _, p := range notifications {
+		p.machine.publish(ctx, p.notifier, p.event)
+	}
+	for _, p := range calls {
+		p.listener.enqueue(p.machine, p.call)
+	}
+}
+
+// afterCommit 状态机是否有需要在流转成功后执行的副作用，没有时 Run 不创建缓冲
+func (s *StateMachine) afterCommit() bool {
+	return s.options.Notifier != nil || s.listeners.async()
+}
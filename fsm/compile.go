@@ -0,0 +1,93 @@
+package fsm
+
+/** 预编译转变器表
+* 1. 状态是 uint8，冻结图表时把状态集合、结束状态编译为按状态下标的数组
+* 2. 事件名编译为连续的事件编号，转变器表按 状态*事件数+事件编号 展开为一维数组
+* 3. 查询只需要一次事件编号查找与数组下标访问，成功路径不产生内存分配
+* 未冻结的图表仍然使用 map 查询
+**/
+type compiledGraph struct {
+	known       [256]bool        // 状态是否存在
+	end         [256]bool        // 是否结束状态
+	events      map[Event]uint16 // 事件编号
+	table       []uint16         // 转变器下标 + 1，0 表示未设置
+	transitions []Transition     // 转变器
+}
+
+func compileGraph(g *StateGraph) *compiledGraph {
+	c := &compiledGraph{events: make(map[Event]uint16)}
+	for state := range g.states {
+		c.known[state] = true
+	}
+	for _, state := range g.end {
+		c.end[state] = true
+	}
+	for _, events := range g.transitions {
+		for event := range events {
+			if _, ok := c.events[event]; !ok {
+				c.events[event] = uint16(len(c.events))
+			}
+		}
+	}
+	c.table = make([]uint16, 256*len(c.events))
+	for from, events := range g.transitions {
+		for event, transition := range events {
+			c.transitions = append(c.transitions, transition)
+			c.table[int(from)*len(c.events)+int(c.events[event])] = uint16(len(c.transitions))
+		}
+	}
+	// 子状态继承复合状态的转变器
+	for state := range g.states {
+		for parent, ok := g.parents[state]; ok; parent, ok = g.parents[parent] {
+			for _, id := range c.events {
+				cell := &c.table[int(state)*len(c.events)+int(id)]
+				if *cell == 0 {
+					*cell = c.table[int(parent)*len(c.events)+int(id)]
+				}
+			}
+		}
+	}
+	return c
+}
+
+// lookupResult 转变器查询结果
+type lookupResult uint8
+
+const (
+	lookupOK          lookupResult = iota // 找到转变器
+	lookupUnknown                         // 旧状态不存在
+	lookupEnd                             // 已到最终状态
+	lookupNoneMatched                     // 未设置事件转换器
+)
+
+// lookup 查询转变器，冻结的图表使用预编译表
+func (g *StateGraph) lookup(from State, event Event) (*Transition, lookupResult) {
+	if c := g.compiled; c != nil {
+		if !c.known[from] {
+			return nil, lookupUnknown
+		}
+		if c.end[from] {
+			return nil, lookupEnd
+		}
+		id, ok := c.events[event]
+		if !ok {
+			return nil, lookupNoneMatched
+		}
+		index := c.table[int(from)*len(c.events)+int(id)]
+		if index == 0 {
+			return nil, lookupNoneMatched
+		}
+		return &c.transitions[index-1], lookupOK
+	}
+	if _, ok := g.states[from]; !ok {
+		return nil, lookupUnknown
+	}
+	if g.IsEnd(from) {
+		return nil, lookupEnd
+	}
+	transition, ok := g.transition(from, event)
+	if !ok {
+		return nil, lookupNoneMatched
+	}
+	return &transition, lookupOK
+}
@@ -0,0 +1,35 @@
+package fsm
+
+import "testing"
+
+/** 预编译状态机的查询与流转
+* 1. 转变器查询不产生内存分配
+* 2. 没有后续事件、通知与异步监听器的流转不产生内存分配
+**/
+func TestCompiledRun(t *testing.T) {
+	m := mainMachine(t, Options{}, nil)
+
+	if allocs := testing.AllocsPerRun(100, func() {
+		if _, result := m.Graph.lookup(StateWaitPay, EventPay); result != lookupOK {
+			t.Fatalf("查询错误：%d", result)
+		}
+	}); allocs != 0 {
+		t.Fatalf("预编译转变器查询产生了内存分配：%v", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		if to, err := m.Run(StateWaitPay, EventPay); err != nil || to != StateWaitConfirm {
+			t.Fatalf("流转错误：%d %v", to, err)
+		}
+	}); allocs != 0 {
+		t.Fatalf("预编译状态机流转产生了内存分配：%v", allocs)
+	}
+	if _, err := m.Run(StatePayied, EventPay); err == nil {
+		t.Fatal("最终状态不能流转")
+	}
+	if _, err := m.Run(StateWaitConfirm, EventCancel); err == nil {
+		t.Fatal("未设置的事件不能流转")
+	}
+	if _, err := m.Run(State(100), EventPay); err == nil {
+		t.Fatal("不存在的状态不能流转")
+	}
+}
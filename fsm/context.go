@@ -0,0 +1,83 @@
+package fsm
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/gocraft/dbr/v2/dialect"
+)
+
+// ctxKey 上下文键
+type ctxKey int
+
+const (
+	instanceKey    ctxKey = iota // 当前实例
+	txKey                        // 数据库事务
+	outboxKey                    // 发件箱缓冲
+	idempotencyKey               // 幂等键
+	queueKey                     // 后续事件队列
+	historyKey                   // 记录流转历史，Fire 时设置
+	traceKey                     // 跟踪数据缓冲
+	actorKey                     // 操作人
+	commitKey                    // 提交后执行的副作用缓冲
+)
+
+// withInstance 在上下文中记录当前流转的实例，流转过程中会更新实例的历史状态
+func withInstance(ctx context.Context, inst *Instance) context.Context {
+	return context.WithValue(ctx, instanceKey, inst)
+}
+
+func instanceFrom(ctx context.Context) (*Instance, bool) {
+	inst, ok := ctx.Value(instanceKey).(*Instance)
+	return inst, ok
+}
+
+// InstanceFrom 获取当前流转的实例，只有通过 Fire 执行时才存在
+func InstanceFrom(ctx context.Context) (Instance, bool) {
+	inst, ok := instanceFrom(ctx)
+	if !ok {
+		return Instance{}, false
+	}
+	return *inst, true
+}
+
+// WithTx 事务模式：状态存储与动作使用调用方提供的事务，任一处理器或动作失败时返回错误，
+// 由调用方回滚事务，保证状态变更与业务写入一起提交或回滚
+func WithTx(ctx context.Context, tx dbr.SessionRunner) context.Context {
+	return context.WithValue(ctx, txKey, tx)
+}
+
+// WithSQLTx 使用 database/sql 的事务开启事务模式，默认按 MySQL 方言生成语句
+func WithSQLTx(ctx context.Context, tx *sql.Tx) context.Context {
+	return WithTx(ctx, &dbr.Tx{
+		EventReceiver: &dbr.NullEventReceiver{},
+		Dialect:       dialect.MySQL,
+		Tx:            tx,
+	})
+}
+
+// TxFrom 获取上下文中的事务，动作中使用它完成业务写入
+func TxFrom(ctx context.Context) (dbr.SessionRunner, bool) {
+	tx, ok := ctx.Value(txKey).(dbr.SessionRunner)
+	return tx, ok
+}
+
+// runnerFrom 获取上下文中的事务，不存在时返回默认会话
+func runnerFrom(ctx context.Context, def dbr.SessionRunner) dbr.SessionRunner {
+	if runner, ok := TxFrom(ctx); ok {
+		return runner
+	}
+	return def
+}
+
+// WithIdempotencyKey 为本次 Fire 设置幂等键，同一实体重复使用相同的键时返回首次的结果
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey, key)
+}
+
+// IdempotencyKeyFrom 获取上下文中的幂等键
+func IdempotencyKeyFrom(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKey).(string)
+	return key, ok && key != ""
+}
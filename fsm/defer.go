@@ -0,0 +1,244 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrUnhandledEvent 当前状态不处理该事件，使用 errors.Is 判断
+var ErrUnhandledEvent = errors.New("事件未处理")
+
+// UnhandledError 当前状态不处理事件：结束状态，或者没有设置事件转换器
+type UnhandledError struct {
+	State State
+	Event Event
+	End   bool
+}
+
+func (e *UnhandledError) Error() string {
+	if e.End {
+		return "已到最终状态，无法流转"
+	}
+	return "未设置事件转换器"
+}
+
+func (e *UnhandledError) Unwrap() error {
+	return ErrUnhandledEvent
+}
+
+// UnhandledPolicy 未处理事件的策略
+type UnhandledPolicy uint8
+
+const (
+	UnhandledReturnError UnhandledPolicy = iota // 返回错误，默认
+	UnhandledIgnore                             // 忽略，状态不变
+	UnhandledLog                                // 打印日志后忽略
+	UnhandledDeadLetter                         // 交给死信处理器，处理成功后忽略
+)
+
+// DeadLetter 未处理的事件
+type DeadLetter struct {
+	Machine  string    `json:"machine"`
+	EntityID string    `json:"entity_id"`
+	State    State     `json:"state"`
+	Event    Event     `json:"event"`
+	Reason   string    `json:"reason"`
+	At       time.Time `json:"at"`
+}
+
+// DeadLetterHandler 死信处理器，返回错误时本次事件失败
+type DeadLetterHandler interface {
+	HandleDeadLetter(ctx context.Context, letter DeadLetter) error
+}
+
+// DeadLetterFunc 函数形式的死信处理器
+type DeadLetterFunc func(ctx context.Context, letter DeadLetter) error
+
+func (f DeadLetterFunc) HandleDeadLetter(ctx context.Context, letter DeadLetter) error {
+	return f(ctx, letter)
+}
+
+// DeferredEvent 实例中保存的延迟事件，重新投递时以延迟时的操作人身份执行
+type DeferredEvent struct {
+	Event Event  `json:"event" bson:"event"`
+	Actor *Actor `json:"actor,omitempty" bson:"actor,omitempty" desc:"延迟时的操作人，没有操作人时为空"`
+}
+
+// SetDeferred 设置各状态可以延迟的事件
+func (s *StateMachine) SetDeferred(deferred map[State][]Event) *StateMachine {
+	s.Graph.mustNotFrozen()
+	s.Graph.deferred = deferred
+	return s
+}
+
+// Deferrable 状态是否可以延迟事件，复合状态声明的延迟事件对子状态生效
+func (g *StateGraph) Deferrable(state State, event Event) bool {
+	for s, ok := state, true; ok; s, ok = g.parents[s] {
+		for _, e := range g.deferred[s] {
+			if e == event {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/** unhandled 处理当前状态不处理的事件
+* 1. 状态声明了可以延迟该事件，并且通过 Fire 执行时，先检查事件声明的权限，通过后把事件与操作人保存到实例的 Deferred 中，状态不变
+*    同名事件只保存一次，超过 MaxDeferred 时返回错误；转变器声明的权限在重新投递时检查
+* 2. 否则按 Unhandled 策略处理：返回错误、忽略、打印日志或交给死信处理器
+* 延迟的事件在实例进入可以处理它的状态后，以延迟时的操作人身份作为后续事件重新投递，见 redeliveryFailed
+**/
+func (s *StateMachine) unhandled(ctx context.Context, from State, event Event, err error) (State, error) {
+	if inst, ok := instanceFrom(ctx); ok && s.Graph.Deferrable(from, event) {
+		deferred, err := s.newDeferred(ctx, from, event)
+		if err != nil {
+			s.auditDenied(ctx, from, event, err)
+			return 0, err
+		}
+		if err := s.deferEvent(inst, deferred); err != nil {
+			s.record(ctx, from, event, from, 0, err)
+			return 0, err
+		}
+		return from, nil
+	}
+	switch s.options.Unhandled {
+	case UnhandledIgnore:
+		return from, nil
+	case UnhandledLog:
+		log.Printf("事件未处理，状态机：%s，状态：%s，事件：%s，原因：%v\n", s.Name(), s.GetStateDesc(from), event, err)
+		return from, nil
+	case UnhandledDeadLetter:
+		if s.options.DeadLetter == nil {
+			return 0, fmt.Errorf("状态机未设置死信处理器：%s：%w", s.Name(), err)
+		}
+		letter := DeadLetter{
+			Machine: s.Name(),
+			State:   from,
+			Event:   event,
+			Reason:  err.Error(),
+			At:      time.Now(),
+		}
+		if inst, ok := instanceFrom(ctx); ok {
+			letter.EntityID = inst.ID
+		}
+		if err := s.options.DeadLetter.HandleDeadLetter(ctx, letter); err != nil {
+			return 0, fmt.Errorf("死信处理失败：%w", err)
+		}
+		return from, nil
+	}
+	s.record(ctx, from, event, from, 0, err)
+	return 0, err
+}
+
+func (s *StateMachine) maxDeferred() int {
+	if s.options.MaxDeferred > 0 {
+		return s.options.MaxDeferred
+	}
+	return 16
+}
+
+// newDeferred 检查事件声明的权限，通过后返回记录了操作人的延迟事件
+func (s *StateMachine) newDeferred(ctx context.Context, from State, event Event) (DeferredEvent, error) {
+	if err := s.authorize(ctx, &Transition{From: from, Event: event}); err != nil {
+		return DeferredEvent{}, err
+	}
+	deferred := DeferredEvent{Event: event}
+	if actor, ok := ActorFrom(ctx); ok {
+		deferred.Actor = &actor
+	}
+	return deferred, nil
+}
+
+// deferEvent 把事件保存到实例的延迟事件中，已有同名事件时不重复保存
+func (s *StateMachine) deferEvent(inst *Instance, deferred DeferredEvent) error {
+	for _, e := range inst.Deferred {
+		if e.Event == deferred.Event {
+			return nil
+		}
+	}
+	if len(inst.Deferred) >= s.maxDeferred() {
+		return fmt.Errorf("延迟事件超过上限 %d：%s", s.maxDeferred(), deferred.Event)
+	}
+	inst.Deferred = append(inst.Deferred, deferred)
+	return nil
+}
+
+// redeliver 进入新状态后，取出第一个可以处理的延迟事件作为后续事件
+func (s *StateMachine) redeliver(ctx context.Context, state State) (DeferredEvent, bool) {
+	inst, ok := instanceFrom(ctx)
+	if !ok || len(inst.Deferred) == 0 {
+		return DeferredEvent{}, false
+	}
+	return s.undefer(inst, state)
+}
+
+// redelivered 重新投递的延迟事件，以延迟时的操作人身份执行，没有操作人时为匿名
+func redelivered(deferred DeferredEvent) queuedEvent {
+	actor := deferred.Actor
+	if actor == nil {
+		actor = &Actor{}
+	}
+	return queuedEvent{event: deferred.Event, actor: actor, deferred: &deferred}
+}
+
+/** redeliveryFailed 重新投递的延迟事件失败时不影响触发的事件及其余后续事件
+* 1. 设置了死信处理器时交给死信处理器，处理成功后丢弃
+* 2. 否则（或者死信处理失败）重新保存到实例的延迟事件中，进入下一个可以处理它的状态时再次投递
+* 失败的流转同样记录到流转历史中；事务模式下失败的流转已经执行的写入不会单独回滚
+**/
+func (s *StateMachine) redeliveryFailed(ctx context.Context, state State, next queuedEvent, err error) {
+	inst, ok := instanceFrom(ctx)
+	if !ok {
+		return
+	}
+	if !s.options.Quiet {
+		log.Printf("延迟事件重新投递失败，状态机：%s，实体：%s，事件：%s，错误：%v\n", s.Name(), inst.ID, next.event, err)
+	}
+	if s.options.DeadLetter != nil {
+		letter := DeadLetter{
+			Machine:  s.Name(),
+			EntityID: inst.ID,
+			State:    state,
+			Event:    next.event,
+			Reason:   err.Error(),
+			At:       time.Now(),
+		}
+		dlErr := s.options.DeadLetter.HandleDeadLetter(ctx, letter)
+		if dlErr == nil {
+			return
+		}
+		log.Printf("死信处理失败，重新延迟事件，状态机：%s，事件：%s，错误：%v\n", s.Name(), next.event, dlErr)
+	}
+	if err := s.deferEvent(inst, *next.deferred); err != nil {
+		log.Printf("重新延迟事件失败，状态机：%s，错误：%v\n", s.Name(), err)
+	}
+}
+
+/** undefer 从实例中取出第一个新状态可以处理的延迟事件
+* 1. 先丢弃新状态及其可达状态都无法处理的事件，进入结束状态时清空全部延迟事件
+* 2. 丢弃的事件不再投递，也不会触发 Unhandled 策略
+**/
+func (s *StateMachine) undefer(inst *Instance, state State) (DeferredEvent, bool) {
+	reachable := append(s.Graph.ReachableFrom(state), state)
+	kept := inst.Deferred[:0]
+	for _, deferred := range inst.Deferred {
+		for _, r := range reachable {
+			if _, result := s.Graph.lookup(r, deferred.Event); result == lookupOK {
+				kept = append(kept, deferred)
+				break
+			}
+		}
+	}
+	inst.Deferred = kept
+	for i, deferred := range inst.Deferred {
+		if _, result := s.Graph.lookup(state, deferred.Event); result == lookupOK {
+			inst.Deferred = append(inst.Deferred[:i:i], inst.Deferred[i+1:]...)
+			return deferred, true
+		}
+	}
+	return DeferredEvent{}, false
+}
@@ -0,0 +1,214 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// deferMachine 待支付时延迟支付确认的主订单状态机，未设置存储时使用内存存储，实例 1001 已创建
+func deferMachine(t *testing.T, options Options) *StateMachine {
+	t.Helper()
+	if options.Store == nil {
+		options.Store = NewMemoryStore()
+	}
+	m := mainMachine(t, options, func(b *Builder) { b.Defer(StateWaitPay, EventPayConfirm) })
+	if _, err := m.Start(context.Background(), "1001"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+/** redeliveryMachine 待支付时延迟支付确认的主订单状态机，实例 1001 已创建
+* 1. 支付确认事件不需要权限，可以由任何人延迟
+* 2. 待确认 -(支付确认)-> 已支付 的转变器需要系统角色，重新投递时按延迟时的操作人检查
+**/
+func redeliveryMachine(t *testing.T, options Options) (*StateMachine, *MemoryStore, *MemoryHistory) {
+	t.Helper()
+	store, history := NewMemoryStore(), NewMemoryHistory()
+	options.Processor, options.Store, options.History, options.Quiet = testProcessor{}, store, history, true
+	m := mainBuilder().
+		Options(options).
+		Defer(StateWaitPay, EventPayConfirm).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).Do(nop).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Require(RoleSystem).Do(nop).
+		MustBuild()
+	if _, err := m.Start(context.Background(), "1001"); err != nil {
+		t.Fatal(err)
+	}
+	return m, store, history
+}
+
+func TestDeferredEventsRedeliver(t *testing.T) {
+	ctx := context.Background()
+	history := NewMemoryHistory()
+	store := NewMemoryStore()
+	m := deferMachine(t, Options{Store: store, History: history})
+	if to, err := m.Fire(ctx, "1001", EventPayConfirm); err != nil || to != StateWaitPay {
+		t.Fatalf("支付确认应延迟：%d %v", to, err)
+	}
+	inst, _ := store.Load(ctx, MainMachineName, "1001")
+	if len(inst.Deferred) != 1 || inst.Deferred[0].Event != EventPayConfirm {
+		t.Fatalf("延迟事件未保存：%+v", inst)
+	}
+	if to, err := m.Fire(ctx, "1001", EventPay); err != nil || to != StatePayied {
+		t.Fatalf("支付后应重新投递支付确认：%d %v", to, err)
+	}
+	inst, _ = store.Load(ctx, MainMachineName, "1001")
+	if len(inst.Deferred) != 0 || len(history.Records()) != 2 {
+		t.Fatalf("延迟事件未清除：%+v %+v", inst, history.Records())
+	}
+}
+
+func TestDeferredEventsAuthorize(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	m := mainMachine(t, Options{Store: store}, func(b *Builder) {
+		b.Defer(StateWaitPay, EventPayConfirm).Require(EventPayConfirm, RoleSystem)
+	})
+	m.Start(ctx, "1001")
+	if _, err := m.Fire(WithActor(ctx, customerActor), "1001", EventPayConfirm); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("无权触发的事件不能延迟：%v", err)
+	}
+	if _, err := m.Fire(WithActor(ctx, systemActor), "1001", EventPayConfirm); err != nil {
+		t.Fatal(err)
+	}
+	inst, _ := store.Load(ctx, MainMachineName, "1001")
+	if len(inst.Deferred) != 1 || inst.Deferred[0].Actor == nil || inst.Deferred[0].Actor.ID != systemActor.ID {
+		t.Fatalf("延迟事件应保存操作人：%+v", inst.Deferred)
+	}
+	// 用户支付后，支付确认以系统身份重新投递
+	if to, err := m.Fire(WithActor(ctx, customerActor), "1001", EventPay); err != nil || to != StatePayied {
+		t.Fatalf("应以延迟时的操作人重新投递：%d %v", to, err)
+	}
+}
+
+func TestDeferredEventsRedeliveryFailure(t *testing.T) {
+	ctx := context.Background()
+	m, store, history := redeliveryMachine(t, Options{})
+	if _, err := m.Fire(WithActor(ctx, customerActor), "1001", EventPayConfirm); err != nil {
+		t.Fatal(err)
+	}
+	// 系统支付后，用户延迟的支付确认重新投递时无权执行，支付仍然成功，支付确认重新延迟
+	if to, err := m.Fire(WithActor(ctx, systemActor), "1001", EventPay); err != nil || to != StateWaitConfirm {
+		t.Fatalf("重新投递失败不应影响触发的事件：%d %v", to, err)
+	}
+	inst, _ := store.Load(ctx, MainMachineName, "1001")
+	if inst.State != StateWaitConfirm || len(inst.Deferred) != 1 || inst.Deferred[0].Actor.ID != customerActor.ID {
+		t.Fatalf("重新投递失败的事件应重新延迟：%+v", inst)
+	}
+	records := history.Records()
+	if last := records[len(records)-1]; !last.Denied || last.Actor != customerActor.ID {
+		t.Fatalf("重新投递应以延迟时的操作人检查权限：%+v", records)
+	}
+}
+
+func TestDeferredEventsRedeliveryDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	var letters []DeadLetter
+	m, store, _ := redeliveryMachine(t, Options{DeadLetter: DeadLetterFunc(func(ctx context.Context, letter DeadLetter) error {
+		letters = append(letters, letter)
+		return nil
+	})})
+	m.Fire(WithActor(ctx, customerActor), "1001", EventPayConfirm)
+	if to, err := m.Fire(WithActor(ctx, systemActor), "1001", EventPay); err != nil || to != StateWaitConfirm {
+		t.Fatalf("重新投递失败不应影响触发的事件：%d %v", to, err)
+	}
+	inst, _ := store.Load(ctx, MainMachineName, "1001")
+	if len(inst.Deferred) != 0 || len(letters) != 1 || letters[0].Event != EventPayConfirm || letters[0].State != StateWaitConfirm {
+		t.Fatalf("重新投递失败的事件应交给死信处理器：%+v %+v", inst.Deferred, letters)
+	}
+}
+
+func TestDeferredEventsDedup(t *testing.T) {
+	ctx := context.Background()
+	history := NewMemoryHistory()
+	store := NewMemoryStore()
+	m := deferMachine(t, Options{Store: store, History: history})
+	for i := 0; i < 2; i++ {
+		if _, err := m.Fire(ctx, "1001", EventPayConfirm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inst, _ := store.Load(ctx, MainMachineName, "1001")
+	if len(inst.Deferred) != 1 {
+		t.Fatalf("同名延迟事件只应保存一次：%+v", inst.Deferred)
+	}
+	if to, err := m.Fire(ctx, "1001", EventPay); err != nil || to != StatePayied || len(history.Records()) != 2 {
+		t.Fatalf("延迟事件只应重新投递一次：%d %v %+v", to, err, history.Records())
+	}
+}
+
+func TestDeferredEventsMaxDeferred(t *testing.T) {
+	ctx := context.Background()
+	m := mainMachine(t, Options{Store: NewMemoryStore(), MaxDeferred: 1}, func(b *Builder) {
+		b.Defer(StateWaitPay, EventPayConfirm, "remind")
+	})
+	m.Start(ctx, "1001")
+	if _, err := m.Fire(ctx, "1001", EventPayConfirm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Fire(ctx, "1001", "remind"); err == nil {
+		t.Fatal("延迟事件超过上限时应返回错误")
+	}
+}
+
+func TestDeferredEventsDropUnreachable(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	m := deferMachine(t, Options{Store: store})
+	if _, err := m.Fire(ctx, "1001", EventPayConfirm); err != nil {
+		t.Fatal(err)
+	}
+	if to, err := m.Fire(ctx, "1001", EventCancel); err != nil || to != StateCanceled {
+		t.Fatalf("取消错误：%d %v", to, err)
+	}
+	inst, _ := store.Load(ctx, MainMachineName, "1001")
+	if len(inst.Deferred) != 0 {
+		t.Fatalf("进入结束状态后应丢弃延迟事件：%+v", inst.Deferred)
+	}
+}
+
+func TestDeferredEventsUnhandled(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct {
+		policy UnhandledPolicy
+		err    bool
+	}{
+		{UnhandledReturnError, true},
+		{UnhandledIgnore, false},
+		{UnhandledLog, false},
+		{UnhandledDeadLetter, true},
+	} {
+		m := deferMachine(t, Options{Unhandled: c.policy})
+		to, err := m.Fire(ctx, "1001", "unknown")
+		if c.err != (err != nil) || (err == nil && to != StateWaitPay) {
+			t.Fatalf("策略 %d 处理错误：%d %v", c.policy, to, err)
+		}
+		if c.policy == UnhandledReturnError && !errors.Is(err, ErrUnhandledEvent) {
+			t.Fatalf("默认返回未处理错误：%v", err)
+		}
+	}
+}
+
+func TestDeferredEventsDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	var letters []DeadLetter
+	m := deferMachine(t, Options{
+		Unhandled: UnhandledDeadLetter,
+		DeadLetter: DeadLetterFunc(func(ctx context.Context, letter DeadLetter) error {
+			letters = append(letters, letter)
+			return nil
+		}),
+	})
+	if _, err := m.Fire(ctx, "1001", EventCancel); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Fire(ctx, "1001", EventCancel); err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].EntityID != "1001" || letters[0].State != StateCanceled || letters[0].Event != EventCancel {
+		t.Fatalf("死信错误：%+v", letters)
+	}
+}
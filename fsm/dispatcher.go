@@ -0,0 +1,204 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull 队列已满，Reject 策略下返回
+	ErrQueueFull = errors.New("事件队列已满")
+	// ErrDispatcherClosed 分发器已关闭
+	ErrDispatcherClosed = errors.New("事件分发器已关闭")
+)
+
+// Backpressure 队列满时的处理策略
+type Backpressure int
+
+const (
+	// BackpressureBlock 阻塞等待队列有空位或上下文取消
+	BackpressureBlock Backpressure = iota
+	// BackpressureReject 立即返回 ErrQueueFull
+	BackpressureReject
+)
+
+// Future 异步事件的执行结果
+type Future struct {
+	done  chan struct{}
+	state State
+	err   error
+}
+
+// Done 事件执行完成时关闭
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait 等待事件执行完成，上下文取消时返回上下文错误
+func (f *Future) Wait(ctx context.Context) (State, error) {
+	select {
+	case <-f.done:
+		return f.state, f.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+type dispatchTask struct {
+	ctx      context.Context
+	id       string
+	event    Event
+	future   *Future
+	callback func(State, error)
+}
+
+/** 异步事件分发器
+* 1. 按实体ID哈希分区，每个分区一个有界队列和一个工作协程
+* 2. 同一实体的事件进入同一分区，按提交顺序执行；不同实体在不同分区并行执行（Fire 按实体加锁）
+* 3. 事件通过状态机的 Fire 执行，结果通过 Future 或回调返回；执行 panic 时转为错误，Future 仍然完成
+* 4. 提交时的上下文只保留值，不继承取消：提交方返回后事件照常执行，需要限时使用 Timeout
+* 5. Close 停止接收新事件，并等待已入队的事件执行完毕
+**/
+type Dispatcher struct {
+	Timeout time.Duration // 每个事件的执行超时，0 表示不限制，需在提交事件前设置
+
+	machine *StateMachine
+	policy  Backpressure
+	queues  []chan dispatchTask
+	locker  sync.RWMutex
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewDispatcher 创建并启动分发器，workers 为分区数，queueSize 为每个分区的队列长度
+func NewDispatcher(m *StateMachine, workers, queueSize int, policy Backpressure) *Dispatcher {
+	if workers <= 0 {
+		workers = 1
+	}
+	d := &Dispatcher{
+		machine: m,
+		policy:  policy,
+		queues:  make([]chan dispatchTask, workers),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan dispatchTask, queueSize)
+		d.wg.Add(1)
+		go d.work(d.queues[i])
+	}
+	return d
+}
+
+func (d *Dispatcher) work(queue chan dispatchTask) {
+	defer d.wg.Done()
+	for task := range queue {
+		state, err := d.execute(task)
+		task.future.state, task.future.err = state, err
+		close(task.future.done)
+		if task.callback != nil {
+			d.notify(task, state, err)
+		}
+	}
+}
+
+// execute 执行事件，panic 转为错误，不影响同一分区的后续事件
+func (d *Dispatcher) execute(task dispatchTask) (state State, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			state, err = 0, fmt.Errorf("事件执行异常，实例：%s，事件：%s，错误：%v", task.id, task.event, r)
+		}
+	}()
+	ctx := task.ctx
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	return d.machine.Fire(ctx, task.id, task.event)
+}
+
+// notify 调用回调，回调 panic 时只记录日志
+func (d *Dispatcher) notify(task dispatchTask, state State, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("事件回调异常，实例：%s，事件：%s，错误：%v\n", task.id, task.event, r)
+		}
+	}()
+	task.callback(state, err)
+}
+
+// partition 实体所在分区
+func (d *Dispatcher) partition(id string) chan dispatchTask {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return d.queues[h.Sum32()%uint32(len(d.queues))]
+}
+
+// Dispatch 提交事件，返回执行结果的 Future，ctx 只用于 Block 策略下等待入队
+func (d *Dispatcher) Dispatch(ctx context.Context, id string, event Event) (*Future, error) {
+	return d.dispatch(ctx, id, event, nil)
+}
+
+// DispatchFunc 提交事件，执行完成后在工作协程中调用回调
+func (d *Dispatcher) DispatchFunc(ctx context.Context, id string, event Event, callback func(State, error)) error {
+	_, err := d.dispatch(ctx, id, event, callback)
+	return err
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context, id string, event Event, callback func(State, error)) (*Future, error) {
+	d.locker.RLock()
+	defer d.locker.RUnlock()
+	if d.closed {
+		return nil, ErrDispatcherClosed
+	}
+	task := dispatchTask{
+		ctx:      context.WithoutCancel(ctx),
+		id:       id,
+		event:    event,
+		future:   &Future{done: make(chan struct{})},
+		callback: callback,
+	}
+	queue := d.partition(id)
+	if d.policy == BackpressureReject {
+		select {
+		case queue <- task:
+			return task.future, nil
+		default:
+			return nil, ErrQueueFull
+		}
+	}
+	select {
+	case queue <- task:
+		return task.future, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close 停止接收新事件并等待队列中的事件执行完毕，上下文取消时不再等待
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.locker.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, queue := range d.queues {
+			close(queue)
+		}
+	}
+	d.locker.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,242 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dispatchMachine 支付动作执行 pay 的主订单状态机，实例 1 到 n 已创建
+func dispatchMachine(t *testing.T, n int, pay func(ctx context.Context) error) *StateMachine {
+	t.Helper()
+	m := mainBuilder().
+		Options(Options{Processor: testProcessor{}, Store: NewMemoryStore(), Quiet: true}).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).
+		DoContext(func(ctx context.Context, from State, event Event, to State) error { return pay(ctx) }).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+		MustBuild()
+	for i := 1; i <= n; i++ {
+		if _, err := m.Start(context.Background(), strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+// blockingPay 第一次支付时通知 entered 并等待 release，之后的支付直接通过
+func blockingPay() (pay func(ctx context.Context) error, entered, release chan struct{}) {
+	entered, release = make(chan struct{}), make(chan struct{})
+	first := true
+	return func(ctx context.Context) error {
+		if first {
+			first = false
+			close(entered)
+			<-release
+		}
+		return nil
+	}, entered, release
+}
+
+func TestDispatcherPerEntityOrder(t *testing.T) {
+	ctx := context.Background()
+	m := dispatchMachine(t, 50, func(ctx context.Context) error { return nil })
+	d := NewDispatcher(m, 4, 8, BackpressureBlock)
+	var futures []*Future
+	for i := 1; i <= 50; i++ {
+		// 支付确认必须在支付之后执行，否则流转失败
+		for _, event := range []Event{EventPay, EventPayConfirm} {
+			f, err := d.Dispatch(ctx, strconv.Itoa(i), event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			futures = append(futures, f)
+		}
+	}
+	for _, f := range futures {
+		if _, err := f.Wait(ctx); err != nil {
+			t.Fatalf("同一实体的事件应按提交顺序执行：%v", err)
+		}
+	}
+	if err := d.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatcherParallelEntities(t *testing.T) {
+	ctx := context.Background()
+	// 两个实体的支付动作必须同时进入才能通过
+	arrived, both := make(chan struct{}, 2), make(chan struct{})
+	var passed atomic.Int32
+	m := dispatchMachine(t, 2, func(ctx context.Context) error {
+		if arrived <- struct{}{}; len(arrived) == 2 {
+			close(both)
+		}
+		select {
+		case <-both:
+			passed.Add(1)
+		case <-time.After(time.Second):
+		}
+		return nil
+	})
+	d := NewDispatcher(m, 2, 1, BackpressureBlock)
+	defer d.Close(ctx)
+	var futures []*Future
+	for _, id := range []string{"1", "2"} {
+		f, err := d.Dispatch(ctx, id, EventPay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		futures = append(futures, f)
+	}
+	for _, f := range futures {
+		if _, err := f.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if passed.Load() != 2 {
+		t.Fatalf("不同实体应并行执行，同时进入动作的实体数：%d", passed.Load())
+	}
+}
+
+func TestDispatcherReject(t *testing.T) {
+	ctx := context.Background()
+	pay, entered, release := blockingPay()
+	d := NewDispatcher(dispatchMachine(t, 3, pay), 1, 1, BackpressureReject)
+	defer d.Close(ctx)
+	defer close(release)
+	if _, err := d.Dispatch(ctx, "1", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	if _, err := d.Dispatch(ctx, "2", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Dispatch(ctx, "3", EventPay); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("队列已满时应立即返回 ErrQueueFull：%v", err)
+	}
+}
+
+func TestDispatcherBlock(t *testing.T) {
+	ctx := context.Background()
+	pay, entered, release := blockingPay()
+	d := NewDispatcher(dispatchMachine(t, 3, pay), 1, 1, BackpressureBlock)
+	if _, err := d.Dispatch(ctx, "1", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	if _, err := d.Dispatch(ctx, "2", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := d.Dispatch(timeout, "3", EventPay); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("队列已满时应等待到上下文取消：%v", err)
+	}
+	close(release)
+	f, err := d.Dispatch(ctx, "3", EventPay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Wait(ctx); err != nil {
+		t.Fatalf("队列有空位后应入队执行：%v", err)
+	}
+	d.Close(ctx)
+}
+
+func TestDispatcherDetachedContext(t *testing.T) {
+	ctx := context.Background()
+	pay, entered, release := blockingPay()
+	d := NewDispatcher(dispatchMachine(t, 2, pay), 1, 2, BackpressureBlock)
+	if _, err := d.Dispatch(ctx, "1", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	submit, cancel := context.WithCancel(ctx)
+	f, err := d.Dispatch(submit, "2", EventPay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 提交方返回后取消上下文，事件照常执行
+	cancel()
+	close(release)
+	if to, err := f.Wait(ctx); err != nil || to != StateWaitConfirm {
+		t.Fatalf("提交上下文取消后事件仍应执行：%d %v", to, err)
+	}
+	d.Close(ctx)
+}
+
+func TestDispatcherTimeout(t *testing.T) {
+	ctx := context.Background()
+	m := dispatchMachine(t, 1, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	d := NewDispatcher(m, 1, 1, BackpressureBlock)
+	d.Timeout = 10 * time.Millisecond
+	f, err := d.Dispatch(ctx, "1", EventPay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("超过执行超时应返回上下文错误：%v", err)
+	}
+	d.Close(ctx)
+}
+
+func TestDispatcherPanic(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	m := dispatchMachine(t, 2, func(ctx context.Context) error {
+		if calls++; calls == 1 {
+			panic("支付网关异常")
+		}
+		return nil
+	})
+	d := NewDispatcher(m, 1, 2, BackpressureBlock)
+	first, _ := d.Dispatch(ctx, "1", EventPay)
+	second, _ := d.Dispatch(ctx, "2", EventPay)
+	if _, err := first.Wait(ctx); err == nil {
+		t.Fatal("panic 应转为错误")
+	}
+	if to, err := second.Wait(ctx); err != nil || to != StateWaitConfirm {
+		t.Fatalf("panic 后工作协程应继续执行：%d %v", to, err)
+	}
+	d.Close(ctx)
+}
+
+func TestDispatcherCloseDrains(t *testing.T) {
+	ctx := context.Background()
+	pay, entered, release := blockingPay()
+	d := NewDispatcher(dispatchMachine(t, 3, pay), 1, 2, BackpressureBlock)
+	var futures []*Future
+	for _, id := range []string{"1", "2", "3"} {
+		f, err := d.Dispatch(ctx, id, EventPay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		futures = append(futures, f)
+		if id == "1" {
+			<-entered
+		}
+	}
+	closed := make(chan error)
+	go func() { closed <- d.Close(ctx) }()
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range futures {
+		select {
+		case <-f.Done():
+		default:
+			t.Fatal("关闭时应执行完已入队的事件")
+		}
+	}
+	if _, err := d.Dispatch(ctx, "1", EventPayConfirm); !errors.Is(err, ErrDispatcherClosed) {
+		t.Fatalf("关闭后应拒绝新事件：%v", err)
+	}
+}
@@ -0,0 +1,4 @@
+// suborder 由 suborder.yaml 生成的子订单状态机示例
+package suborder
+
+//go:generate go run payment/fsm/cmd/fsmgen -in suborder.yaml
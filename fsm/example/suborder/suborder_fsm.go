@@ -0,0 +1,221 @@
+// Code generated by fsmgen. DO NOT EDIT.
+
+package suborder
+
+import (
+	"context"
+	"fmt"
+
+	"payment/fsm"
+)
+
+// SubOrderState 子订单状态机状态
+type SubOrderState fsm.State
+
+const (
+	// StateSubOrderWaitPay 待支付
+	StateSubOrderWaitPay SubOrderState = 0
+	// StateSubOrderWaitConfirm 待确认
+	StateSubOrderWaitConfirm SubOrderState = 1
+	// StateSubOrderWaitShip 待发货
+	StateSubOrderWaitShip SubOrderState = 2
+	// StateSubOrderWaitReceive 待收货
+	StateSubOrderWaitReceive SubOrderState = 3
+	// StateSubOrderAfterSaleRefund 售后中-退款
+	StateSubOrderAfterSaleRefund SubOrderState = 4
+	// StateSubOrderAfterSaleRefundReturn 售后中-退货退款
+	StateSubOrderAfterSaleRefundReturn SubOrderState = 5
+	// StateSubOrderCanceled 已取消
+	StateSubOrderCanceled SubOrderState = 6
+	// StateSubOrderReceived 已签收
+	StateSubOrderReceived SubOrderState = 7
+	// StateSubOrderCompleted 已完成
+	StateSubOrderCompleted SubOrderState = 8
+)
+
+var subOrderStateNames = map[SubOrderState]string{
+	StateSubOrderWaitPay:               "wait_pay",
+	StateSubOrderWaitConfirm:           "wait_confirm",
+	StateSubOrderWaitShip:              "wait_ship",
+	StateSubOrderWaitReceive:           "wait_receive",
+	StateSubOrderAfterSaleRefund:       "after_sale_refund",
+	StateSubOrderAfterSaleRefundReturn: "after_sale_refund_return",
+	StateSubOrderCanceled:              "canceled",
+	StateSubOrderReceived:              "received",
+	StateSubOrderCompleted:             "completed",
+}
+
+func (s SubOrderState) String() string {
+	if name, ok := subOrderStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("SubOrderState(%d)", uint8(s))
+}
+
+// SubOrderEvent 子订单状态机事件
+type SubOrderEvent fsm.Event
+
+const (
+	// EventSubOrderPay 支付
+	EventSubOrderPay SubOrderEvent = "pay"
+	// EventSubOrderPayConfirm 支付确认
+	EventSubOrderPayConfirm SubOrderEvent = "pay_confirm"
+	// EventSubOrderShip 发货
+	EventSubOrderShip SubOrderEvent = "ship"
+	// EventSubOrderReceive 签收
+	EventSubOrderReceive SubOrderEvent = "receive"
+	// EventSubOrderRefund 申请退款
+	EventSubOrderRefund SubOrderEvent = "refund"
+	// EventSubOrderRefundReturn 申请退货退款
+	EventSubOrderRefundReturn SubOrderEvent = "refund_return"
+	// EventSubOrderCancel 取消
+	EventSubOrderCancel SubOrderEvent = "cancel"
+	// EventSubOrderCancelAfterSale 取消售后
+	EventSubOrderCancelAfterSale SubOrderEvent = "cancel_after_sale"
+	// EventSubOrderAfterSaleComplete 售后完成
+	EventSubOrderAfterSaleComplete SubOrderEvent = "after_sale_complete"
+	// EventSubOrderComplete 订单完成
+	EventSubOrderComplete SubOrderEvent = "complete"
+)
+
+func (e SubOrderEvent) String() string {
+	return string(e)
+}
+
+// SubOrderActions 子订单状态机动作，由业务实现
+type SubOrderActions interface {
+	// Pay wait_pay -(pay)-> wait_confirm
+	Pay(ctx context.Context, from, to SubOrderState) error
+	// Cancel wait_pay -(cancel)-> canceled
+	Cancel(ctx context.Context, from, to SubOrderState) error
+	// PayConfirmFromWaitPay wait_pay -(pay_confirm)-> wait_ship
+	PayConfirmFromWaitPay(ctx context.Context, from, to SubOrderState) error
+	// PayConfirmFromWaitConfirm wait_confirm -(pay_confirm)-> wait_ship
+	PayConfirmFromWaitConfirm(ctx context.Context, from, to SubOrderState) error
+	// Ship wait_ship -(ship)-> wait_receive
+	Ship(ctx context.Context, from, to SubOrderState) error
+	// Refund wait_ship -(refund)-> after_sale_refund
+	Refund(ctx context.Context, from, to SubOrderState) error
+	// Receive wait_receive -(receive)-> received
+	Receive(ctx context.Context, from, to SubOrderState) error
+	// AfterSaleCompleteFromAfterSaleRefund after_sale_refund -(after_sale_complete)-> completed
+	AfterSaleCompleteFromAfterSaleRefund(ctx context.Context, from, to SubOrderState) error
+	// CancelAfterSaleFromAfterSaleRefund after_sale_refund -(cancel_after_sale)-> wait_ship
+	CancelAfterSaleFromAfterSaleRefund(ctx context.Context, from, to SubOrderState) error
+	// AfterSaleCompleteFromAfterSaleRefundReturn after_sale_refund_return -(after_sale_complete)-> completed
+	AfterSaleCompleteFromAfterSaleRefundReturn(ctx context.Context, from, to SubOrderState) error
+	// CancelAfterSaleFromAfterSaleRefundReturn after_sale_refund_return -(cancel_after_sale)-> received
+	CancelAfterSaleFromAfterSaleRefundReturn(ctx context.Context, from, to SubOrderState) error
+	// Complete received -(complete)-> completed
+	Complete(ctx context.Context, from, to SubOrderState) error
+	// RefundReturn received -(refund_return)-> after_sale_refund_return
+	RefundReturn(ctx context.Context, from, to SubOrderState) error
+}
+
+// SubOrderGuards 子订单状态机守卫，返回 false 时拒绝流转
+type SubOrderGuards interface {
+	// CanShip wait_ship -(ship)-> wait_receive
+	CanShip(ctx context.Context, from, to SubOrderState) bool
+	// CanRefundReturn received -(refund_return)-> after_sale_refund_return
+	CanRefundReturn(ctx context.Context, from, to SubOrderState) bool
+}
+
+// SubOrderTransition 转变器定义
+type SubOrderTransition struct {
+	From  SubOrderState
+	Event SubOrderEvent
+	To    SubOrderState
+}
+
+// SubOrderTransitions 子订单状态机转变器表
+var SubOrderTransitions = []SubOrderTransition{
+	{From: StateSubOrderWaitPay, Event: EventSubOrderPay, To: StateSubOrderWaitConfirm},
+	{From: StateSubOrderWaitPay, Event: EventSubOrderCancel, To: StateSubOrderCanceled},
+	{From: StateSubOrderWaitPay, Event: EventSubOrderPayConfirm, To: StateSubOrderWaitShip},
+	{From: StateSubOrderWaitConfirm, Event: EventSubOrderPayConfirm, To: StateSubOrderWaitShip},
+	{From: StateSubOrderWaitShip, Event: EventSubOrderShip, To: StateSubOrderWaitReceive},
+	{From: StateSubOrderWaitShip, Event: EventSubOrderRefund, To: StateSubOrderAfterSaleRefund},
+	{From: StateSubOrderWaitReceive, Event: EventSubOrderReceive, To: StateSubOrderReceived},
+	{From: StateSubOrderAfterSaleRefund, Event: EventSubOrderAfterSaleComplete, To: StateSubOrderCompleted},
+	{From: StateSubOrderAfterSaleRefund, Event: EventSubOrderCancelAfterSale, To: StateSubOrderWaitShip},
+	{From: StateSubOrderAfterSaleRefundReturn, Event: EventSubOrderAfterSaleComplete, To: StateSubOrderCompleted},
+	{From: StateSubOrderAfterSaleRefundReturn, Event: EventSubOrderCancelAfterSale, To: StateSubOrderReceived},
+	{From: StateSubOrderReceived, Event: EventSubOrderComplete, To: StateSubOrderCompleted},
+	{From: StateSubOrderReceived, Event: EventSubOrderRefundReturn, To: StateSubOrderAfterSaleRefundReturn},
+}
+
+// NewSubOrderMachine 使用业务动作创建子订单状态机，处理器为空实现，需要时通过 WithOptions 替换
+func NewSubOrderMachine(actions SubOrderActions, guards SubOrderGuards) (*fsm.StateMachine, error) {
+	b := fsm.NewBuilder("子订单状态机").
+		Processor(fsm.NopProcessor{}).
+		Start(fsm.State(StateSubOrderWaitPay)).
+		End(fsm.State(StateSubOrderCanceled), fsm.State(StateSubOrderCompleted))
+	b.State(fsm.State(StateSubOrderWaitPay), "待支付")
+	b.State(fsm.State(StateSubOrderWaitConfirm), "待确认")
+	b.State(fsm.State(StateSubOrderWaitShip), "待发货")
+	b.State(fsm.State(StateSubOrderWaitReceive), "待收货")
+	b.State(fsm.State(StateSubOrderAfterSaleRefund), "售后中-退款")
+	b.State(fsm.State(StateSubOrderAfterSaleRefundReturn), "售后中-退货退款")
+	b.State(fsm.State(StateSubOrderCanceled), "已取消")
+	b.State(fsm.State(StateSubOrderReceived), "已签收")
+	b.State(fsm.State(StateSubOrderCompleted), "已完成")
+	b.From(fsm.State(StateSubOrderWaitPay)).On(fsm.Event(EventSubOrderPay)).To(fsm.State(StateSubOrderWaitConfirm)).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.Pay(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderWaitPay)).On(fsm.Event(EventSubOrderCancel)).To(fsm.State(StateSubOrderCanceled)).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.Cancel(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderWaitPay)).On(fsm.Event(EventSubOrderPayConfirm)).To(fsm.State(StateSubOrderWaitShip)).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.PayConfirmFromWaitPay(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderWaitConfirm)).On(fsm.Event(EventSubOrderPayConfirm)).To(fsm.State(StateSubOrderWaitShip)).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.PayConfirmFromWaitConfirm(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderWaitShip)).On(fsm.Event(EventSubOrderShip)).To(fsm.State(StateSubOrderWaitReceive)).
+		When(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) bool {
+			return guards.CanShip(ctx, SubOrderState(from), SubOrderState(to))
+		}).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.Ship(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderWaitShip)).On(fsm.Event(EventSubOrderRefund)).To(fsm.State(StateSubOrderAfterSaleRefund)).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.Refund(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderWaitReceive)).On(fsm.Event(EventSubOrderReceive)).To(fsm.State(StateSubOrderReceived)).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.Receive(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderAfterSaleRefund)).On(fsm.Event(EventSubOrderAfterSaleComplete)).To(fsm.State(StateSubOrderCompleted)).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.AfterSaleCompleteFromAfterSaleRefund(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderAfterSaleRefund)).On(fsm.Event(EventSubOrderCancelAfterSale)).To(fsm.State(StateSubOrderWaitShip)).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.CancelAfterSaleFromAfterSaleRefund(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderAfterSaleRefundReturn)).On(fsm.Event(EventSubOrderAfterSaleComplete)).To(fsm.State(StateSubOrderCompleted)).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.AfterSaleCompleteFromAfterSaleRefundReturn(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderAfterSaleRefundReturn)).On(fsm.Event(EventSubOrderCancelAfterSale)).To(fsm.State(StateSubOrderReceived)).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.CancelAfterSaleFromAfterSaleRefundReturn(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderReceived)).On(fsm.Event(EventSubOrderComplete)).To(fsm.State(StateSubOrderCompleted)).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.Complete(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	b.From(fsm.State(StateSubOrderReceived)).On(fsm.Event(EventSubOrderRefundReturn)).To(fsm.State(StateSubOrderAfterSaleRefundReturn)).
+		When(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) bool {
+			return guards.CanRefundReturn(ctx, SubOrderState(from), SubOrderState(to))
+		}).
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.RefundReturn(ctx, SubOrderState(from), SubOrderState(to))
+		})
+	return b.Build()
+}
@@ -0,0 +1,97 @@
+// Code generated by fsmgen. DO NOT EDIT.
+
+package suborder
+
+import (
+	"context"
+	"testing"
+
+	"payment/fsm"
+)
+
+type stubSubOrder struct{}
+
+func (stubSubOrder) Pay(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) Cancel(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) PayConfirmFromWaitPay(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) PayConfirmFromWaitConfirm(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) Ship(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) CanShip(ctx context.Context, from, to SubOrderState) bool {
+	return true
+}
+
+func (stubSubOrder) Refund(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) Receive(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) AfterSaleCompleteFromAfterSaleRefund(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) CancelAfterSaleFromAfterSaleRefund(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) AfterSaleCompleteFromAfterSaleRefundReturn(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) CancelAfterSaleFromAfterSaleRefundReturn(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) Complete(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) RefundReturn(ctx context.Context, from, to SubOrderState) error {
+	return nil
+}
+
+func (stubSubOrder) CanRefundReturn(ctx context.Context, from, to SubOrderState) bool {
+	return true
+}
+
+func TestSubOrderDefinition(t *testing.T) {
+	m, err := NewSubOrderMachine(stubSubOrder{}, stubSubOrder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for state, name := range subOrderStateNames {
+		if state.String() != name {
+			t.Fatalf("状态名称错误：%d %s", uint8(state), state)
+		}
+	}
+	for _, tr := range SubOrderTransitions {
+		path, ok := m.Graph.ShortestPath(fsm.State(tr.From), fsm.State(tr.To))
+		if !ok || (tr.From != tr.To && len(path) == 0) {
+			t.Fatalf("转变器未生效：%s -(%s)-> %s", tr.From, tr.Event, tr.To)
+		}
+		found := false
+		for _, event := range m.Graph.AvailableEvents(fsm.State(tr.From)) {
+			found = found || event == fsm.Event(tr.Event)
+		}
+		if !found {
+			t.Fatalf("事件不可用：%s -(%s)->", tr.From, tr.Event)
+		}
+	}
+}
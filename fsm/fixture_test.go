@@ -0,0 +1,54 @@
+package fsm
+
+import "testing"
+
+// nop 空动作
+func nop(from State, event Event, to State) error { return nil }
+
+// testProcessor 测试处理器，EnterNewState 返回 enterErr
+type testProcessor struct {
+	enterErr error
+}
+
+func (p testProcessor) ExitOldState(from, to State) error { return nil }
+
+func (p testProcessor) EnterNewState(to State, event Event) error { return p.enterErr }
+
+// mainBuilder 测试用主订单状态机构建器，只声明状态、开始与结束状态以及处理器
+func mainBuilder() *Builder {
+	return NewBuilder(MainMachineName).
+		States(mainStates).
+		Start(StateWaitPay).
+		End(StatePayied, StateCanceled).
+		Processor(testProcessor{})
+}
+
+// mainFlow 测试用主订单流程：待支付 -(支付)-> 待确认，待支付 -(取消)-> 已取消，待确认 -(支付确认)-> 已支付，动作为空
+func mainFlow() *Builder {
+	return mainBuilder().
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).Do(nop).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop)
+}
+
+/** mainMachine 测试用主订单状态机
+* 1. 流程同 mainFlow
+* 2. 使用 options 作为运行配置，未设置处理器时使用测试处理器，不打印流转日志
+* 3. build 不为空时在构建前追加声明，如延迟事件、SLA
+**/
+func mainMachine(t *testing.T, options Options, build func(b *Builder)) *StateMachine {
+	t.Helper()
+	if options.Processor == nil {
+		options.Processor = testProcessor{}
+	}
+	options.Quiet = true
+	b := mainFlow().Options(options)
+	if build != nil {
+		build(b)
+	}
+	m, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
@@ -2,9 +2,13 @@
 package fsm
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
 /** 四个概念
@@ -19,12 +23,36 @@ type Event string
 
 type Action func(from State, event Event, to State) error
 
+// ContextAction 带上下文的动作，可以通过上下文获取事务、发件箱等运行信息
+type ContextAction func(ctx context.Context, from State, event Event, to State) error
+
+// Guard 守卫，返回 false 时拒绝流转；试运行同样会执行守卫，守卫不能有副作用
+type Guard func(ctx context.Context, from State, event Event, to State) bool
+
 type Transition struct {
-	From      State          `desc:"旧状态"`
-	Event     Event          `desc:"事件"`
-	To        State          `desc:"新状态"`
-	Action    Action         `desc:"动作"`
-	Processor EventProcessor `desc:"处理器"`
+	From          State           `desc:"旧状态"`
+	Event         Event           `desc:"事件"`
+	To            State           `desc:"新状态"`
+	Action        Action          `desc:"动作"`
+	ContextAction ContextAction   `desc:"上下文动作"`
+	Processor     EventProcessor  `desc:"处理器"`
+	Retry         *RetryPolicy    `desc:"重试策略"`
+	Permissions   []string        `desc:"触发所需权限"`
+	History       HistoryKind     `desc:"历史伪状态，To 为复合状态"`
+	Fallback      map[State]State `desc:"历史伪状态没有记录时，按当前状态返回的状态"`
+	Guard         Guard           `desc:"守卫"`
+	Raises        []Event         `desc:"动作可能产生的后续事件，用于试运行"`
+}
+
+// do 执行转变器动作，优先执行上下文动作
+func (t Transition) do(ctx context.Context, from State, event Event, to State) error {
+	if t.ContextAction != nil {
+		return t.ContextAction(ctx, from, event, to)
+	}
+	if t.Action != nil {
+		return t.Action(from, event, to)
+	}
+	return nil
 }
 
 // StateGraph 状态机图表
@@ -34,9 +62,94 @@ type StateGraph struct {
 	end         []State                        // 结束状态
 	states      map[State]string               // 状态集合
 	transitions map[State]map[Event]Transition // 转变器集合
+	permissions map[Event][]string             // 事件所需权限
+	composites  map[State]Composite            // 复合状态
+	parents     map[State]State                // 子状态 -> 复合状态
+	deferred    map[State][]Event              // 状态可以延迟的事件
+	slas        map[State]time.Duration        // 状态停留时长 SLA
+	labels      map[Locale]Labels              // 各语言的状态与事件名称
+	payloads    map[Event]json.RawMessage      // 事件参数的 JSON Schema
+
+	frozen   bool           // 是否已冻结
+	compiled *compiledGraph // 冻结时预编译的转变器表
+
+	cacheLocker sync.Mutex  // 查询缓存锁
+	cache       *graphCache // 查询缓存
+}
+
+// freeze 冻结图表，复制状态与转变器集合，冻结后不允许再修改
+func (g *StateGraph) freeze() {
+	if g.frozen {
+		return
+	}
+	end := make([]State, len(g.end))
+	copy(end, g.end)
+	states := make(map[State]string, len(g.states))
+	for state, name := range g.states {
+		states[state] = name
+	}
+	transitions := make(map[State]map[Event]Transition, len(g.transitions))
+	for from, events := range g.transitions {
+		transitions[from] = make(map[Event]Transition, len(events))
+		for event, transition := range events {
+			transitions[from][event] = transition
+		}
+	}
+	permissions := make(map[Event][]string, len(g.permissions))
+	for event, required := range g.permissions {
+		permissions[event] = append([]string(nil), required...)
+	}
+	composites := make(map[State]Composite, len(g.composites))
+	for state, composite := range g.composites {
+		composite.Children = append([]State(nil), composite.Children...)
+		composites[state] = composite
+	}
+	parents := make(map[State]State, len(g.parents))
+	for child, parent := range g.parents {
+		parents[child] = parent
+	}
+	g.end, g.states, g.transitions, g.permissions = end, states, transitions, permissions
+	deferred := make(map[State][]Event, len(g.deferred))
+	for state, events := range g.deferred {
+		deferred[state] = append([]Event(nil), events...)
+	}
+	slas := make(map[State]time.Duration, len(g.slas))
+	for state, sla := range g.slas {
+		slas[state] = sla
+	}
+	labels := make(map[Locale]Labels, len(g.labels))
+	for locale, l := range g.labels {
+		copied := Labels{States: make(map[State]string, len(l.States)), Events: make(map[Event]string, len(l.Events))}
+		for state, label := range l.States {
+			copied.States[state] = label
+		}
+		for event, label := range l.Events {
+			copied.Events[event] = label
+		}
+		labels[locale] = copied
+	}
+	payloads := make(map[Event]json.RawMessage, len(g.payloads))
+	for event, schema := range g.payloads {
+		payloads[event] = append(json.RawMessage(nil), schema...)
+	}
+	g.composites, g.parents, g.deferred, g.slas, g.labels = composites, parents, deferred, slas, labels
+	g.payloads = payloads
+	g.frozen = true
+	g.compiled = compileGraph(g)
+	g.invalidate()
+}
+
+// mustNotFrozen 修改已冻结的图表时 panic
+func (g *StateGraph) mustNotFrozen() {
+	if g.frozen {
+		panic(fmt.Sprintf("状态机已冻结，无法修改：%s", g.name))
+	}
 }
 
 func (g *StateGraph) IsEnd(state State) bool {
+	if g.compiled != nil {
+		return g.compiled.end[state]
+	}
 	for _, end := range g.end {
 		if state == end {
 			return true
@@ -54,11 +167,82 @@ type EventProcessor interface {
 	EnterNewState(to State, event Event) error
 }
 
-// 每个状态机都需要定义一个默认的处理器 Processor，并且每个转变器 Transition 也可以自定义自己的处理器，注意，状态机和转变器的 处理器不是覆盖关系，而是先后执行的关系。
+/** 状态机运行配置
+* 1. 通过 Builder.Options 或 SetOptions 在状态机冻结前设置，冻结后不可修改，流转中读取不加锁
+* 2. 已冻结的状态机（如注册后的内置状态机）通过 WithOptions 生成使用新配置的状态机
+**/
+type Options struct {
+	Processor EventProcessor `desc:"默认处理器，未设置时为空处理器"`
+	Store     StateStore     `desc:"状态存储，Fire 时使用"`
+
+	Idempotency      IdempotencyStore `desc:"幂等键存储，Fire 时使用"`
+	IdempotencyTTL   time.Duration    `desc:"幂等键保留时间，默认 24 小时"`
+	IdempotencyLease time.Duration    `desc:"幂等键处理中的预留时长，默认 1 分钟加上重试策略最长的等待时间"`
+
+	MaxCascadeDepth int `desc:"后续事件最大级联深度，默认 10"`
+	MaxDeferred     int `desc:"每个实例最多保存的延迟事件数，默认 16"`
+
+	Notifier Notifier        `desc:"状态变更通知"`
+	History  HistoryRecorder `desc:"流转历史，Fire 时记录"`
+	Tracer   Tracer          `desc:"钩子耗时跟踪"`
+
+	Authorizer Authorizer `desc:"事件权限判断，默认 DefaultAuthorizer"`
+
+	Unhandled  UnhandledPolicy   `desc:"未处理事件的策略，默认返回错误"`
+	DeadLetter DeadLetterHandler `desc:"死信处理器，Unhandled 为 UnhandledDeadLetter 时使用"`
+
+	Version int `desc:"状态机版本，Start 创建的实例绑定该版本，Fire 拒绝其他版本的实例"`
+
+	Quiet  bool   `desc:"不打印流转日志，高频调用时开启"`
+	Locale Locale `desc:"GetStateDesc 使用的语言，默认 DefaultLocale"`
+}
+
+// 每个状态机可以定义一个默认的处理器 Processor（未设置时为空处理器）以及多个监听器，并且每个转变器 Transition 也可以自定义自己的处理器，注意，状态机和转变器的 处理器不是覆盖关系，而是先后执行的关系。
 type StateMachine struct {
-	locker    sync.Mutex     // 排他锁
-	Processor EventProcessor // 默认处理器
-	Graph     *StateGraph    // 状态机图表
+	locker   sync.Mutex  // 排他锁，没有实例的流转使用
+	entities entityLocks // 实体锁，通过 Fire 执行的流转按实体加锁
+	Graph    *StateGraph // 状态机图表
+	options  Options     // 运行配置，冻结后不可修改
+
+	listeners listeners // 监听器，通过 AddListener 添加
+}
+
+/** 实体锁
+* 1. 同一实体的流转串行执行，钩子不会交错；不同实体的流转并行执行
+* 2. 只在当前状态机对象内生效，多个进程或 WithOptions 生成的状态机之间依靠状态存储的修订号发现并发修改
+**/
+type entityLocks struct {
+	locker sync.Mutex
+	locks  map[string]*entityLock
+}
+
+type entityLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock 锁定实体，返回解锁函数，没有等待者的锁在解锁时移除
+func (l *entityLocks) lock(id string) func() {
+	l.locker.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*entityLock)
+	}
+	e, ok := l.locks[id]
+	if !ok {
+		e = &entityLock{}
+		l.locks[id] = e
+	}
+	e.refs++
+	l.locker.Unlock()
+	e.Lock()
+	return func() {
+		e.Unlock()
+		l.locker.Lock()
+		if e.refs--; e.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.locker.Unlock()
+	}
 }
 
 func NewStateMachine() *StateMachine {
@@ -71,79 +255,317 @@ func NewStateMachine() *StateMachine {
 }
 
 func (s *StateMachine) SetName(name string) *StateMachine {
+	s.Graph.mustNotFrozen()
 	s.Graph.name = name
 	return s
 }
 
 func (s *StateMachine) SetStart(start State) *StateMachine {
+	s.Graph.mustNotFrozen()
 	s.Graph.start = start
 	return s
 }
 
 func (s *StateMachine) SetEnd(end []State) *StateMachine {
+	s.Graph.mustNotFrozen()
 	s.Graph.end = end
+	s.Graph.invalidate()
 	return s
 }
 
 func (s *StateMachine) SetStates(states map[State]string) *StateMachine {
+	s.Graph.mustNotFrozen()
 	s.Graph.states = states
+	s.Graph.invalidate()
 	return s
 }
 
 func (s *StateMachine) SetTransitions(transitions map[State]map[Event]Transition) *StateMachine {
+	s.Graph.mustNotFrozen()
 	s.Graph.transitions = transitions
+	s.Graph.invalidate()
+	return s
+}
+
+// SetPermissions 设置事件所需权限，转变器还可以通过 Transition.Permissions 声明额外的权限
+func (s *StateMachine) SetPermissions(permissions map[Event][]string) *StateMachine {
+	s.Graph.mustNotFrozen()
+	s.Graph.permissions = permissions
 	return s
 }
 
+// SetOptions 设置运行配置，状态机冻结后调用会 panic
+func (s *StateMachine) SetOptions(options Options) *StateMachine {
+	s.Graph.mustNotFrozen()
+	s.options = options
+	return s
+}
+
+// Options 当前运行配置的副本
+func (s *StateMachine) Options() Options {
+	return s.options
+}
+
+/** WithOptions 生成使用新配置的状态机
+* 1. 与当前状态机共享冻结后的图表，当前状态机未冻结时先冻结
+* 2. 监听器不复制，需要时在新状态机上添加
+**/
+func (s *StateMachine) WithOptions(options Options) *StateMachine {
+	s.Graph.freeze()
+	return &StateMachine{Graph: s.Graph, options: options}
+}
+
+func (s *StateMachine) Name() string {
+	return s.Graph.name
+}
+
+// GetStateDesc 状态在状态机语言下的名称及编号，如 待支付(0)
 func (s *StateMachine) GetStateDesc(state State) string {
-	return fmt.Sprintf("%s(%d)", s.Graph.states[state], state)
+	return fmt.Sprintf("%s(%d)", s.Graph.StateLabel(s.locale(), state), state)
 }
 
 /** 状态机 StateMachine 核心方法
-* 1. 状态及事件检测
+* 1. 状态及事件检测，检查操作人是否有权触发事件
 * 2. 执行状态机的处理器的 ExitOldState 方法
 * 3. 检查转变器是否定义了处理器，如果定义了，执行该处理器的 ExitOldState 方法
-* 4. 执行转变器定义的 Action
+* 4. 执行转变器定义的 Action，动作失败时按转变器的重试策略重试
 * 5. 执行状态机的处理器的 EnterNewState 方法
 * 6. 检查转变器是否定义了处理器，如果定义了，执行该处理器的 EnterNewState 方法
-* 7. 执行完毕
+* 7. 执行完毕，流转（含后续事件）全部成功后发布状态变更通知、调用异步监听器（见 commitBuffer）
+* 上下文中存在事务（WithTx）时为事务模式，任一处理器或动作失败都会中止流转并返回错误
+* 非事务模式下动作的错误与处理器一样打印日志后照常进入新状态；以下情况例外，动作最终失败时中止流转且不执行 EnterNewState：
+*   转变器声明了重试策略（重试用尽或错误不可重试），或者上下文已取消
+* 当前状态不处理的事件先检查是否可以延迟，再按 Unhandled 策略处理
 **/
 func (s *StateMachine) Run(from State, event Event) (State, error) {
-	log.Printf("状态流转开始，旧状态：%s，事件：%s\n", s.GetStateDesc(from), event)
-	// 检查旧状态是否存在
-	if _, ok := s.Graph.states[from]; !ok {
-		return 0, fmt.Errorf("旧状态不存在：%d", from)
+	return s.RunContext(context.Background(), from, event)
+}
+
+// RunContext 带上下文执行状态流转，上下文会传递给 ContextAction
+// 动作中通过 Raise 产生的后续事件在当前流转完成后依次执行，返回最终状态；
+// 后续事件失败时返回已经到达的状态与 ErrCascade，此时不发布状态变更通知
+func (s *StateMachine) RunContext(ctx context.Context, from State, event Event) (State, error) {
+	var buffer *commitBuffer
+	if s.afterCommit() {
+		ctx, buffer = withCommitBuffer(ctx)
 	}
-	// 检查旧状态是否已到最终状态
-	if s.Graph.IsEnd(from) {
-		return 0, fmt.Errorf("已到最终状态，无法流转")
+	to, followUps, err := s.transit(ctx, from, event)
+	if err != nil {
+		buffer.flush(ctx, err)
+		return 0, err
 	}
-	// 检查状态与事件是否匹配
-	transition, ok := s.Graph.transitions[from][event]
-	if !ok {
-		return 0, fmt.Errorf("未设置事件转换器")
+	if len(followUps) > 0 {
+		if to, err = s.drain(ctx, to, followUps); err != nil {
+			buffer.flush(ctx, err)
+			return to, err
+		}
 	}
-	to := transition.To
-	// 加锁
-	s.locker.Lock()
-	// 执行完成后解锁
-	defer s.locker.Unlock()
+	buffer.flush(ctx, nil)
+	return to, nil
+}
 
-	// 执行状态机处理器，退出旧状态
-	_ = s.Processor.ExitOldState(from, to)
-	// 如果当前转变器设置了处理器，则执行处理器的退出旧状态
-	if transition.Processor != nil {
-		_ = transition.Processor.ExitOldState(from, to)
+// transit 执行一次状态流转并记录流转历史，返回新状态及后续事件：动作产生的事件在前，重新投递的延迟事件在后
+func (s *StateMachine) transit(ctx context.Context, from State, event Event) (State, []queuedEvent, error) {
+	trace := s.startTrace(ctx, from, event)
+	to, attempt, raised, err := s.step(ctx, trace, from, event)
+	trace.finish(attempt, err)
+	if errors.Is(err, ErrPermissionDenied) {
+		s.auditDenied(ctx, from, event, err)
+		return 0, nil, err
+	}
+	if errors.Is(err, ErrUnhandledEvent) {
+		to, err := s.unhandled(ctx, from, event, err)
+		return to, nil, err
+	}
+	if err != nil {
+		s.record(ctx, from, event, from, attempt, err)
+		return 0, nil, err
+	}
+	s.record(ctx, from, event, to, attempt, nil)
+	var followUps []queuedEvent
+	for _, e := range raised {
+		followUps = append(followUps, queuedEvent{event: e})
+	}
+	if deferred, ok := s.redeliver(ctx, to); ok {
+		followUps = append(followUps, redelivered(deferred))
+	}
+	return to, followUps, nil
+}
+
+// prepare 查找转变器、检查权限、计算新状态并检查守卫，不执行任何钩子
+func (s *StateMachine) prepare(ctx context.Context, from State, event Event) (*Transition, State, error) {
+	// 检查旧状态是否存在、是否已到最终状态、状态与事件是否匹配
+	transition, result := s.Graph.lookup(from, event)
+	switch result {
+	case lookupUnknown:
+		return nil, 0, fmt.Errorf("旧状态不存在：%d", from)
+	case lookupEnd:
+		return nil, 0, &UnhandledError{State: from, Event: event, End: true}
+	case lookupNoneMatched:
+		return nil, 0, &UnhandledError{State: from, Event: event}
+	}
+	// 检查操作人权限
+	if err := s.authorize(ctx, transition); err != nil {
+		return nil, 0, err
+	}
+	// 计算新状态：复合状态进入初始子状态，历史伪状态返回进入前的状态
+	to, err := s.resolve(ctx, from, transition)
+	if err != nil {
+		return nil, 0, err
+	}
+	// 检查守卫
+	if transition.Guard != nil && !transition.Guard(ctx, from, event, to) {
+		return nil, 0, &GuardError{Machine: s.Name(), From: from, Event: event, To: to}
+	}
+	return transition, to, nil
+}
+
+// step 状态流转的核心步骤，返回新状态、动作的执行次数及动作产生的后续事件
+func (s *StateMachine) step(ctx context.Context, trace *stepTrace, from State, event Event) (State, int, []Event, error) {
+	if !s.options.Quiet {
+		log.Printf("状态流转开始，旧状态：%s，事件：%s\n", s.GetStateDesc(from), event)
+	}
+	transition, to, err := s.prepare(ctx, from, event)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	trace.target(to)
+	// 加锁：通过 Fire 执行时锁定实体，否则锁定状态机；执行完成后解锁
+	if inst, ok := instanceFrom(ctx); ok {
+		defer s.entities.lock(inst.ID)()
+	} else {
+		s.locker.Lock()
+		defer s.locker.Unlock()
+	}
+
+	attempt := 1
+	var raised []Event
+	for {
+		// 首次执行，或者重试策略要求重新退出旧状态
+		if attempt == 1 || transition.Retry.rerunExit() {
+			// 执行状态机处理器，退出旧状态
+			start := trace.now()
+			err := s.processor().ExitOldState(from, to)
+			trace.hook(HookExitOldState, attempt, start, err, nil)
+			if err := hookError(ctx, "ExitOldState", err); err != nil {
+				return 0, attempt, nil, err
+			}
+			// 执行监听器，退出旧状态
+			if err := s.notifyListeners(ctx, trace, attempt, listenerCall{from: from, to: to}); err != nil {
+				return 0, attempt, nil, err
+			}
+			// 如果当前转变器设置了处理器，则执行处理器的退出旧状态
+			if transition.Processor != nil {
+				start := trace.now()
+				err := transition.Processor.ExitOldState(from, to)
+				trace.hook(HookTransitionExitOldState, attempt, start, err, nil)
+				if err := hookError(ctx, "ExitOldState", err); err != nil {
+					return 0, attempt, nil, err
+				}
+			}
+		}
+		// 执行转变器动作，成功后才并入本次尝试产生的后续事件与消息
+		actionCtx, payloads := trace.withPayloads(ctx)
+		actionCtx, buffers := transition.withAttempt(actionCtx)
+		start := trace.now()
+		err := transition.do(actionCtx, from, event, to)
+		trace.hook(HookAction, attempt, start, err, payloads.take())
+		if err == nil {
+			raised = buffers.merge()
+			break
+		}
+		err = fmt.Errorf("转变器动作执行失败：%w", err)
+		if !transition.Retry.allow(err, attempt) {
+			if err := s.actionError(ctx, transition, err); err != nil {
+				return 0, attempt, nil, err
+			}
+			break
+		}
+		// 记录失败的尝试，等待期间继续持有锁，保证同一次流转的钩子不与其他流转交错
+		s.record(ctx, from, event, from, attempt, err)
+		if err := transition.Retry.wait(ctx, attempt); err != nil {
+			return 0, attempt, nil, err
+		}
+		attempt++
 	}
-	// 执行转变器动作
-	_ = transition.Action(from, event, to)
 	// 执行转变器处理器，进入新状态的方法
-	_ = s.Processor.EnterNewState(to, event)
+	start := trace.now()
+	err = s.processor().EnterNewState(to, event)
+	trace.hook(HookEnterNewState, attempt, start, err, nil)
+	if err := hookError(ctx, "EnterNewState", err); err != nil {
+		return 0, attempt, nil, err
+	}
+	// 执行监听器，进入新状态
+	if err := s.notifyListeners(ctx, trace, attempt, listenerCall{enter: true, from: from, to: to, event: event}); err != nil {
+		return 0, attempt, nil, err
+	}
 	// 如果当前转变器设置了处理器，则执行处理器的进入新状态的方法
 	if transition.Processor != nil {
-		_ = transition.Processor.EnterNewState(to, event)
+		start := trace.now()
+		err := transition.Processor.EnterNewState(to, event)
+		trace.hook(HookTransitionEnterNewState, attempt, start, err, nil)
+		if err := hookError(ctx, "EnterNewState", err); err != nil {
+			return 0, attempt, nil, err
+		}
 	}
-	return to, nil
+	// 记录复合状态的历史状态
+	s.remember(ctx, from, to)
+	// 发布状态变更通知
+	s.notify(ctx, from, event, to)
+	return to, attempt, raised, nil
+}
+
+// attemptBuffers 动作一次执行中产生的后续事件与发件箱消息
+type attemptBuffers struct {
+	queue                *eventQueue
+	outbox, parentOutbox *outboxBuffer
+}
+
+// withAttempt 上下文动作每次执行使用独立的队列与发件箱缓冲，普通动作无法产生事件与消息，不创建
+func (t *Transition) withAttempt(ctx context.Context) (context.Context, *attemptBuffers) {
+	if t.ContextAction == nil {
+		return ctx, nil
+	}
+	b := &attemptBuffers{queue: &eventQueue{}}
+	ctx = context.WithValue(ctx, queueKey, b.queue)
+	if outbox, ok := ctx.Value(outboxKey).(*outboxBuffer); ok {
+		b.parentOutbox, b.outbox = outbox, &outboxBuffer{}
+		ctx = context.WithValue(ctx, outboxKey, b.outbox)
+	}
+	return ctx, b
+}
+
+// merge 动作成功后把消息并入本次流转，返回产生的后续事件
+func (b *attemptBuffers) merge() []Event {
+	if b == nil {
+		return nil
+	}
+	if b.outbox != nil {
+		b.parentOutbox.merge(b.outbox)
+	}
+	return b.queue.take()
+}
+
+// actionError 动作最终失败：事务模式、转变器声明了重试策略或上下文已取消时返回错误，否则打印日志后继续流转
+func (s *StateMachine) actionError(ctx context.Context, transition *Transition, err error) error {
+	if _, ok := TxFrom(ctx); ok || transition.Retry != nil || ctx.Err() != nil {
+		return err
+	}
+	if !s.options.Quiet {
+		log.Printf("转变器动作执行失败，状态机：%s，事件：%s，错误：%v\n", s.Name(), transition.Event, err)
+	}
+	return nil
+}
+
+// hookError 处理器错误：事务模式下返回错误由调用方回滚，否则忽略
+func hookError(ctx context.Context, hook string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := TxFrom(ctx); ok {
+		return fmt.Errorf("处理器 %s 执行失败：%w", hook, err)
+	}
+	return nil
 }
 
 // 状态：待支付，待确认，已支付，已取消
@@ -178,17 +600,17 @@ const (
 )
 
 func MainPay(from State, event Event, to State) error {
-	log.Printf("主订单支付，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("主订单支付，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func MainPayConfirm(from State, event Event, to State) error {
-	log.Printf("主订单支付确认，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("主订单支付确认，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func MainCancel(from State, event Event, to State) error {
-	log.Printf("主订单取消，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("主订单取消，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
@@ -231,13 +653,48 @@ var mainStates = map[State]string{
 	StateCanceled:    "canceled",
 }
 
-// 主订单状态机
-var mainStateMachine = NewStateMachine().
-	SetName("主订单状态机").
+// 主订单状态与事件的中英文名称
+var mainLabels = map[Locale]Labels{
+	LocaleZhCN: {
+		States: map[State]string{
+			StateWaitPay:     "待支付",
+			StateWaitConfirm: "待确认",
+			StatePayied:      "已支付",
+			StateCanceled:    "已取消",
+		},
+		Events: map[Event]string{
+			EventPay:        "支付",
+			EventPayConfirm: "支付确认",
+			EventCancel:     "取消",
+		},
+	},
+	LocaleEnUS: {
+		States: map[State]string{
+			StateWaitPay:     "Awaiting payment",
+			StateWaitConfirm: "Awaiting confirmation",
+			StatePayied:      "Paid",
+			StateCanceled:    "Canceled",
+		},
+		Events: map[Event]string{
+			EventPay:        "Pay",
+			EventPayConfirm: "Confirm payment",
+			EventCancel:     "Cancel",
+		},
+	},
+}
+
+// MainStateMachine 主订单状态机
+var MainStateMachine = NewStateMachine().
+	SetName(MainMachineName).
 	SetEnd([]State{StateCanceled}).
 	SetStart(StateWaitPay).
 	SetTransitions(transitions).
-	SetStates(mainStates)
+	SetStates(mainStates).
+	SetPermissions(map[Event][]string{
+		EventPayConfirm: {RoleSystem},
+	}).
+	SetLabels(LocaleZhCN, mainLabels[LocaleZhCN]).
+	SetLabels(LocaleEnUS, mainLabels[LocaleEnUS])
 
 // 状态：待支付，待确认，待发货，待收货，售后中-退款，售后中-退货退款， 已取消，已签收，已完成
 // 事件：支付，支付确认，发货，签收，申请退款，申请退货退款，取消，取消售后, 售后完成，订单完成
@@ -248,13 +705,12 @@ var mainStateMachine = NewStateMachine().
 * 2.3 待确认 -(支付确认)-> 待发货
 * 2.5 待发货 -(发货)-> 待收货
 * 2.6 待发货 -(申请退款)-> 售后中-退款
-* 2.7 售后中-退款 -(售后完成)-> 已完成
-* 2.7 售后中-退款 -(取消售后)-> 待发货
-* 2.8 待收货 -(签收)-> 已签收
-* 2.9 已签收 -(订单完成)-> 已完成
-* 2.10 已签收 -(申请退货退款)-> 售后中-退货退款
-* 2.11 售后中-退货退款 -(售后完成)-> 已完成
-* 2.12 售后中-退货退款 -(取消售后)-> 已签收
+* 2.7 售后中 -(售后完成)-> 已完成
+* 2.8 售后中 -(取消售后)-> 进入售后前的状态（历史伪状态），没有记录时 售后中-退款 返回待发货，售后中-退货退款 返回已签收
+* 2.9 待收货 -(签收)-> 已签收
+* 2.10 已签收 -(订单完成)-> 已完成
+* 2.11 已签收 -(申请退货退款)-> 售后中-退货退款
+* 售后中为复合状态，包含 售后中-退款、售后中-退货退款
 **/
 
 // State 子订单状态
@@ -277,6 +733,8 @@ const (
 	StateSubReceived
 	// StateSubCompleted 已完成
 	StateSubCompleted
+	// StateSubAfterSale 售后中，复合状态
+	StateSubAfterSale
 )
 
 // Event 子订单事件
@@ -304,52 +762,52 @@ const (
 )
 
 func SubPay(from State, event Event, to State) error {
-	log.Printf("子订单支付，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("子订单支付，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func SubPayConfirm(from State, event Event, to State) error {
-	log.Printf("子订单支付确认，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("子订单支付确认，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func SubShip(from State, event Event, to State) error {
-	log.Printf("子订单发货，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("子订单发货，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func SubReceive(from State, event Event, to State) error {
-	log.Printf("子订单签收，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("子订单签收，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func SubRefund(from State, event Event, to State) error {
-	log.Printf("子订单退款，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("子订单退款，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func SubRefundAndReturn(from State, event Event, to State) error {
-	log.Printf("子订单退货退款，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("子订单退货退款，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func SubCancel(from State, event Event, to State) error {
-	log.Printf("子订单取消，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("子订单取消，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func SubCancelAfterSale(from State, event Event, to State) error {
-	log.Printf("子订单取消售后，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("子订单取消售后，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func SubAfterSaleComplete(from State, event Event, to State) error {
-	log.Printf("子订单售后完成，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("子订单售后完成，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func SubComplete(from State, event Event, to State) error {
-	log.Printf("子订单完成，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("子订单完成，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
@@ -405,32 +863,24 @@ var subTransitions = map[State]map[Event]Transition{
 			Event:  EventSubReceive,
 		},
 	},
-	StateSubAfterSaleRefund: {
+	StateSubAfterSale: {
 		EventSubAfterSaleComplete: {
-			From:   StateSubAfterSaleRefund,
+			From:   StateSubAfterSale,
 			Action: SubAfterSaleComplete,
 			To:     StateSubCompleted,
 			Event:  EventSubAfterSaleComplete,
 		},
 		EventSubCancelAfterSale: {
-			From:   StateSubAfterSaleRefund,
-			Action: SubCancelAfterSale,
-			To:     StateSubWaitShip,
-			Event:  EventSubCancelAfterSale,
-		},
-	},
-	StateSubAfterSaleRefundAndReturn: {
-		EventSubAfterSaleComplete: {
-			From:   StateSubAfterSaleRefundAndReturn,
-			Action: SubAfterSaleComplete,
-			To:     StateSubCompleted,
-			Event:  EventSubAfterSaleComplete,
-		},
-		EventSubCancelAfterSale: {
-			From:   StateSubAfterSaleRefundAndReturn,
-			Action: SubCancelAfterSale,
-			To:     StateSubReceived,
-			Event:  EventSubCancelAfterSale,
+			From:    StateSubAfterSale,
+			Action:  SubCancelAfterSale,
+			To:      StateSubAfterSale,
+			History: DeepHistory,
+			// 不带实例的 Run 与记录历史之前保存的实例，按原来的规则返回
+			Fallback: map[State]State{
+				StateSubAfterSaleRefund:          StateSubWaitShip,
+				StateSubAfterSaleRefundAndReturn: StateSubReceived,
+			},
+			Event: EventSubCancelAfterSale,
 		},
 	},
 	StateSubReceived: {
@@ -459,15 +909,92 @@ var subStates = map[State]string{
 	StateSubCanceled:                 "canceled",
 	StateSubReceived:                 "received",
 	StateSubCompleted:                "completed",
+	StateSubAfterSale:                "after_sale",
 }
 
-// 子订单状态机
-var subStateMachine = NewStateMachine().
-	SetName("子订单状态机").
+// subComposites 子订单复合状态
+var subComposites = map[State]Composite{
+	StateSubAfterSale: {
+		Initial:  StateSubAfterSaleRefund,
+		Children: []State{StateSubAfterSaleRefund, StateSubAfterSaleRefundAndReturn},
+	},
+}
+
+// 子订单状态与事件的中英文名称
+var subLabels = map[Locale]Labels{
+	LocaleZhCN: {
+		States: map[State]string{
+			StateSubWaitPay:                  "待支付",
+			StateSubWaitConfirm:              "待确认",
+			StateSubWaitShip:                 "待发货",
+			StateSubWaitReceive:              "待收货",
+			StateSubAfterSaleRefund:          "售后中-退款",
+			StateSubAfterSaleRefundAndReturn: "售后中-退货退款",
+			StateSubCanceled:                 "已取消",
+			StateSubReceived:                 "已签收",
+			StateSubCompleted:                "已完成",
+			StateSubAfterSale:                "售后中",
+		},
+		Events: map[Event]string{
+			EventSubPay:               "支付",
+			EventSubPayConfirm:        "支付确认",
+			EventSubShip:              "发货",
+			EventSubReceive:           "签收",
+			EventSubRefund:            "申请退款",
+			EventSubRefundAndReturn:   "申请退货退款",
+			EventSubCancel:            "取消",
+			EventSubCancelAfterSale:   "取消售后",
+			EventSubAfterSaleComplete: "售后完成",
+			EventSubComplete:          "订单完成",
+		},
+	},
+	LocaleEnUS: {
+		States: map[State]string{
+			StateSubWaitPay:                  "Awaiting payment",
+			StateSubWaitConfirm:              "Awaiting confirmation",
+			StateSubWaitShip:                 "Awaiting shipment",
+			StateSubWaitReceive:              "Awaiting delivery",
+			StateSubAfterSaleRefund:          "After-sales: refund",
+			StateSubAfterSaleRefundAndReturn: "After-sales: return and refund",
+			StateSubCanceled:                 "Canceled",
+			StateSubReceived:                 "Delivered",
+			StateSubCompleted:                "Completed",
+			StateSubAfterSale:                "After-sales",
+		},
+		Events: map[Event]string{
+			EventSubPay:               "Pay",
+			EventSubPayConfirm:        "Confirm payment",
+			EventSubShip:              "Ship",
+			EventSubReceive:           "Confirm delivery",
+			EventSubRefund:            "Request refund",
+			EventSubRefundAndReturn:   "Request return and refund",
+			EventSubCancel:            "Cancel",
+			EventSubCancelAfterSale:   "Cancel after-sales",
+			EventSubAfterSaleComplete: "Complete after-sales",
+			EventSubComplete:          "Complete order",
+		},
+	},
+}
+
+// SubStateMachine 子订单状态机
+var SubStateMachine = NewStateMachine().
+	SetName(SubMachineName).
 	SetEnd([]State{StateSubCompleted, StateSubCanceled}).
 	SetStart(StateSubWaitPay).
 	SetTransitions(subTransitions).
-	SetStates(subStates)
+	SetStates(subStates).
+	SetComposites(subComposites).
+	SetPermissions(map[Event][]string{
+		EventSubPayConfirm: {RoleSystem},
+	}).
+	SetSLA(map[State]time.Duration{
+		StateSubWaitShip: 48 * time.Hour,
+	}).
+	SetLabels(LocaleZhCN, subLabels[LocaleZhCN]).
+	SetLabels(LocaleEnUS, subLabels[LocaleEnUS]).
+	SetPayloadSchemas(map[Event]json.RawMessage{
+		EventSubShip: json.RawMessage(`{"type":"object","required":["carrier","tracking_no"],"properties":{"carrier":{"type":"string"},"tracking_no":{"type":"string"}}}`),
+	})
 
 // 状态：待审批，已驳回，已通过，已取消， 退货中，待收货，退款中，已完成
 // 事件：驳回，通过，取消，发货，签收，退款完成，等待用户寄回
@@ -524,47 +1051,47 @@ const (
 )
 
 func AfterSaleReject(from State, event Event, to State) error {
-	log.Printf("售后驳回，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("售后驳回，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func AfterSalePass(from State, event Event, to State) error {
-	log.Printf("售后通过，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("售后通过，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func AfterSaleCancel(from State, event Event, to State) error {
-	log.Printf("售后取消，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("售后取消，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func AfterSaleShip(from State, event Event, to State) error {
-	log.Printf("售后发货，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("售后发货，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func AfterSaleReceive(from State, event Event, to State) error {
-	log.Printf("售后签收，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("售后签收，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func AfterSaleRefund(from State, event Event, to State) error {
-	log.Printf("售后退款，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("售后退款，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func AfterSaleReturn(from State, event Event, to State) error {
-	log.Printf("售后退货，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("售后退货，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func AfterSaleComplete(from State, event Event, to State) error {
-	log.Printf("售后完成，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("售后完成，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
 func AfterSaleRefundReq(from State, event Event, to State) error {
-	log.Printf("售后退款申请，旧状态：%s，新状态：%s\n", from, to)
+	log.Printf("售后退款申请，旧状态：%d，新状态：%d\n", from, to)
 	return nil
 }
 
@@ -642,10 +1169,70 @@ var afterSaleStates = map[State]string{
 	StateAfterSaleComplete:    "complete",
 }
 
-// 售后状态机
-var afterSaleStateMachine = NewStateMachine().
-	SetName("售后状态机").
+// 售后状态与事件的中英文名称
+var afterSaleLabels = map[Locale]Labels{
+	LocaleZhCN: {
+		States: map[State]string{
+			StateAfterSaleWaitReview:  "待审批",
+			StateAfterSaleReject:      "已驳回",
+			StateAfterSalePass:        "已通过",
+			StateAfterSaleCancel:      "已取消",
+			StateAfterSaleReturn:      "退货中",
+			StateAfterSaleWaitReceive: "待收货",
+			StateAfterSaleRefund:      "退款中",
+			StateAfterSaleComplete:    "已完成",
+		},
+		Events: map[Event]string{
+			EventAfterSaleReject:  "驳回",
+			EventAfterSalePass:    "通过",
+			EventAfterSaleCancel:  "取消",
+			EventAfterSaleShip:    "发货",
+			EventAfterSaleReceive: "签收",
+			EventAfterSaleRefund:  "退款完成",
+			EventAfterSaleReturn:  "等待用户寄回",
+			EventRefundReq:        "退款申请",
+		},
+	},
+	LocaleEnUS: {
+		States: map[State]string{
+			StateAfterSaleWaitReview:  "Awaiting review",
+			StateAfterSaleReject:      "Rejected",
+			StateAfterSalePass:        "Approved",
+			StateAfterSaleCancel:      "Canceled",
+			StateAfterSaleReturn:      "Returning",
+			StateAfterSaleWaitReceive: "Awaiting return delivery",
+			StateAfterSaleRefund:      "Refunding",
+			StateAfterSaleComplete:    "Completed",
+		},
+		Events: map[Event]string{
+			EventAfterSaleReject:  "Reject",
+			EventAfterSalePass:    "Approve",
+			EventAfterSaleCancel:  "Cancel",
+			EventAfterSaleShip:    "Ship return",
+			EventAfterSaleReceive: "Receive return",
+			EventAfterSaleRefund:  "Complete refund",
+			EventAfterSaleReturn:  "Await customer return",
+			EventRefundReq:        "Request refund",
+		},
+	},
+}
+
+// AfterSaleStateMachine 售后状态机
+var AfterSaleStateMachine = NewStateMachine().
+	SetName(AfterSaleMachineName).
 	SetEnd([]State{StateAfterSaleComplete, StateAfterSaleCancel, StateAfterSaleReject}).
 	SetStart(StateAfterSaleWaitReview).
 	SetTransitions(afterSaleTransitions).
-	SetStates(afterSaleStates)
+	SetStates(afterSaleStates).
+	SetPermissions(map[Event][]string{
+		EventAfterSalePass:   {RoleCSSupervisor},
+		EventAfterSaleReject: {RoleCSSupervisor},
+	}).
+	SetSLA(map[State]time.Duration{
+		StateAfterSaleWaitReview: 24 * time.Hour,
+	}).
+	SetLabels(LocaleZhCN, afterSaleLabels[LocaleZhCN]).
+	SetLabels(LocaleEnUS, afterSaleLabels[LocaleEnUS]).
+	SetPayloadSchemas(map[Event]json.RawMessage{
+		EventAfterSaleReject: json.RawMessage(`{"type":"object","required":["reason"],"properties":{"reason":{"type":"string","maxLength":200}}}`),
+	})
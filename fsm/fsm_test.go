@@ -0,0 +1,56 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// enterRecorder 记录是否执行了 EnterNewState
+type enterRecorder struct {
+	entered *bool
+}
+
+func (p enterRecorder) ExitOldState(from, to State) error { return nil }
+
+func (p enterRecorder) EnterNewState(to State, event Event) error {
+	*p.entered = true
+	return nil
+}
+
+func TestRunActionError(t *testing.T) {
+	failure := errors.New("渠道超时")
+	session, _ := newFakeSession(t)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, c := range []struct {
+		name  string
+		ctx   context.Context
+		retry bool
+		abort bool
+	}{
+		{"ignored", context.Background(), false, false},
+		{"tx", WithTx(context.Background(), session), false, true},
+		{"retry_policy", context.Background(), true, true},
+		{"canceled", canceled, false, true},
+	} {
+		entered := false
+		pay := mainBuilder().
+			Options(Options{Processor: enterRecorder{entered: &entered}, Quiet: true}).
+			From(StateWaitPay).On(EventPay).To(StateWaitConfirm)
+		if c.retry {
+			pay.Retry(RetryPolicy{MaxAttempts: 1})
+		}
+		m := pay.Do(func(from State, event Event, to State) error { return failure }).
+			From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+			From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+			MustBuild()
+		to, err := m.RunContext(c.ctx, StateWaitPay, EventPay)
+		if c.abort && (!errors.Is(err, failure) || to != 0 || entered) {
+			t.Fatalf("%s：动作失败时流转应中止：%d %v %v", c.name, to, err, entered)
+		}
+		if !c.abort && (err != nil || to != StateWaitConfirm || !entered) {
+			t.Fatalf("%s：非事务模式下动作的错误应被忽略：%d %v %v", c.name, to, err, entered)
+		}
+	}
+}
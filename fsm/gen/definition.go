@@ -0,0 +1,236 @@
+// 状态机代码生成器：从 YAML/JSON/DOT 定义生成状态、事件常量，转变器表，动作接口及校验测试
+package gen
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+/** 状态机定义
+* 1. Package 生成代码的包名，Machine 生成标识符的前缀，Name 状态机名称
+* 2. States 必须通过 Value 指定状态值（0~255），状态值会被持久化，调整顺序或插入状态不会改变已有的值；Start 开始状态，End 结束状态
+* 3. Transitions 中 Action 为空时按事件名生成动作方法名，Guard 为 true 时生成守卫方法
+**/
+type Definition struct {
+	Package     string          `json:"package" yaml:"package"`
+	Machine     string          `json:"machine" yaml:"machine"`
+	Name        string          `json:"name" yaml:"name"`
+	Start       string          `json:"start" yaml:"start"`
+	End         []string        `json:"end" yaml:"end"`
+	States      []StateDef      `json:"states" yaml:"states"`
+	Events      []EventDef      `json:"events" yaml:"events"`
+	Transitions []TransitionDef `json:"transitions" yaml:"transitions"`
+}
+
+type StateDef struct {
+	Name  string `json:"name" yaml:"name"`
+	Value *int   `json:"value" yaml:"value"`
+	Desc  string `json:"desc" yaml:"desc"`
+}
+
+type EventDef struct {
+	Name string `json:"name" yaml:"name"`
+	Desc string `json:"desc" yaml:"desc"`
+}
+
+type TransitionDef struct {
+	From   string `json:"from" yaml:"from"`
+	Event  string `json:"event" yaml:"event"`
+	To     string `json:"to" yaml:"to"`
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+	Guard  bool   `json:"guard,omitempty" yaml:"guard,omitempty"`
+}
+
+// Load 按扩展名读取 .yaml/.yml/.json/.dot 定义
+func Load(path string) (*Definition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	def := &Definition{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, def)
+	case ".json":
+		err = json.Unmarshal(data, def)
+	case ".dot", ".gv":
+		def, err = ParseDOT(string(data))
+	default:
+		return nil, fmt.Errorf("不支持的定义文件：%s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("定义文件解析失败：%s：%w", path, err)
+	}
+	return def, def.Validate()
+}
+
+var (
+	dotGraphRe = regexp.MustCompile(`digraph\s+"?(\w+)"?\s*\{`)
+	dotEdgeRe  = regexp.MustCompile(`^"?(\w+)"?\s*->\s*"?(\w+)"?\s*(?:\[(.*)\])?\s*;?$`)
+	dotNodeRe  = regexp.MustCompile(`^"?(\w+)"?\s*\[(.*)\]\s*;?$`)
+	dotAttrRe  = regexp.MustCompile(`(\w+)\s*=\s*(?:"([^"]*)"|(\w+))`)
+)
+
+/** ParseDOT 解析 DOT 子集
+* 1. digraph 名称作为 Machine，注释 // package: xxx 与 // name: xxx 指定包名与状态机名称
+* 2. 名为 start 的节点表示开始，start -> x 指定开始状态
+* 3. shape=doublecircle 的节点为结束状态，节点 label 作为状态描述，value 为状态值
+* 4. 边的 label 为事件名，可选属性 action、guard=true、desc
+**/
+func ParseDOT(src string) (*Definition, error) {
+	def := &Definition{}
+	m := dotGraphRe.FindStringSubmatch(src)
+	if m == nil {
+		return nil, fmt.Errorf("缺少 digraph 声明")
+	}
+	def.Machine = m[1]
+	states := map[string]bool{}
+	events := map[string]bool{}
+	addState := func(name string, attrs map[string]string) error {
+		if name == "start" {
+			return nil
+		}
+		if !states[name] {
+			states[name] = true
+			def.States = append(def.States, StateDef{Name: name})
+		}
+		for i := range def.States {
+			if def.States[i].Name != name {
+				continue
+			}
+			if desc := attrs["label"]; desc != "" {
+				def.States[i].Desc = desc
+			}
+			if v, ok := attrs["value"]; ok {
+				value, err := strconv.Atoi(v)
+				if err != nil {
+					return fmt.Errorf("状态值错误：%s：%s", name, v)
+				}
+				def.States[i].Value = &value
+			}
+		}
+		return nil
+	}
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "// package:"):
+			def.Package = strings.TrimSpace(strings.TrimPrefix(line, "// package:"))
+		case strings.HasPrefix(line, "// name:"):
+			def.Name = strings.TrimSpace(strings.TrimPrefix(line, "// name:"))
+		}
+		if m := dotEdgeRe.FindStringSubmatch(line); m != nil {
+			attrs := dotAttrs(m[3])
+			if m[1] == "start" {
+				def.Start = m[2]
+				addState(m[2], nil)
+				continue
+			}
+			addState(m[1], nil)
+			addState(m[2], nil)
+			event := attrs["label"]
+			if event == "" {
+				return nil, fmt.Errorf("边缺少事件：%s -> %s", m[1], m[2])
+			}
+			if !events[event] {
+				events[event] = true
+				def.Events = append(def.Events, EventDef{Name: event, Desc: attrs["desc"]})
+			}
+			def.Transitions = append(def.Transitions, TransitionDef{
+				From:   m[1],
+				Event:  event,
+				To:     m[2],
+				Action: attrs["action"],
+				Guard:  attrs["guard"] == "true",
+			})
+			continue
+		}
+		if m := dotNodeRe.FindStringSubmatch(line); m != nil {
+			if m[1] == "node" || m[1] == "edge" || m[1] == "graph" {
+				continue
+			}
+			attrs := dotAttrs(m[2])
+			if err := addState(m[1], attrs); err != nil {
+				return nil, err
+			}
+			if attrs["shape"] == "doublecircle" {
+				def.End = append(def.End, m[1])
+			}
+		}
+	}
+	return def, nil
+}
+
+func dotAttrs(s string) map[string]string {
+	attrs := map[string]string{}
+	for _, m := range dotAttrRe.FindAllStringSubmatch(s, -1) {
+		if m[2] != "" {
+			attrs[m[1]] = m[2]
+		} else {
+			attrs[m[1]] = m[3]
+		}
+	}
+	return attrs
+}
+
+// Validate 校验定义：名称、状态与状态值、事件引用以及转变器重复
+func (d *Definition) Validate() error {
+	if d.Package == "" || d.Machine == "" {
+		return fmt.Errorf("缺少 package 或 machine")
+	}
+	if d.Name == "" {
+		d.Name = d.Machine
+	}
+	states := map[string]bool{}
+	values := map[int]string{}
+	for _, s := range d.States {
+		if states[s.Name] {
+			return fmt.Errorf("状态重复：%s", s.Name)
+		}
+		states[s.Name] = true
+		if s.Value == nil {
+			return fmt.Errorf("状态缺少 value：%s", s.Name)
+		}
+		if *s.Value < 0 || *s.Value > 255 {
+			return fmt.Errorf("状态值超出范围 0~255：%s：%d", s.Name, *s.Value)
+		}
+		if other, ok := values[*s.Value]; ok {
+			return fmt.Errorf("状态值重复：%s 与 %s：%d", other, s.Name, *s.Value)
+		}
+		values[*s.Value] = s.Name
+	}
+	events := map[string]bool{}
+	for _, e := range d.Events {
+		events[e.Name] = true
+	}
+	if !states[d.Start] {
+		return fmt.Errorf("开始状态未声明：%s", d.Start)
+	}
+	for _, s := range d.End {
+		if !states[s] {
+			return fmt.Errorf("结束状态未声明：%s", s)
+		}
+	}
+	seen := map[[2]string]bool{}
+	for _, t := range d.Transitions {
+		if !states[t.From] || !states[t.To] {
+			return fmt.Errorf("转变器状态未声明：%s -(%s)-> %s", t.From, t.Event, t.To)
+		}
+		if !events[t.Event] {
+			return fmt.Errorf("转变器事件未声明：%s", t.Event)
+		}
+		key := [2]string{t.From, t.Event}
+		if seen[key] {
+			return fmt.Errorf("转变器重复：%s -(%s)->", t.From, t.Event)
+		}
+		seen[key] = true
+	}
+	return nil
+}
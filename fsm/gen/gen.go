@@ -0,0 +1,300 @@
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// camel 把 wait_pay / after-sale 转换为 WaitPay / AfterSale
+func camel(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		if r == '_' || r == '-' || r == ' ' || r == '.' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// lowerFirst 首字母小写，用于包内变量名
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(s)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
+
+type stateData struct {
+	Const string
+	Value int
+	Name  string
+	Desc  string
+}
+
+type eventData struct {
+	Const string
+	Name  string
+	Desc  string
+}
+
+type transitionData struct {
+	From   string
+	Event  string
+	To     string
+	Desc   string
+	Method string
+	Guard  string
+}
+
+type templateData struct {
+	Package     string
+	Machine     string
+	Var         string
+	Name        string
+	Start       string
+	End         []string
+	States      []stateData
+	Events      []eventData
+	Transitions []transitionData
+	HasGuards   bool
+}
+
+func newTemplateData(def *Definition) templateData {
+	data := templateData{
+		Package: def.Package,
+		Machine: def.Machine,
+		Var:     lowerFirst(def.Machine),
+		Name:    def.Name,
+	}
+	stateConst := func(name string) string { return "State" + def.Machine + camel(name) }
+	eventConst := func(name string) string { return "Event" + def.Machine + camel(name) }
+	data.Start = stateConst(def.Start)
+	for _, s := range def.End {
+		data.End = append(data.End, stateConst(s))
+	}
+	for _, s := range def.States {
+		desc := s.Desc
+		if desc == "" {
+			desc = s.Name
+		}
+		data.States = append(data.States, stateData{Const: stateConst(s.Name), Value: *s.Value, Name: s.Name, Desc: desc})
+	}
+	eventCount := map[string]int{}
+	for _, t := range def.Transitions {
+		eventCount[t.Event]++
+	}
+	for _, e := range def.Events {
+		data.Events = append(data.Events, eventData{Const: eventConst(e.Name), Name: e.Name, Desc: e.Desc})
+	}
+	for _, t := range def.Transitions {
+		method := t.Action
+		if method == "" {
+			method = camel(t.Event)
+			if eventCount[t.Event] > 1 {
+				method += "From" + camel(t.From)
+			}
+		}
+		td := transitionData{
+			From:   stateConst(t.From),
+			Event:  eventConst(t.Event),
+			To:     stateConst(t.To),
+			Desc:   fmt.Sprintf("%s -(%s)-> %s", t.From, t.Event, t.To),
+			Method: method,
+		}
+		if t.Guard {
+			td.Guard = "Can" + method
+			data.HasGuards = true
+		}
+		data.Transitions = append(data.Transitions, td)
+	}
+	return data
+}
+
+// Generate 生成状态机代码与校验测试，返回格式化后的源码
+func Generate(def *Definition) (code []byte, test []byte, err error) {
+	if err := def.Validate(); err != nil {
+		return nil, nil, err
+	}
+	data := newTemplateData(def)
+	if code, err = render(codeTemplate, data); err != nil {
+		return nil, nil, err
+	}
+	if test, err = render(testTemplate, data); err != nil {
+		return nil, nil, err
+	}
+	return code, test, nil
+}
+
+func render(tmpl *template.Template, data templateData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("生成代码格式化失败：%w\n%s", err, buf.String())
+	}
+	return src, nil
+}
+
+var codeTemplate = template.Must(template.New("code").Parse(`// Code generated by fsmgen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+	"fmt"
+
+	"payment/fsm"
+)
+
+// {{.Machine}}State {{.Name}}状态
+type {{.Machine}}State fsm.State
+
+const (
+{{- range .States}}
+	// {{.Const}} {{.Desc}}
+	{{.Const}} {{$.Machine}}State = {{.Value}}
+{{- end}}
+)
+
+var {{.Var}}StateNames = map[{{.Machine}}State]string{
+{{- range .States}}
+	{{.Const}}: "{{.Name}}",
+{{- end}}
+}
+
+func (s {{.Machine}}State) String() string {
+	if name, ok := {{.Var}}StateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("{{.Machine}}State(%d)", uint8(s))
+}
+
+// {{.Machine}}Event {{.Name}}事件
+type {{.Machine}}Event fsm.Event
+
+const (
+{{- range .Events}}
+	// {{.Const}} {{.Desc}}
+	{{.Const}} {{$.Machine}}Event = "{{.Name}}"
+{{- end}}
+)
+
+func (e {{.Machine}}Event) String() string {
+	return string(e)
+}
+
+// {{.Machine}}Actions {{.Name}}动作，由业务实现
+type {{.Machine}}Actions interface {
+{{- range .Transitions}}
+	// {{.Method}} {{.Desc}}
+	{{.Method}}(ctx context.Context, from, to {{$.Machine}}State) error
+{{- end}}
+}
+{{if .HasGuards}}
+// {{.Machine}}Guards {{.Name}}守卫，返回 false 时拒绝流转
+type {{.Machine}}Guards interface {
+{{- range .Transitions}}{{if .Guard}}
+	// {{.Guard}} {{.Desc}}
+	{{.Guard}}(ctx context.Context, from, to {{$.Machine}}State) bool
+{{- end}}{{end}}
+}
+{{end}}
+// {{.Machine}}Transition 转变器定义
+type {{.Machine}}Transition struct {
+	From  {{.Machine}}State
+	Event {{.Machine}}Event
+	To    {{.Machine}}State
+}
+
+// {{.Machine}}Transitions {{.Name}}转变器表
+var {{.Machine}}Transitions = []{{.Machine}}Transition{
+{{- range .Transitions}}
+	{From: {{.From}}, Event: {{.Event}}, To: {{.To}}},
+{{- end}}
+}
+
+// New{{.Machine}}Machine 使用业务动作创建{{.Name}}，处理器为空实现，需要时通过 WithOptions 替换
+func New{{.Machine}}Machine(actions {{.Machine}}Actions{{if .HasGuards}}, guards {{.Machine}}Guards{{end}}) (*fsm.StateMachine, error) {
+	b := fsm.NewBuilder("{{.Name}}").
+		Processor(fsm.NopProcessor{}).
+		Start(fsm.State({{.Start}})).
+		End({{range .End}}fsm.State({{.}}), {{end}})
+{{- range .States}}
+	b.State(fsm.State({{.Const}}), "{{.Desc}}")
+{{- end}}
+{{- range .Transitions}}
+	b.From(fsm.State({{.From}})).On(fsm.Event({{.Event}})).To(fsm.State({{.To}})).
+{{- if .Guard}}
+		When(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) bool {
+			return guards.{{.Guard}}(ctx, {{$.Machine}}State(from), {{$.Machine}}State(to))
+		}).
+{{- end}}
+		DoContext(func(ctx context.Context, from fsm.State, event fsm.Event, to fsm.State) error {
+			return actions.{{.Method}}(ctx, {{$.Machine}}State(from), {{$.Machine}}State(to))
+		})
+{{- end}}
+	return b.Build()
+}
+`))
+
+var testTemplate = template.Must(template.New("test").Parse(`// Code generated by fsmgen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+	"testing"
+
+	"payment/fsm"
+)
+
+type stub{{.Machine}} struct{}
+{{range .Transitions}}
+func (stub{{$.Machine}}) {{.Method}}(ctx context.Context, from, to {{$.Machine}}State) error {
+	return nil
+}
+{{if .Guard}}
+func (stub{{$.Machine}}) {{.Guard}}(ctx context.Context, from, to {{$.Machine}}State) bool {
+	return true
+}
+{{end}}{{end}}
+func Test{{.Machine}}Definition(t *testing.T) {
+	m, err := New{{.Machine}}Machine(stub{{.Machine}}{}{{if .HasGuards}}, stub{{.Machine}}{}{{end}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for state, name := range {{.Var}}StateNames {
+		if state.String() != name {
+			t.Fatalf("状态名称错误：%d %s", uint8(state), state)
+		}
+	}
+	for _, tr := range {{.Machine}}Transitions {
+		path, ok := m.Graph.ShortestPath(fsm.State(tr.From), fsm.State(tr.To))
+		if !ok || (tr.From != tr.To && len(path) == 0) {
+			t.Fatalf("转变器未生效：%s -(%s)-> %s", tr.From, tr.Event, tr.To)
+		}
+		found := false
+		for _, event := range m.Graph.AvailableEvents(fsm.State(tr.From)) {
+			found = found || event == fsm.Event(tr.Event)
+		}
+		if !found {
+			t.Fatalf("事件不可用：%s -(%s)->", tr.From, tr.Event)
+		}
+	}
+}
+`))
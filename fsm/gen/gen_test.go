@@ -0,0 +1,180 @@
+package gen
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const orderDOT = `// package: order
+// name: 订单状态机
+digraph Order {
+	start -> wait_pay;
+	wait_pay [label="待支付", value=0];
+	paid [label="已支付", shape=doublecircle, value=2];
+	"canceled" [shape=doublecircle, value=1];
+	wait_pay -> paid [label="pay", action="Charge", guard=true];
+	wait_pay -> canceled [label=cancel];
+}
+`
+
+// orderDefinition 与 orderDOT 相同的定义
+func orderDefinition() *Definition {
+	value := func(v int) *int { return &v }
+	return &Definition{
+		Package: "order",
+		Machine: "Order",
+		Name:    "订单状态机",
+		Start:   "wait_pay",
+		End:     []string{"paid", "canceled"},
+		States: []StateDef{
+			{Name: "wait_pay", Value: value(0), Desc: "待支付"},
+			{Name: "paid", Value: value(2), Desc: "已支付"},
+			{Name: "canceled", Value: value(1)},
+		},
+		Events: []EventDef{{Name: "pay"}, {Name: "cancel"}},
+		Transitions: []TransitionDef{
+			{From: "wait_pay", Event: "pay", To: "paid", Action: "Charge", Guard: true},
+			{From: "wait_pay", Event: "cancel", To: "canceled"},
+		},
+	}
+}
+
+func TestParseDOT(t *testing.T) {
+	def, err := ParseDOT(orderDOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := orderDefinition()
+	if def.Package != want.Package || def.Name != want.Name || def.Machine != want.Machine || def.Start != want.Start {
+		t.Fatalf("图属性解析错误：%+v", def)
+	}
+	if strings.Join(def.End, ",") != "paid,canceled" {
+		t.Fatalf("结束状态解析错误：%v", def.End)
+	}
+	if len(def.States) != 3 {
+		t.Fatalf("状态解析错误：%+v", def.States)
+	}
+	for i, s := range want.States {
+		if got := def.States[i]; got.Name != s.Name || got.Desc != s.Desc || got.Value == nil || *got.Value != *s.Value {
+			t.Fatalf("状态解析错误：%+v", got)
+		}
+	}
+	if len(def.Transitions) != 2 || def.Transitions[0] != want.Transitions[0] || def.Transitions[1] != want.Transitions[1] {
+		t.Fatalf("转变器解析错误：%+v", def.Transitions)
+	}
+	if err := def.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, src := range map[string]string{
+		"no_digraph": "graph Order {}",
+		"no_label":   "digraph Order {\n a -> b;\n}",
+		"bad_value":  "digraph Order {\n a [value=x];\n}",
+	} {
+		if _, err := ParseDOT(src); err == nil {
+			t.Fatalf("%s：应返回错误", name)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"order.dot": orderDOT,
+		"order.yaml": `package: order
+machine: Order
+start: wait_pay
+end: [paid]
+states:
+  - {name: wait_pay, value: 0}
+  - {name: paid, value: 1}
+events:
+  - {name: pay}
+transitions:
+  - {from: wait_pay, event: pay, to: paid}
+`,
+		"order.json": `{"package": "order", "machine": "Order", "start": "wait_pay", "end": ["paid"],
+"states": [{"name": "wait_pay", "value": 0}, {"name": "paid", "value": 1}],
+"events": [{"name": "pay"}], "transitions": [{"from": "wait_pay", "event": "pay", "to": "paid"}]}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		def, err := Load(path)
+		if err != nil {
+			t.Fatalf("%s：%v", name, err)
+		}
+		if def.Name == "" || len(def.Transitions) == 0 {
+			t.Fatalf("%s：定义读取错误：%+v", name, def)
+		}
+	}
+	if _, err := Load(filepath.Join(dir, "order.toml")); err == nil {
+		t.Fatal("不存在的文件应返回错误")
+	}
+	path := filepath.Join(dir, "order.txt")
+	os.WriteFile(path, nil, 0o644)
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "不支持") {
+		t.Fatalf("不支持的扩展名应返回错误：%v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	value := func(v int) *int { return &v }
+	for _, c := range []struct {
+		name   string
+		modify func(d *Definition)
+		want   string
+	}{
+		{"no_package", func(d *Definition) { d.Package = "" }, "package"},
+		{"duplicate_state", func(d *Definition) { d.States = append(d.States, d.States[0]) }, "状态重复"},
+		{"missing_value", func(d *Definition) { d.States[1].Value = nil }, "缺少 value"},
+		{"value_range", func(d *Definition) { d.States[1].Value = value(256) }, "超出范围"},
+		{"duplicate_value", func(d *Definition) { d.States[1].Value = value(0) }, "状态值重复"},
+		{"unknown_start", func(d *Definition) { d.Start = "shipped" }, "开始状态"},
+		{"unknown_end", func(d *Definition) { d.End = []string{"shipped"} }, "结束状态"},
+		{"unknown_state", func(d *Definition) { d.Transitions[0].To = "shipped" }, "状态未声明"},
+		{"unknown_event", func(d *Definition) { d.Transitions[0].Event = "ship" }, "事件未声明"},
+		{"duplicate_transition", func(d *Definition) { d.Transitions[1].Event = "pay" }, "转变器重复"},
+	} {
+		def := orderDefinition()
+		c.modify(def)
+		if err := def.Validate(); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("%s：校验结果错误：%v", c.name, err)
+		}
+	}
+	def := orderDefinition()
+	def.Name = ""
+	if err := def.Validate(); err != nil || def.Name != def.Machine {
+		t.Fatalf("名称为空时应使用 Machine：%v %s", err, def.Name)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	code, test, err := Generate(orderDefinition())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"StateOrderPaid OrderState = 2",
+		"StateOrderCanceled OrderState = 1",
+		"Processor(fsm.NopProcessor{})",
+		"Charge(ctx context.Context, from, to OrderState) error",
+		"CanCharge(ctx context.Context, from, to OrderState) bool",
+	} {
+		if !strings.Contains(string(code), want) {
+			t.Fatalf("生成代码缺少：%s\n%s", want, code)
+		}
+	}
+	if !strings.Contains(string(test), "func TestOrderDefinition") {
+		t.Fatalf("生成的测试错误：\n%s", test)
+	}
+	def := orderDefinition()
+	def.States[0].Value = nil
+	if _, _, err := Generate(def); err == nil {
+		t.Fatal("定义校验失败时不应生成代码")
+	}
+}
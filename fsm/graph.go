@@ -0,0 +1,191 @@
+package fsm
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+/** 图表查询
+* 1. AvailableEvents、ReachableFrom、CanReach、ShortestPath 只按图表结构计算，不执行守卫，也不检查权限，
+*    结果是“可能”可用或可达；带守卫的边可以通过 Guarded 判断
+* 2. 需要按运行时条件判断时使用 StateMachine.AvailableEventsContext，对每个事件执行权限检查与守卫
+**/
+
+// graphCache 状态机图表查询缓存，图表变更时失效
+type graphCache struct {
+	locker    sync.Mutex
+	events    map[State][]Event        // 状态 -> 可用事件
+	reachable map[State][]State        // 状态 -> 可达状态
+	paths     map[[2]State]graphResult // (from, to) -> 最短路径
+}
+
+type graphResult struct {
+	events []Event
+	ok     bool
+}
+
+func newGraphCache() *graphCache {
+	return &graphCache{
+		events:    make(map[State][]Event),
+		reachable: make(map[State][]State),
+		paths:     make(map[[2]State]graphResult),
+	}
+}
+
+// queryCache 返回当前图表的查询缓存
+func (g *StateGraph) queryCache() *graphCache {
+	g.cacheLocker.Lock()
+	defer g.cacheLocker.Unlock()
+	if g.cache == nil {
+		g.cache = newGraphCache()
+	}
+	return g.cache
+}
+
+// invalidate 图表变更后清空查询缓存
+func (g *StateGraph) invalidate() {
+	g.cacheLocker.Lock()
+	defer g.cacheLocker.Unlock()
+	g.cache = nil
+}
+
+// availableEvents 未加锁的可用事件计算，按事件名排序
+func (g *StateGraph) availableEvents(state State) []Event {
+	if g.IsEnd(state) {
+		return nil
+	}
+	events := make([]Event, 0, len(g.transitions[state]))
+	seen := make(map[Event]bool)
+	for s, ok := state, true; ok; s, ok = g.parents[s] {
+		for event := range g.transitions[s] {
+			if !seen[event] {
+				seen[event] = true
+				events = append(events, event)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+	return events
+}
+
+// Guarded 状态下的事件是否带有守卫，守卫拒绝时事件不可用，图表查询不执行守卫
+func (g *StateGraph) Guarded(state State, event Event) bool {
+	transition, ok := g.transition(state, event)
+	return ok && transition.Guard != nil
+}
+
+// AvailableEvents 当前状态下可以触发的事件，结束状态没有可用事件
+func (g *StateGraph) AvailableEvents(state State) []Event {
+	c := g.queryCache()
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	events, ok := c.events[state]
+	if !ok {
+		events = g.availableEvents(state)
+		c.events[state] = events
+	}
+	return append([]Event(nil), events...)
+}
+
+// ReachableFrom 从指定状态出发经过一个或多个事件可以到达的状态，按状态值排序，带守卫的边视为可以通过
+func (g *StateGraph) ReachableFrom(state State) []State {
+	c := g.queryCache()
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	states, ok := c.reachable[state]
+	if !ok {
+		visited := make(map[State]bool)
+		queue := []State{state}
+		for len(queue) > 0 {
+			from := queue[0]
+			queue = queue[1:]
+			for _, event := range g.availableEvents(from) {
+				for _, to := range g.targets(from, event) {
+					if !visited[to] {
+						visited[to] = true
+						queue = append(queue, to)
+					}
+				}
+			}
+		}
+		states = make([]State, 0, len(visited))
+		for s := range visited {
+			states = append(states, s)
+		}
+		sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+		c.reachable[state] = states
+	}
+	return append([]State(nil), states...)
+}
+
+// CanReach 是否可以从 from 流转到 to，from 与 to 相同时视为可达
+func (g *StateGraph) CanReach(from, to State) bool {
+	_, ok := g.ShortestPath(from, to)
+	return ok
+}
+
+// ShortestPath 从 from 到 to 的最短事件序列，不可达时返回 false
+// 同样长度的路径按事件名排序选取第一条，保证结果稳定
+func (g *StateGraph) ShortestPath(from, to State) ([]Event, bool) {
+	c := g.queryCache()
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	key := [2]State{from, to}
+	result, ok := c.paths[key]
+	if !ok {
+		result = g.shortestPath(from, to)
+		c.paths[key] = result
+	}
+	return append([]Event(nil), result.events...), result.ok
+}
+
+func (g *StateGraph) shortestPath(from, to State) graphResult {
+	if _, ok := g.states[from]; !ok {
+		return graphResult{}
+	}
+	if from == to {
+		return graphResult{events: []Event{}, ok: true}
+	}
+	type step struct {
+		prev  State
+		event Event
+	}
+	visited := map[State]step{from: {}}
+	queue := []State{from}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, event := range g.availableEvents(current) {
+			for _, next := range g.targets(current, event) {
+				if _, ok := visited[next]; ok {
+					continue
+				}
+				visited[next] = step{prev: current, event: event}
+				if next == to {
+					var events []Event
+					for s := to; s != from; s = visited[s].prev {
+						events = append(events, visited[s].event)
+					}
+					for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+						events[i], events[j] = events[j], events[i]
+					}
+					return graphResult{events: events, ok: true}
+				}
+				queue = append(queue, next)
+			}
+		}
+	}
+	return graphResult{}
+}
+
+// AvailableEventsContext 当前状态下按上下文可以触发的事件：检查上下文中操作人的权限并执行守卫，守卫不能有副作用
+func (s *StateMachine) AvailableEventsContext(ctx context.Context, state State) []Event {
+	var events []Event
+	for _, event := range s.Graph.AvailableEvents(state) {
+		if _, _, err := s.prepare(ctx, state, event); err == nil {
+			events = append(events, event)
+		}
+	}
+	return events
+}
@@ -0,0 +1,77 @@
+package fsm
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestGraphReachableFrom(t *testing.T) {
+	g := mainMachine(t, Options{}, nil).Graph
+	for _, c := range []struct {
+		from State
+		want []State
+	}{
+		{StateWaitPay, []State{StateWaitConfirm, StatePayied, StateCanceled}},
+		{StateWaitConfirm, []State{StatePayied}},
+		{StatePayied, nil},
+		{State(9), nil},
+	} {
+		if got := g.ReachableFrom(c.from); !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("%d 的可达状态错误：%v", c.from, got)
+		}
+	}
+	// 查询结果为副本，修改不影响缓存
+	got := g.ReachableFrom(StateWaitPay)
+	got[0] = StateCanceled
+	if again := g.ReachableFrom(StateWaitPay); again[0] != StateWaitConfirm {
+		t.Fatalf("缓存被修改：%v", again)
+	}
+}
+
+func TestGraphComposite(t *testing.T) {
+	g := SubStateMachine.Graph
+	reachable := g.ReachableFrom(StateSubAfterSaleRefund)
+	if !reflect.DeepEqual(reachable, []State{StateSubWaitShip, StateSubWaitReceive, StateSubAfterSaleRefund,
+		StateSubAfterSaleRefundAndReturn, StateSubReceived, StateSubCompleted}) {
+		t.Fatalf("子状态应继承复合状态的转变器：%v", reachable)
+	}
+}
+
+func TestGraphShortestPath(t *testing.T) {
+	g := mainMachine(t, Options{}, nil).Graph
+	if path, ok := g.ShortestPath(StateWaitPay, StatePayied); !ok || !reflect.DeepEqual(path, []Event{EventPay, EventPayConfirm}) {
+		t.Fatalf("最短路径错误：%v %v", path, ok)
+	}
+	if !g.CanReach(StateWaitPay, StateWaitPay) || g.CanReach(StateCanceled, StateWaitPay) {
+		t.Fatal("可达判断错误")
+	}
+}
+
+func TestGraphGuarded(t *testing.T) {
+	allow := false
+	m := NewBuilder(MainMachineName).
+		States(mainStates).
+		Start(StateWaitPay).
+		End(StatePayied, StateCanceled).
+		Options(Options{Quiet: true}).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).
+		When(func(ctx context.Context, from State, event Event, to State) bool { return allow }).Do(nop).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+		MustBuild()
+	if !m.Graph.Guarded(StateWaitPay, EventPay) || m.Graph.Guarded(StateWaitPay, EventCancel) {
+		t.Fatal("守卫标记错误")
+	}
+	// 图表查询不执行守卫，按上下文查询时执行
+	if events := m.Graph.AvailableEvents(StateWaitPay); len(events) != 2 {
+		t.Fatalf("图表可用事件错误：%v", events)
+	}
+	if events := m.AvailableEventsContext(context.Background(), StateWaitPay); !reflect.DeepEqual(events, []Event{EventCancel}) {
+		t.Fatalf("守卫拒绝的事件不可用：%v", events)
+	}
+	allow = true
+	if events := m.AvailableEventsContext(context.Background(), StateWaitPay); len(events) != 2 {
+		t.Fatalf("守卫通过后事件可用：%v", events)
+	}
+}
@@ -0,0 +1,217 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// HistoryKind 历史伪状态类型
+type HistoryKind uint8
+
+const (
+	NoHistory      HistoryKind = iota // 普通转变器
+	ShallowHistory                    // 浅历史：回到进入复合状态前所在的同级状态，复合状态从初始子状态进入
+	DeepHistory                       // 深历史：回到进入复合状态前所在的具体状态
+)
+
+/** 复合状态
+* 1. 复合状态本身也是声明过的状态，Children 为直接子状态，子状态也可以是复合状态
+* 2. 复合状态上声明的转变器对所有子状态生效，子状态自己声明的同名事件优先
+* 3. 转变器的新状态是复合状态时，从 Initial 进入（逐层进入到具体状态）
+* 4. 从外部进入复合状态时，实例记录进入前的状态（Instance.History），
+*    目标为历史伪状态的转变器（ToHistory）据此返回
+* 5. 没有记录时（不带实例的 Run、记录历史之前保存的实例）按转变器的 Fallback 返回，
+*    Fallback 没有配置当前状态时：有实例则从 Initial 进入，没有实例则返回错误
+**/
+type Composite struct {
+	Initial  State   `desc:"初始子状态"`
+	Children []State `desc:"直接子状态"`
+}
+
+// SetComposites 设置复合状态
+func (s *StateMachine) SetComposites(composites map[State]Composite) *StateMachine {
+	s.Graph.mustNotFrozen()
+	s.Graph.composites = composites
+	s.Graph.parents = make(map[State]State)
+	for parent, composite := range composites {
+		for _, child := range composite.Children {
+			s.Graph.parents[child] = parent
+		}
+	}
+	s.Graph.invalidate()
+	return s
+}
+
+// Parent 状态所属的复合状态
+func (g *StateGraph) Parent(state State) (State, bool) {
+	parent, ok := g.parents[state]
+	return parent, ok
+}
+
+// IsComposite 是否复合状态
+func (g *StateGraph) IsComposite(state State) bool {
+	_, ok := g.composites[state]
+	return ok
+}
+
+// contains 状态是否在复合状态之内（包含自身）
+func (g *StateGraph) contains(composite, state State) bool {
+	for {
+		if state == composite {
+			return true
+		}
+		parent, ok := g.parents[state]
+		if !ok {
+			return false
+		}
+		state = parent
+	}
+}
+
+// transition 查找转变器，子状态没有声明时沿复合状态向上查找
+func (g *StateGraph) transition(from State, event Event) (Transition, bool) {
+	for state := from; ; {
+		if transition, ok := g.transitions[state][event]; ok {
+			return transition, true
+		}
+		parent, ok := g.parents[state]
+		if !ok {
+			return Transition{}, false
+		}
+		state = parent
+	}
+}
+
+// enter 进入状态，复合状态逐层进入初始子状态
+func (g *StateGraph) enter(state State) State {
+	for i := 0; i <= len(g.composites); i++ {
+		composite, ok := g.composites[state]
+		if !ok {
+			return state
+		}
+		state = composite.Initial
+	}
+	return state
+}
+
+// recall 按历史类型计算返回的状态，remembered 为进入复合状态前的状态
+func (g *StateGraph) recall(composite State, kind HistoryKind, remembered State) State {
+	if kind == ShallowHistory {
+		for {
+			parent, ok := g.parents[remembered]
+			if !ok || g.contains(parent, composite) {
+				break
+			}
+			remembered = parent
+		}
+	}
+	return g.enter(remembered)
+}
+
+// historySources 可能进入复合状态的外部状态，用于图表查询
+func (g *StateGraph) historySources(composite State, kind HistoryKind) []State {
+	seen := map[State]bool{}
+	var sources []State
+	for from := range g.states {
+		if g.IsComposite(from) || g.contains(composite, from) {
+			continue
+		}
+		for _, event := range g.availableEvents(from) {
+			transition, _ := g.transition(from, event)
+			if transition.History != NoHistory || !g.contains(composite, g.enter(transition.To)) {
+				continue
+			}
+			if to := g.recall(composite, kind, from); !seen[to] {
+				seen[to] = true
+				sources = append(sources, to)
+			}
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i] < sources[j] })
+	return sources
+}
+
+// fallback 历史伪状态没有记录时的返回状态，当前状态没有配置时沿复合状态向上查找
+func (g *StateGraph) fallback(transition *Transition, from State) (State, bool) {
+	for state := from; ; {
+		if to, ok := transition.Fallback[state]; ok {
+			return to, true
+		}
+		parent, ok := g.parents[state]
+		if !ok {
+			return 0, false
+		}
+		state = parent
+	}
+}
+
+// targets 转变器可能到达的状态，历史伪状态可能到达多个状态
+func (g *StateGraph) targets(from State, event Event) []State {
+	transition, ok := g.transition(from, event)
+	if !ok {
+		return nil
+	}
+	if transition.History == NoHistory {
+		return []State{g.enter(transition.To)}
+	}
+	sources := g.historySources(transition.To, transition.History)
+	if to, ok := g.fallback(&transition, from); ok {
+		to = g.enter(to)
+		i := sort.Search(len(sources), func(i int) bool { return sources[i] >= to })
+		if i == len(sources) || sources[i] != to {
+			sources = append(sources[:i], append([]State{to}, sources[i:]...)...)
+		}
+	}
+	return sources
+}
+
+// resolve 计算转变器的新状态
+func (s *StateMachine) resolve(ctx context.Context, from State, transition *Transition) (State, error) {
+	if transition.History == NoHistory {
+		return s.Graph.enter(transition.To), nil
+	}
+	inst, hasInstance := instanceFrom(ctx)
+	var remembered State
+	ok := false
+	if hasInstance {
+		remembered, ok = inst.History[transition.To]
+	}
+	if !ok {
+		if to, ok := s.Graph.fallback(transition, from); ok {
+			return s.Graph.enter(to), nil
+		}
+		if !hasInstance {
+			return 0, fmt.Errorf("没有实例，无法确定历史状态：%s", s.GetStateDesc(transition.To))
+		}
+		return s.Graph.enter(transition.To), nil
+	}
+	if _, ok := s.Graph.states[remembered]; !ok {
+		return 0, fmt.Errorf("历史状态不存在：%d", remembered)
+	}
+	return s.Graph.recall(transition.To, transition.History, remembered), nil
+}
+
+// remember 从外部进入复合状态时，在实例中记录进入前的状态
+func (s *StateMachine) remember(ctx context.Context, from, to State) {
+	if len(s.Graph.composites) == 0 {
+		return
+	}
+	inst, ok := instanceFrom(ctx)
+	if !ok {
+		return
+	}
+	for state := to; ; {
+		parent, ok := s.Graph.parents[state]
+		if !ok {
+			return
+		}
+		if !s.Graph.contains(parent, from) {
+			if inst.History == nil {
+				inst.History = make(map[State]State)
+			}
+			inst.History[parent] = from
+		}
+		state = parent
+	}
+}
@@ -0,0 +1,140 @@
+package fsm
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestHistoryState(t *testing.T) {
+	ctx := context.Background()
+	store := NewMongoStore(&fakeCollection{})
+	m := NewBuilder(SubMachineName).
+		States(subStates).
+		Composite(StateSubAfterSale, StateSubAfterSaleRefund, StateSubAfterSaleRefund, StateSubAfterSaleRefundAndReturn).
+		Start(StateSubWaitPay).
+		End(StateSubCompleted, StateSubCanceled).
+		Options(Options{Processor: testProcessor{}, Store: store, Quiet: true}).
+		From(StateSubWaitPay).On(EventSubPay).To(StateSubWaitConfirm).Do(nop).
+		From(StateSubWaitPay).On(EventSubCancel).To(StateSubCanceled).Do(nop).
+		From(StateSubWaitConfirm).On(EventSubPayConfirm).To(StateSubWaitShip).Do(nop).
+		From(StateSubWaitShip).On(EventSubShip).To(StateSubWaitReceive).Do(nop).
+		From(StateSubWaitShip).On(EventSubRefund).To(StateSubAfterSale).Do(nop).
+		From(StateSubWaitReceive).On(EventSubReceive).To(StateSubReceived).Do(nop).
+		From(StateSubReceived).On(EventSubComplete).To(StateSubCompleted).Do(nop).
+		From(StateSubReceived).On(EventSubRefundAndReturn).To(StateSubAfterSaleRefundAndReturn).Do(nop).
+		From(StateSubAfterSale).On(EventSubAfterSaleComplete).To(StateSubCompleted).Do(nop).
+		From(StateSubAfterSale).On(EventSubCancelAfterSale).ToHistory(StateSubAfterSale, DeepHistory).
+		Fallback(StateSubAfterSaleRefund, StateSubWaitShip).
+		Fallback(StateSubAfterSaleRefundAndReturn, StateSubReceived).Do(nop).
+		MustBuild()
+
+	if _, err := m.Start(ctx, "1001"); err != nil {
+		t.Fatal(err)
+	}
+	fire := func(event Event, want State) {
+		t.Helper()
+		to, err := m.Fire(ctx, "1001", event)
+		if err != nil || to != want {
+			t.Fatalf("事件 %s 流转错误：%d %v", event, to, err)
+		}
+	}
+	fire(EventSubPay, StateSubWaitConfirm)
+	fire(EventSubPayConfirm, StateSubWaitShip)
+	fire(EventSubRefund, StateSubAfterSaleRefund)
+	inst, err := store.Load(ctx, SubMachineName, "1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.History[StateSubAfterSale] != StateSubWaitShip {
+		t.Fatalf("历史状态未保存：%+v", inst)
+	}
+	fire(EventSubCancelAfterSale, StateSubWaitShip)
+	fire(EventSubShip, StateSubWaitReceive)
+	fire(EventSubReceive, StateSubReceived)
+	fire(EventSubRefundAndReturn, StateSubAfterSaleRefundAndReturn)
+	fire(EventSubCancelAfterSale, StateSubReceived)
+
+	// 没有实例时按 Fallback 返回，与引入历史伪状态之前的行为一致
+	for from, want := range map[State]State{
+		StateSubAfterSaleRefund:          StateSubWaitShip,
+		StateSubAfterSaleRefundAndReturn: StateSubReceived,
+	} {
+		if to, err := m.Run(from, EventSubCancelAfterSale); err != nil || to != want {
+			t.Fatalf("没有实例时应按 Fallback 返回：%d -> %d %v", from, to, err)
+		}
+	}
+	events := m.Graph.AvailableEvents(StateSubAfterSaleRefundAndReturn)
+	if !reflect.DeepEqual(events, []Event{EventSubAfterSaleComplete, EventSubCancelAfterSale}) {
+		t.Fatalf("子状态应继承复合状态的事件：%v", events)
+	}
+	if !m.Graph.CanReach(StateSubAfterSaleRefundAndReturn, StateSubWaitShip) {
+		t.Fatal("历史伪状态可以返回待发货")
+	}
+
+	// 记录历史之前保存的实例同样按 Fallback 返回
+	legacy := Instance{ID: "1002", Machine: SubMachineName, State: StateSubAfterSaleRefundAndReturn}
+	if err := store.Save(ctx, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if to, err := m.Fire(ctx, "1002", EventSubCancelAfterSale); err != nil || to != StateSubReceived {
+		t.Fatalf("没有历史记录的实例应按 Fallback 返回：%d %v", to, err)
+	}
+}
+
+func TestShallowHistoryState(t *testing.T) {
+	const (
+		stateNew State = iota
+		stateFulfil
+		statePicking
+		statePacked
+		stateHold
+		stateHeld
+		stateDone
+	)
+	build := func(kind HistoryKind) *StateMachine {
+		m := NewBuilder("履约").
+			States(map[State]string{stateNew: "new", stateFulfil: "fulfil", statePicking: "picking",
+				statePacked: "packed", stateHold: "hold", stateHeld: "held", stateDone: "done"}).
+			Composite(stateFulfil, statePicking, statePicking, statePacked).
+			Composite(stateHold, stateHeld, stateHeld).
+			Start(stateNew).
+			End(stateDone).
+			Options(Options{Processor: testProcessor{}, Quiet: true}).
+			From(stateNew).On("start").To(stateFulfil).Do(nop).
+			From(statePicking).On("pack").To(statePacked).Do(nop).
+			From(statePacked).On("ship").To(stateDone).Do(nop).
+			From(stateFulfil).On("hold").To(stateHold).Do(nop).
+			From(stateHold).On("resume").ToHistory(stateHold, kind).Do(nop).
+			MustBuild()
+		return m
+	}
+	if _, err := NewBuilder("履约").
+		States(map[State]string{stateNew: "new", stateHold: "hold"}).
+		Start(stateNew).
+		From(stateNew).On("hold").To(stateHold).Do(nop).
+		From(stateHold).On("resume").ToHistory(stateNew, DeepHistory).Do(nop).
+		Build(); err == nil {
+		t.Fatal("历史伪状态的目标必须是复合状态")
+	}
+
+	for kind, want := range map[HistoryKind]State{ShallowHistory: statePicking, DeepHistory: statePacked} {
+		m := build(kind)
+		inst := &Instance{ID: "1", State: stateNew}
+		ctx := withInstance(context.Background(), inst)
+		state := stateNew
+		for _, event := range []Event{"start", "pack", "hold", "resume"} {
+			to, err := m.RunContext(ctx, state, event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state = to
+		}
+		if state != want {
+			t.Fatalf("历史类型 %d 返回错误：%d", kind, state)
+		}
+		if _, err := m.Run(stateHeld, "resume"); err == nil {
+			t.Fatal("没有实例也没有 Fallback 时无法确定历史状态")
+		}
+	}
+}
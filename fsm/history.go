@@ -0,0 +1,103 @@
+package fsm
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TransitionRecord 状态流转记录，失败的流转同样记录，Error 为失败原因，Denied 表示被权限拒绝
+type TransitionRecord struct {
+	Machine  string    `json:"machine" bson:"machine"`
+	EntityID string    `json:"entity_id" bson:"entity_id"`
+	From     State     `json:"from" bson:"from"`
+	Event    Event     `json:"event" bson:"event"`
+	To       State     `json:"to" bson:"to"`
+	Attempt  int       `json:"attempt,omitempty" bson:"attempt,omitempty"`
+	Actor    string    `json:"actor,omitempty" bson:"actor,omitempty"`
+	Denied   bool      `json:"denied,omitempty" bson:"denied,omitempty"`
+	Error    string    `json:"error,omitempty" bson:"error,omitempty"`
+	At       time.Time `json:"at" bson:"at"`
+}
+
+// HistoryRecorder 流转历史记录
+type HistoryRecorder interface {
+	Record(ctx context.Context, records ...TransitionRecord) error
+	History(ctx context.Context, machine, id string) ([]TransitionRecord, error)
+}
+
+// record 在流转中追加记录，只有通过 Fire 执行时才会记录，attempt 为动作的第几次执行
+// 记录放入上下文中的缓冲（见 commitBuffer），实例保存或事务结束后写入
+func (s *StateMachine) record(ctx context.Context, from State, event Event, to State, attempt int, err error) {
+	if s.options.History == nil || ctx.Value(historyKey) == nil {
+		return
+	}
+	buffer, ok := commitFrom(ctx)
+	if !ok {
+		return
+	}
+	r := TransitionRecord{
+		Machine: s.Name(),
+		From:    from,
+		Event:   event,
+		To:      to,
+		Attempt: attempt,
+		At:      time.Now(),
+	}
+	if inst, ok := InstanceFrom(ctx); ok {
+		r.EntityID = inst.ID
+	}
+	if actor, ok := ActorFrom(ctx); ok {
+		r.Actor = actor.ID
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	buffer.addRecord(s, r)
+}
+
+// writeHistory 写入流转记录，失败只记录日志
+func (s *StateMachine) writeHistory(ctx context.Context, records ...TransitionRecord) {
+	if err := s.options.History.Record(ctx, records...); err != nil {
+		log.Printf("流转历史记录失败，状态机：%s，错误：%v\n", s.Name(), err)
+	}
+}
+
+// MemoryHistory 内存流转历史
+type MemoryHistory struct {
+	locker  sync.RWMutex
+	records []TransitionRecord
+}
+
+func NewMemoryHistory() *MemoryHistory {
+	return &MemoryHistory{}
+}
+
+func (m *MemoryHistory) Record(ctx context.Context, records ...TransitionRecord) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	m.records = append(m.records, records...)
+	return nil
+}
+
+func (m *MemoryHistory) History(ctx context.Context, machine, id string) ([]TransitionRecord, error) {
+	m.locker.RLock()
+	defer m.locker.RUnlock()
+	var records []TransitionRecord
+	for _, r := range m.records {
+		if r.Machine == machine && r.EntityID == id {
+			records = append(records, r)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].At.Before(records[j].At) })
+	return records, nil
+}
+
+// Records 全部流转记录
+func (m *MemoryHistory) Records() []TransitionRecord {
+	m.locker.RLock()
+	defer m.locker.RUnlock()
+	return append([]TransitionRecord(nil), m.records...)
+}
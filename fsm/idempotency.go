@@ -0,0 +1,300 @@
+package fsm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrIdempotencyPending 相同的幂等键正在处理中，稍后重试可以得到首次的结果
+var ErrIdempotencyPending = errors.New("幂等键正在处理中")
+
+// IdempotentResult 幂等键对应的首次处理结果，Pending 为 true 时表示已预留但尚未处理完成
+type IdempotentResult struct {
+	Event   Event     `json:"event"`
+	To      State     `json:"to"`
+	At      time.Time `json:"at"`
+	Pending bool      `json:"pending"`
+}
+
+// replay 返回首次的结果，同一个键用于不同事件时返回错误
+func (r IdempotentResult) replay(key string, event Event) (State, error) {
+	if r.Event != event {
+		return 0, fmt.Errorf("幂等键 %s 已用于事件 %s，不能用于事件 %s", key, r.Event, event)
+	}
+	if r.Pending {
+		return 0, fmt.Errorf("%w：%s", ErrIdempotencyPending, key)
+	}
+	return r.To, nil
+}
+
+/** IdempotencyStore 幂等键存储，按状态机与实体区分，超过 ttl 后失效
+* 1. Reserve 键不存在（或已过期）时写入处理中的记录并返回 true，已存在时返回已有的记录与 false，必须是原子操作
+* 2. Put 保存处理结果，覆盖处理中的记录
+* 3. Release 处理失败时删除处理中的记录，相同的键可以重新处理
+**/
+type IdempotencyStore interface {
+	Reserve(ctx context.Context, machine, id, key string, event Event, ttl time.Duration) (IdempotentResult, bool, error)
+	Put(ctx context.Context, machine, id, key string, result IdempotentResult, ttl time.Duration) error
+	Release(ctx context.Context, machine, id, key string) error
+}
+
+func (s *StateMachine) idempotencyTTL() time.Duration {
+	if s.options.IdempotencyTTL > 0 {
+		return s.options.IdempotencyTTL
+	}
+	return 24 * time.Hour
+}
+
+// idempotencyLease 预留的幂等键在处理完成前的有效期，需要覆盖重试等待，进程崩溃时预留最多保持这么久
+func (s *StateMachine) idempotencyLease() time.Duration {
+	if s.options.IdempotencyLease > 0 {
+		return s.options.IdempotencyLease
+	}
+	lease := time.Minute
+	var wait time.Duration
+	for _, events := range s.Graph.transitions {
+		for _, transition := range events {
+			wait = max(wait, transition.Retry.maxWait())
+		}
+	}
+	return lease + wait
+}
+
+// pending 预留时写入的处理中记录
+func pending(event Event) IdempotentResult {
+	return IdempotentResult{Event: event, At: time.Now(), Pending: true}
+}
+
+// MemoryIdempotencyStore 内存幂等键存储，过期的键在预留时覆盖
+type MemoryIdempotencyStore struct {
+	locker  sync.Mutex
+	results map[[3]string]memoryIdempotentResult
+}
+
+type memoryIdempotentResult struct {
+	result   IdempotentResult
+	expireAt time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		results: make(map[[3]string]memoryIdempotentResult),
+	}
+}
+
+func (m *MemoryIdempotencyStore) Reserve(ctx context.Context, machine, id, key string, event Event, ttl time.Duration) (IdempotentResult, bool, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	k := [3]string{machine, id, key}
+	if r, ok := m.results[k]; ok && time.Now().Before(r.expireAt) {
+		return r.result, false, nil
+	}
+	m.results[k] = memoryIdempotentResult{
+		result:   pending(event),
+		expireAt: time.Now().Add(ttl),
+	}
+	return IdempotentResult{}, true, nil
+}
+
+func (m *MemoryIdempotencyStore) Put(ctx context.Context, machine, id, key string, result IdempotentResult, ttl time.Duration) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	m.results[[3]string{machine, id, key}] = memoryIdempotentResult{
+		result:   result,
+		expireAt: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (m *MemoryIdempotencyStore) Release(ctx context.Context, machine, id, key string) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	delete(m.results, [3]string{machine, id, key})
+	return nil
+}
+
+// RedisIdempotencyStore Redis 幂等键存储，结果以 JSON 保存并设置过期时间
+type RedisIdempotencyStore struct {
+	Client *redis.Client
+	Prefix string
+}
+
+func NewRedisIdempotencyStore(client *redis.Client) *RedisIdempotencyStore {
+	return &RedisIdempotencyStore{Client: client, Prefix: "fsm:idempotency:"}
+}
+
+func (r *RedisIdempotencyStore) key(machine, id, key string) string {
+	return r.Prefix + machine + ":" + id + ":" + key
+}
+
+func (r *RedisIdempotencyStore) Get(ctx context.Context, machine, id, key string) (IdempotentResult, bool, error) {
+	data, err := r.Client.Get(ctx, r.key(machine, id, key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return IdempotentResult{}, false, nil
+	}
+	if err != nil {
+		return IdempotentResult{}, false, err
+	}
+	var result IdempotentResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return IdempotentResult{}, false, err
+	}
+	return result, true, nil
+}
+
+func (r *RedisIdempotencyStore) Put(ctx context.Context, machine, id, key string, result IdempotentResult, ttl time.Duration) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return r.Client.Set(ctx, r.key(machine, id, key), data, ttl).Err()
+}
+
+// Reserve 使用 SET NX 预留，键已存在时读取已有的记录
+func (r *RedisIdempotencyStore) Reserve(ctx context.Context, machine, id, key string, event Event, ttl time.Duration) (IdempotentResult, bool, error) {
+	data, err := json.Marshal(pending(event))
+	if err != nil {
+		return IdempotentResult{}, false, err
+	}
+	ok, err := r.Client.SetNX(ctx, r.key(machine, id, key), data, ttl).Result()
+	if err != nil || ok {
+		return IdempotentResult{}, ok, err
+	}
+	result, ok, err := r.Get(ctx, machine, id, key)
+	if err == nil && !ok {
+		// 读取前刚好过期，视为仍在处理中，由调用方稍后重试
+		result = pending(event)
+	}
+	return result, false, err
+}
+
+func (r *RedisIdempotencyStore) Release(ctx context.Context, machine, id, key string) error {
+	return r.Client.Del(ctx, r.key(machine, id, key)).Err()
+}
+
+/** SQL 幂等键存储，默认表结构：
+* CREATE TABLE fsm_idempotency (
+*   machine    VARCHAR(64)  NOT NULL,
+*   entity_id  VARCHAR(64)  NOT NULL,
+*   idem_key   VARCHAR(128) NOT NULL,
+*   event      VARCHAR(64)  NOT NULL,
+*   to_state   TINYINT      NOT NULL,
+*   pending    TINYINT(1)   NOT NULL,
+*   created_at DATETIME(3)  NOT NULL,
+*   expire_at  DATETIME(3)  NOT NULL,
+*   PRIMARY KEY (machine, entity_id, idem_key),
+*   KEY idx_expire (expire_at)
+* );
+* 1. 预留时先删除该键已过期的记录，再插入处理中的记录，主键冲突说明已被预留
+* 2. Put 先更新已有的记录，不存在时插入
+* 3. 上下文中存在事务时使用该事务写入，与状态变更一起提交；过期数据通过 Purge 清理
+**/
+type SQLIdempotencyStore struct {
+	Session *dbr.Session
+	Table   string
+}
+
+func NewSQLIdempotencyStore(session *dbr.Session) *SQLIdempotencyStore {
+	return &SQLIdempotencyStore{Session: session, Table: "fsm_idempotency"}
+}
+
+type idempotencyRow struct {
+	Event     Event     `db:"event"`
+	ToState   State     `db:"to_state"`
+	Pending   bool      `db:"pending"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func (s *SQLIdempotencyStore) Get(ctx context.Context, machine, id, key string) (IdempotentResult, bool, error) {
+	var row idempotencyRow
+	err := runnerFrom(ctx, s.Session).
+		Select("event", "to_state", "pending", "created_at").
+		From(s.Table).
+		Where("machine = ? AND entity_id = ? AND idem_key = ? AND expire_at > ?", machine, id, key, time.Now()).
+		LoadOneContext(ctx, &row)
+	if errors.Is(err, dbr.ErrNotFound) {
+		return IdempotentResult{}, false, nil
+	}
+	if err != nil {
+		return IdempotentResult{}, false, err
+	}
+	return IdempotentResult{Event: row.Event, To: row.ToState, At: row.CreatedAt, Pending: row.Pending}, true, nil
+}
+
+func (s *SQLIdempotencyStore) Reserve(ctx context.Context, machine, id, key string, event Event, ttl time.Duration) (IdempotentResult, bool, error) {
+	runner := runnerFrom(ctx, s.Session)
+	_, err := runner.DeleteFrom(s.Table).
+		Where("machine = ? AND entity_id = ? AND idem_key = ? AND expire_at <= ?", machine, id, key, time.Now()).
+		ExecContext(ctx)
+	if err != nil {
+		return IdempotentResult{}, false, err
+	}
+	if err := s.insert(ctx, machine, id, key, pending(event), ttl); err != nil {
+		result, ok, getErr := s.Get(ctx, machine, id, key)
+		if getErr != nil || !ok {
+			return IdempotentResult{}, false, err
+		}
+		return result, false, nil
+	}
+	return IdempotentResult{}, true, nil
+}
+
+func (s *SQLIdempotencyStore) Put(ctx context.Context, machine, id, key string, result IdempotentResult, ttl time.Duration) error {
+	res, err := runnerFrom(ctx, s.Session).
+		Update(s.Table).
+		Set("event", result.Event).
+		Set("to_state", result.To).
+		Set("pending", result.Pending).
+		Set("created_at", result.At).
+		Set("expire_at", result.At.Add(ttl)).
+		Where("machine = ? AND entity_id = ? AND idem_key = ?", machine, id, key).
+		ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	return s.insert(ctx, machine, id, key, result, ttl)
+}
+
+func (s *SQLIdempotencyStore) Release(ctx context.Context, machine, id, key string) error {
+	_, err := runnerFrom(ctx, s.Session).
+		DeleteFrom(s.Table).
+		Where("machine = ? AND entity_id = ? AND idem_key = ?", machine, id, key).
+		ExecContext(ctx)
+	return err
+}
+
+func (s *SQLIdempotencyStore) insert(ctx context.Context, machine, id, key string, result IdempotentResult, ttl time.Duration) error {
+	_, err := runnerFrom(ctx, s.Session).
+		InsertInto(s.Table).
+		Pair("machine", machine).
+		Pair("entity_id", id).
+		Pair("idem_key", key).
+		Pair("event", result.Event).
+		Pair("to_state", result.To).
+		Pair("pending", result.Pending).
+		Pair("created_at", result.At).
+		Pair("expire_at", result.At.Add(ttl)).
+		ExecContext(ctx)
+	return err
+}
+
+// Purge 删除已过期的幂等键
+func (s *SQLIdempotencyStore) Purge(ctx context.Context) (int64, error) {
+	res, err := s.Session.DeleteFrom(s.Table).
+		Where("expire_at <= ?", time.Now()).
+		ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
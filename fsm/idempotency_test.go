@@ -0,0 +1,202 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/** idempotentMachine 使用幂等键存储的主订单状态机，实例 1 已创建
+* 1. 支付动作执行 pay 并计数
+* 2. ttl 为幂等键保留时间
+**/
+func idempotentMachine(t *testing.T, store IdempotencyStore, ttl time.Duration, pay func() error) (*StateMachine, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	m := mainBuilder().
+		Options(Options{Processor: testProcessor{}, Store: NewMemoryStore(), Idempotency: store, IdempotencyTTL: ttl, Quiet: true}).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).Retry(RetryPolicy{MaxAttempts: 2, RetryOn: []error{errTimeout}}).
+		Do(func(from State, event Event, to State) error {
+			calls.Add(1)
+			return pay()
+		}).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+		MustBuild()
+	if _, err := m.Start(context.Background(), "1"); err != nil {
+		t.Fatal(err)
+	}
+	return m, &calls
+}
+
+// failingPut 保存结果总是失败的幂等键存储
+type failingPut struct {
+	*MemoryIdempotencyStore
+}
+
+func (failingPut) Put(ctx context.Context, machine, id, key string, result IdempotentResult, ttl time.Duration) error {
+	return errors.New("存储不可用")
+}
+
+func TestIdempotentFireReplay(t *testing.T) {
+	ctx := WithIdempotencyKey(context.Background(), "k1")
+	ok := func() error { return nil }
+	m, calls := idempotentMachine(t, NewMemoryIdempotencyStore(), 0, ok)
+	for i := 0; i < 2; i++ {
+		if to, err := m.Fire(ctx, "1", EventPay); err != nil || to != StateWaitConfirm {
+			t.Fatalf("第 %d 次流转结果错误：%d %v", i+1, to, err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("重复的键不应再次执行：%d", calls.Load())
+	}
+	if _, err := m.Fire(ctx, "1", EventCancel); err == nil {
+		t.Fatal("同一个键用于不同事件时应返回错误")
+	}
+}
+
+func TestIdempotentFireFailureReleases(t *testing.T) {
+	ctx := WithIdempotencyKey(context.Background(), "k1")
+	fail := true
+	m, calls := idempotentMachine(t, NewMemoryIdempotencyStore(), 0, func() error {
+		if fail {
+			return errors.New("支付网关超时")
+		}
+		return nil
+	})
+	if _, err := m.Fire(ctx, "1", EventPay); err == nil {
+		t.Fatal("动作失败时应返回错误")
+	}
+	fail = false
+	if to, err := m.Fire(ctx, "1", EventPay); err != nil || to != StateWaitConfirm || calls.Load() != 2 {
+		t.Fatalf("失败后相同的键应可以重试：%d %v %d", to, err, calls.Load())
+	}
+}
+
+func TestIdempotentFireConcurrent(t *testing.T) {
+	ctx := WithIdempotencyKey(context.Background(), "k1")
+	entered, release := make(chan struct{}), make(chan struct{})
+	m, calls := idempotentMachine(t, NewMemoryIdempotencyStore(), 0, func() error {
+		close(entered)
+		<-release
+		return nil
+	})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := m.Fire(ctx, "1", EventPay); err != nil {
+			t.Error(err)
+		}
+	}()
+	<-entered
+	if _, err := m.Fire(ctx, "1", EventPay); !errors.Is(err, ErrIdempotencyPending) {
+		t.Fatalf("处理中的键应返回 ErrIdempotencyPending：%v", err)
+	}
+	close(release)
+	wg.Wait()
+	if to, err := m.Fire(ctx, "1", EventPay); err != nil || to != StateWaitConfirm || calls.Load() != 1 {
+		t.Fatalf("处理完成后应返回首次的结果：%d %v %d", to, err, calls.Load())
+	}
+}
+
+func TestIdempotentFireTTL(t *testing.T) {
+	ctx := WithIdempotencyKey(context.Background(), "k1")
+	ok := func() error { return nil }
+	m, calls := idempotentMachine(t, NewMemoryIdempotencyStore(), time.Millisecond, ok)
+	if _, err := m.Fire(ctx, "1", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// 过期后重新处理，待确认状态不能再次支付
+	if _, err := m.Fire(ctx, "1", EventPay); err == nil || errors.Is(err, ErrIdempotencyPending) {
+		t.Fatalf("过期的键应重新处理：%v", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("动作执行次数错误：%d", calls.Load())
+	}
+}
+
+func TestIdempotentFireLease(t *testing.T) {
+	// 预留需要覆盖重试等待：1 分钟加上两次重试间隔 1、2 分钟
+	m, _, _, _ := retryMachine(t, RetryPolicy{MaxAttempts: 3, Backoff: time.Minute, MaxBackoff: time.Hour})
+	if lease := m.idempotencyLease(); lease != 4*time.Minute {
+		t.Fatalf("预留时长错误：%v", lease)
+	}
+	if lease := m.WithOptions(Options{IdempotencyLease: time.Hour}).idempotencyLease(); lease != time.Hour {
+		t.Fatalf("应使用配置的预留时长：%v", lease)
+	}
+}
+
+func TestIdempotentFirePutFailure(t *testing.T) {
+	ctx := WithIdempotencyKey(context.Background(), "k1")
+	ok := func() error { return nil }
+	m, _ := idempotentMachine(t, failingPut{NewMemoryIdempotencyStore()}, 0, ok)
+	if to, err := m.Fire(ctx, "1", EventPay); err == nil || to != StateWaitConfirm {
+		t.Fatalf("保存结果失败时应返回错误与已流转的状态：%d %v", to, err)
+	}
+	if _, err := m.Fire(ctx, "1", EventPay); !errors.Is(err, ErrIdempotencyPending) {
+		t.Fatalf("保存失败后预留应继续阻止重复处理：%v", err)
+	}
+}
+
+func TestIdempotencyStores(t *testing.T) {
+	ctx := context.Background()
+	stores := map[string]func(t *testing.T) IdempotencyStore{
+		"memory": func(t *testing.T) IdempotencyStore { return NewMemoryIdempotencyStore() },
+		"sql": func(t *testing.T) IdempotencyStore {
+			session, db := newFakeSession(t)
+			db.keys["fsm_idempotency"] = []string{"machine", "entity_id", "idem_key"}
+			return NewSQLIdempotencyStore(session)
+		},
+		"redis": func(t *testing.T) IdempotencyStore {
+			_, client := newFakeRedis(t)
+			return NewRedisIdempotencyStore(client)
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			if _, reserved, err := store.Reserve(ctx, "m", "1", "k", EventPay, time.Minute); err != nil || !reserved {
+				t.Fatalf("首次预留失败：%v %v", reserved, err)
+			}
+			if result, reserved, err := store.Reserve(ctx, "m", "1", "k", EventPay, time.Minute); err != nil || reserved || !result.Pending {
+				t.Fatalf("重复预留应返回处理中的记录：%+v %v %v", result, reserved, err)
+			}
+			done := IdempotentResult{Event: EventPay, To: StateWaitConfirm, At: time.Now()}
+			if err := store.Put(ctx, "m", "1", "k", done, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if result, reserved, err := store.Reserve(ctx, "m", "1", "k", EventPay, time.Minute); err != nil || reserved ||
+				result.Pending || result.To != StateWaitConfirm {
+				t.Fatalf("保存后应返回处理结果：%+v %v %v", result, reserved, err)
+			}
+			if err := store.Release(ctx, "m", "1", "k"); err != nil {
+				t.Fatal(err)
+			}
+			if _, reserved, err := store.Reserve(ctx, "m", "1", "k", EventPay, time.Minute); err != nil || !reserved {
+				t.Fatalf("释放后应可以重新预留：%v %v", reserved, err)
+			}
+			// 其他实体的相同键互不影响
+			if _, reserved, _ := store.Reserve(ctx, "m", "2", "k", EventPay, time.Minute); !reserved {
+				t.Fatal("不同实体的键应分别预留")
+			}
+		})
+	}
+}
+
+func TestSQLIdempotencyStoreExpired(t *testing.T) {
+	ctx := context.Background()
+	session, db := newFakeSession(t)
+	db.keys["fsm_idempotency"] = []string{"machine", "entity_id", "idem_key"}
+	store := NewSQLIdempotencyStore(session)
+	if _, reserved, _ := store.Reserve(ctx, "m", "1", "k", EventPay, -time.Second); !reserved {
+		t.Fatal("首次预留失败")
+	}
+	if _, reserved, err := store.Reserve(ctx, "m", "1", "k", EventPay, time.Minute); err != nil || !reserved {
+		t.Fatalf("过期的键应可以重新预留：%v %v", reserved, err)
+	}
+}
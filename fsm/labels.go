@@ -0,0 +1,176 @@
+package fsm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Locale 语言，如 zh-CN、en-US
+type Locale string
+
+const (
+	LocaleZhCN Locale = "zh-CN"
+	LocaleEnUS Locale = "en-US"
+)
+
+// DefaultLocale 默认语言，状态机未设置 Locale 时 GetStateDesc 使用
+var DefaultLocale = LocaleZhCN
+
+// language 语言代码，如 zh-CN 的 zh
+func (l Locale) language() string {
+	language, _, _ := strings.Cut(string(l), "-")
+	return strings.ToLower(language)
+}
+
+// Labels 一种语言的状态与事件名称
+type Labels struct {
+	States map[State]string `json:"states,omitempty"`
+	Events map[Event]string `json:"events,omitempty"`
+}
+
+// SetLabels 设置一种语言的状态与事件名称，多次设置同一语言时合并
+func (s *StateMachine) SetLabels(locale Locale, labels Labels) *StateMachine {
+	s.Graph.mustNotFrozen()
+	if s.Graph.labels == nil {
+		s.Graph.labels = make(map[Locale]Labels)
+	}
+	current := s.Graph.labels[locale]
+	if current.States == nil {
+		current.States = make(map[State]string)
+	}
+	if current.Events == nil {
+		current.Events = make(map[Event]string)
+	}
+	for state, label := range labels.States {
+		current.States[state] = label
+	}
+	for event, label := range labels.Events {
+		current.Events[event] = label
+	}
+	s.Graph.labels[locale] = current
+	return s
+}
+
+// Locales 已设置名称的语言
+func (g *StateGraph) Locales() []Locale {
+	locales := make([]Locale, 0, len(g.labels))
+	for locale := range g.labels {
+		locales = append(locales, locale)
+	}
+	sort.Slice(locales, func(i, j int) bool { return locales[i] < locales[j] })
+	return locales
+}
+
+/** fallbacks 查找名称时依次尝试的语言
+* 1. 指定的语言
+* 2. 语言代码相同的其它语言，如 zh-TW 回退到 zh-CN
+* 3. DefaultLocale
+* 都没有时使用 SetStates 声明的状态名称、事件本身
+**/
+func (g *StateGraph) fallbacks(locale Locale) []Locale {
+	locales := []Locale{locale}
+	for _, l := range g.Locales() {
+		if l != locale && l.language() == locale.language() {
+			locales = append(locales, l)
+		}
+	}
+	if locale != DefaultLocale {
+		locales = append(locales, DefaultLocale)
+	}
+	return locales
+}
+
+// StateLabel 状态在指定语言下的名称
+func (g *StateGraph) StateLabel(locale Locale, state State) string {
+	for _, l := range g.fallbacks(locale) {
+		if label, ok := g.labels[l].States[state]; ok {
+			return label
+		}
+	}
+	return g.states[state]
+}
+
+// EventLabel 事件在指定语言下的名称
+func (g *StateGraph) EventLabel(locale Locale, event Event) string {
+	for _, l := range g.fallbacks(locale) {
+		if label, ok := g.labels[l].Events[event]; ok {
+			return label
+		}
+	}
+	return string(event)
+}
+
+// events 转变器与权限中出现的全部事件
+func (g *StateGraph) events() []Event {
+	seen := map[Event]bool{}
+	for _, transitions := range g.transitions {
+		for event := range transitions {
+			seen[event] = true
+		}
+	}
+	for event := range g.permissions {
+		seen[event] = true
+	}
+	events := make([]Event, 0, len(seen))
+	for event := range seen {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+	return events
+}
+
+// MissingLabel 缺少的翻译
+type MissingLabel struct {
+	Locale Locale `json:"locale"`
+	State  *State `json:"state,omitempty"`
+	Event  Event  `json:"event,omitempty"`
+}
+
+func (m MissingLabel) String() string {
+	if m.State != nil {
+		return fmt.Sprintf("%s 缺少状态翻译：%d", m.Locale, *m.State)
+	}
+	return fmt.Sprintf("%s 缺少事件翻译：%s", m.Locale, m.Event)
+}
+
+// MissingLabels 检查缺少的翻译，不回退到其它语言；未指定语言时检查所有已设置的语言
+func (g *StateGraph) MissingLabels(locales ...Locale) []MissingLabel {
+	if len(locales) == 0 {
+		locales = g.Locales()
+	}
+	states := make([]State, 0, len(g.states))
+	for state := range g.states {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+	events := g.events()
+	var missing []MissingLabel
+	for _, locale := range locales {
+		labels := g.labels[locale]
+		for _, state := range states {
+			if _, ok := labels.States[state]; !ok {
+				state := state
+				missing = append(missing, MissingLabel{Locale: locale, State: &state})
+			}
+		}
+		for _, event := range events {
+			if _, ok := labels.Events[event]; !ok {
+				missing = append(missing, MissingLabel{Locale: locale, Event: event})
+			}
+		}
+	}
+	return missing
+}
+
+func (s *StateMachine) locale() Locale {
+	if s.options.Locale != "" {
+		return s.options.Locale
+	}
+	return DefaultLocale
+}
+
+// GetEventDesc 事件在状态机语言下的名称
+func (s *StateMachine) GetEventDesc(event Event) string {
+	return s.Graph.EventLabel(s.locale(), event)
+}
@@ -0,0 +1,64 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabelsBuiltinComplete(t *testing.T) {
+	for _, m := range []*StateMachine{MainStateMachine, SubStateMachine, AfterSaleStateMachine} {
+		if missing := m.Graph.MissingLabels(LocaleZhCN, LocaleEnUS); len(missing) > 0 {
+			t.Fatalf("%s 缺少翻译：%v", m.Name(), missing)
+		}
+	}
+}
+
+func TestLabelsFallback(t *testing.T) {
+	g := SubStateMachine.Graph
+	for _, c := range []struct {
+		locale Locale
+		want   string
+	}{
+		{LocaleZhCN, "待发货"},
+		{LocaleEnUS, "Awaiting shipment"},
+		{"en-GB", "Awaiting shipment"},
+		{"zh-TW", "待发货"},
+		{"fr-FR", "待发货"},
+	} {
+		if got := g.StateLabel(c.locale, StateSubWaitShip); got != c.want {
+			t.Fatalf("%s 状态名称错误：%s", c.locale, got)
+		}
+	}
+	if got := g.EventLabel(LocaleEnUS, EventSubCancelAfterSale); got != "Cancel after-sales" {
+		t.Fatalf("事件名称错误：%s", got)
+	}
+	if got := g.EventLabel(LocaleEnUS, "unknown"); got != "unknown" {
+		t.Fatalf("未知事件应使用事件本身：%s", got)
+	}
+	if got := SubStateMachine.GetStateDesc(StateSubWaitShip); got != "待发货(2)" {
+		t.Fatalf("默认语言状态描述错误：%s", got)
+	}
+	if m := mainMachine(t, Options{}, nil); m.GetStateDesc(StateWaitPay) != "wait_pay(0)" {
+		t.Fatalf("没有翻译时应使用状态名称：%s", m.GetStateDesc(StateWaitPay))
+	}
+}
+
+func TestLabelsMissing(t *testing.T) {
+	en := Labels{States: map[State]string{StateWaitPay: "Awaiting payment"}, Events: mainLabels[LocaleEnUS].Events}
+	_, err := mainFlow().Labels(LocaleZhCN, mainLabels[LocaleZhCN]).Labels(LocaleEnUS, en).Build()
+	if err == nil || !strings.Contains(err.Error(), "en-US 缺少状态翻译：1") || strings.Contains(err.Error(), "zh-CN") {
+		t.Fatalf("应检查缺少的翻译：%v", err)
+	}
+}
+
+func TestLabelsLocale(t *testing.T) {
+	m := mainMachine(t, Options{Locale: LocaleEnUS}, func(b *Builder) {
+		b.Labels(LocaleZhCN, mainLabels[LocaleZhCN]).Labels(LocaleEnUS, mainLabels[LocaleEnUS])
+	})
+	if got := m.GetStateDesc(StateWaitConfirm); got != "Awaiting confirmation(1)" {
+		t.Fatalf("英文状态描述错误：%s", got)
+	}
+	if got := m.MermaidPath(nil); !strings.Contains(got, "s0 : Awaiting payment") || !strings.Contains(got, "s0 --> s3 : Cancel") {
+		t.Fatalf("Mermaid 应使用翻译：%s", got)
+	}
+}
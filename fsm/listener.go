@@ -0,0 +1,231 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// NopProcessor 空处理器，未设置 Processor 时使用
+type NopProcessor struct{}
+
+func (NopProcessor) ExitOldState(from, to State) error         { return nil }
+func (NopProcessor) EnterNewState(to State, event Event) error { return nil }
+
+// processor 状态机默认处理器，未设置时为空处理器
+func (s *StateMachine) processor() EventProcessor {
+	if s.options.Processor == nil {
+		return NopProcessor{}
+	}
+	return s.options.Processor
+}
+
+// ListenerPolicy 监听器出错时的策略
+type ListenerPolicy uint8
+
+const (
+	ListenerLog  ListenerPolicy = iota // 打印日志，不影响流转，默认
+	ListenerFail                       // 流转失败，进入新状态时动作已执行，只在事务模式下使流转失败，由调用方回滚
+)
+
+// ListenerOptions 监听器选项
+type ListenerOptions struct {
+	Name   string         `desc:"名称，用于日志"`
+	Policy ListenerPolicy `desc:"出错时的策略，异步监听器只打印日志"`
+	Async  bool           `desc:"异步执行，不阻塞流转，按流转顺序在独立协程中执行"`
+	Buffer int            `desc:"异步队列大小，默认 64，队列已满时丢弃并打印日志"`
+}
+
+// ListenerID 监听器编号，用于移除
+type ListenerID uint64
+
+type listenerCall struct {
+	enter bool
+	from  State
+	to    State
+	event Event
+}
+
+type listener struct {
+	id        ListenerID
+	processor EventProcessor
+	options   ListenerOptions
+
+	locker sync.Mutex
+	calls  chan listenerCall
+	closed bool
+}
+
+// listeners 监听器列表，修改时整体替换，流转中读取不加锁
+type listeners struct {
+	locker sync.Mutex
+	nextID ListenerID
+	list   atomic.Pointer[[]*listener]
+}
+
+func (l *listeners) load() []*listener {
+	if list := l.list.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+// async 是否有异步监听器
+func (l *listeners) async() bool {
+	for _, listener := range l.load() {
+		if listener.options.Async {
+			return true
+		}
+	}
+	return false
+}
+
+/** 监听器
+* 1. 状态机可以添加多个监听器，与默认处理器 Processor 实现相同的接口，按添加顺序在 Processor 之后、转变器处理器之前执行
+* 2. 同步监听器出错时按 Policy 处理：打印日志后继续，或者使流转失败；进入新状态时出错与处理器相同，非事务模式下只打印日志
+* 3. 异步监听器在独立协程中按流转顺序执行，不阻塞流转，出错或 panic 只打印日志；移除时执行完队列中的调用后退出
+*    调用与状态变更通知一样在流转成功、保存或提交后入队，流转失败或回滚时丢弃（见 commitBuffer）
+*    重试重新退出旧状态时，异步监听器的退出旧状态只调用一次
+* 4. 流转中添加或移除监听器，从下一次流转开始生效
+**/
+func (s *StateMachine) AddListener(processor EventProcessor, options ListenerOptions) ListenerID {
+	l := &listener{processor: processor, options: options}
+	if l.options.Name == "" {
+		l.options.Name = fmt.Sprintf("%T", processor)
+	}
+	if options.Async {
+		buffer := options.Buffer
+		if buffer <= 0 {
+			buffer = 64
+		}
+		l.calls = make(chan listenerCall, buffer)
+		go l.run(s.Name())
+	}
+	s.listeners.locker.Lock()
+	defer s.listeners.locker.Unlock()
+	s.listeners.nextID++
+	l.id = s.listeners.nextID
+	list := append(append([]*listener(nil), s.listeners.load()...), l)
+	s.listeners.list.Store(&list)
+	return l.id
+}
+
+// RemoveListener 移除监听器，监听器不存在时返回 false
+func (s *StateMachine) RemoveListener(id ListenerID) bool {
+	s.listeners.locker.Lock()
+	defer s.listeners.locker.Unlock()
+	current := s.listeners.load()
+	for i, l := range current {
+		if l.id != id {
+			continue
+		}
+		list := append(append([]*listener(nil), current[:i]...), current[i+1:]...)
+		s.listeners.list.Store(&list)
+		l.close()
+		return true
+	}
+	return false
+}
+
+// Listeners 当前监听器的选项，按执行顺序
+func (s *StateMachine) Listeners() []ListenerOptions {
+	current := s.listeners.load()
+	options := make([]ListenerOptions, len(current))
+	for i, l := range current {
+		options[i] = l.options
+	}
+	return options
+}
+
+// run 异步监听器的执行协程
+func (l *listener) run(machine string) {
+	for call := range l.calls {
+		if err := l.safeCall(call); err != nil {
+			log.Printf("异步监听器执行失败，状态机：%s，监听器：%s，错误：%v\n", machine, l.options.Name, err)
+		}
+	}
+}
+
+// safeCall 调用监听器，panic 转为错误，避免异步协程退出
+func (l *listener) safeCall(call listenerCall) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("监听器 panic：%v", r)
+		}
+	}()
+	return l.call(call)
+}
+
+func (l *listener) call(call listenerCall) error {
+	if call.enter {
+		return l.processor.EnterNewState(call.to, call.event)
+	}
+	return l.processor.ExitOldState(call.from, call.to)
+}
+
+// enqueue 异步监听器非阻塞入队，队列已满或已移除时丢弃
+func (l *listener) enqueue(machine string, call listenerCall) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.calls <- call:
+	default:
+		log.Printf("异步监听器队列已满，丢弃调用，状态机：%s，监听器：%s\n", machine, l.options.Name)
+	}
+}
+
+func (l *listener) close() {
+	if l.calls == nil {
+		return
+	}
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.calls)
+	}
+}
+
+/** notifyListeners 在流转中调用监听器
+* 1. 同步监听器按策略返回错误，进入新状态时只在事务模式下返回
+* 2. 异步监听器的调用放入上下文中的缓冲，成功后入队；重试时不重复缓冲退出旧状态的调用
+**/
+func (s *StateMachine) notifyListeners(ctx context.Context, trace *stepTrace, attempt int, call listenerCall) error {
+	hook := HookListenerExitOldState
+	if call.enter {
+		hook = HookListenerEnterNewState
+	}
+	_, inTx := TxFrom(ctx)
+	buffer, buffered := commitFrom(ctx)
+	for _, l := range s.listeners.load() {
+		if l.options.Async {
+			if !call.enter && attempt > 1 {
+				continue
+			}
+			if buffered {
+				buffer.addCall(s.Name(), l, call)
+			} else {
+				l.enqueue(s.Name(), call)
+			}
+			continue
+		}
+		start := trace.now()
+		err := l.call(call)
+		trace.hook(hook, attempt, start, err, nil)
+		if err == nil {
+			continue
+		}
+		if l.options.Policy == ListenerFail && (!call.enter || inTx) {
+			return fmt.Errorf("监听器 %s 执行失败：%w", l.options.Name, err)
+		}
+		if !s.options.Quiet {
+			log.Printf("监听器执行失败，状态机：%s，监听器：%s，错误：%v\n", s.Name(), l.options.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingListener 记录调用顺序
+type recordingListener struct {
+	name   string
+	locker *sync.Mutex
+	calls  *[]string
+	err    error
+}
+
+func (l recordingListener) ExitOldState(from, to State) error {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	*l.calls = append(*l.calls, fmt.Sprintf("%s.exit(%d->%d)", l.name, from, to))
+	return l.err
+}
+
+func (l recordingListener) EnterNewState(to State, event Event) error {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	*l.calls = append(*l.calls, fmt.Sprintf("%s.enter(%d,%s)", l.name, to, event))
+	return l.err
+}
+
+// asyncListener 通过通道通知调用
+type asyncListener chan string
+
+func (l asyncListener) ExitOldState(from, to State) error {
+	l <- "exit"
+	return nil
+}
+
+func (l asyncListener) EnterNewState(to State, event Event) error {
+	l <- "enter"
+	return errors.New("通知服务不可用")
+}
+
+// panicListener 退出旧状态时 panic，进入新状态时通过通道通知
+type panicListener chan string
+
+func (l panicListener) ExitOldState(from, to State) error { panic("监听器异常") }
+
+func (l panicListener) EnterNewState(to State, event Event) error {
+	l <- "enter"
+	return nil
+}
+
+// receiveCalls 在超时前依次读取异步监听器的调用
+func receiveCalls(t *testing.T, calls <-chan string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-calls:
+			if got != w {
+				t.Fatalf("异步监听器调用顺序错误：%s，期望：%s", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("异步监听器未执行")
+		}
+	}
+}
+
+// listenerMachine 未设置处理器、带 metrics 监听器的主订单状态机，calls 记录监听器调用
+func listenerMachine(t *testing.T) (*StateMachine, *recorder) {
+	t.Helper()
+	r := &recorder{}
+	m := mainMachine(t, Options{}, func(b *Builder) {
+		b.Processor(nil).Listener(r.listener("metrics", nil), ListenerOptions{Name: "metrics"})
+	})
+	return m, r
+}
+
+// recorder 多个监听器共享的调用记录
+type recorder struct {
+	locker sync.Mutex
+	calls  []string
+}
+
+func (r *recorder) listener(name string, err error) recordingListener {
+	return recordingListener{name: name, locker: &r.locker, calls: &r.calls, err: err}
+}
+
+func TestListenersOrder(t *testing.T) {
+	m, r := listenerMachine(t)
+	m.AddListener(r.listener("notice", errors.New("短信发送失败")), ListenerOptions{Name: "notice"})
+	if to, err := m.Run(StateWaitPay, EventPay); err != nil || to != StateWaitConfirm {
+		t.Fatalf("流转失败：%d %v", to, err)
+	}
+	want := []string{"metrics.exit(0->1)", "notice.exit(0->1)", "metrics.enter(1,pay)", "notice.enter(1,pay)"}
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Fatalf("监听器调用顺序错误：%v", r.calls)
+	}
+}
+
+func TestListenersRemove(t *testing.T) {
+	m, r := listenerMachine(t)
+	id := m.AddListener(r.listener("notice", nil), ListenerOptions{Name: "notice"})
+	if !m.RemoveListener(id) || m.RemoveListener(id) {
+		t.Fatal("移除监听器错误")
+	}
+	if names := m.Listeners(); len(names) != 1 || names[0].Name != "metrics" {
+		t.Fatalf("监听器列表错误：%+v", names)
+	}
+}
+
+func TestListenersFail(t *testing.T) {
+	m, r := listenerMachine(t)
+	notice := r.listener("notice", errors.New("短信发送失败"))
+	m.AddListener(notice, ListenerOptions{Name: "notice", Policy: ListenerFail})
+	if _, err := m.Run(StateWaitPay, EventPay); err == nil || !errors.Is(err, notice.err) {
+		t.Fatalf("监听器出错应使流转失败：%v", err)
+	}
+	if names := m.Listeners(); len(names) != 2 || names[0].Name != "metrics" || names[1].Name != "notice" {
+		t.Fatalf("监听器列表错误：%+v", names)
+	}
+	plan, _ := m.Simulate(context.Background(), StateWaitPay, EventPay)
+	if len(plan.Steps) != 1 || len(plan.Steps[0].Hooks) != 7 {
+		t.Fatalf("试运行应列出同步监听器：%+v", plan)
+	}
+}
+
+func TestListenersFailOnEnter(t *testing.T) {
+	m, _ := listenerMachine(t)
+	notice := testProcessor{enterErr: errors.New("短信发送失败")}
+	m.AddListener(notice, ListenerOptions{Name: "notice", Policy: ListenerFail})
+	if to, err := m.Run(StateWaitPay, EventPay); err != nil || to != StateWaitConfirm {
+		t.Fatalf("非事务模式下进入新状态的监听器出错不应使流转失败：%d %v", to, err)
+	}
+	session, _ := newFakeSession(t)
+	if _, err := m.RunContext(WithTx(context.Background(), session), StateWaitPay, EventPay); !errors.Is(err, notice.enterErr) {
+		t.Fatalf("事务模式下进入新状态的监听器出错应使流转失败：%v", err)
+	}
+}
+
+func TestListenersAsync(t *testing.T) {
+	m, _ := listenerMachine(t)
+	async := make(asyncListener, 4)
+	asyncID := m.AddListener(async, ListenerOptions{Async: true})
+	m.RemoveListener(1)
+	if _, err := m.Run(StateWaitConfirm, EventPayConfirm); err != nil {
+		t.Fatalf("异步监听器出错不应影响流转：%v", err)
+	}
+	receiveCalls(t, async, "exit", "enter")
+	m.RemoveListener(asyncID)
+	if _, err := m.Run(StateWaitConfirm, EventPayConfirm); err != nil || len(m.Listeners()) != 0 {
+		t.Fatalf("移除异步监听器后流转失败：%v", err)
+	}
+}
+
+func TestListenersAsyncPanic(t *testing.T) {
+	m, _ := listenerMachine(t)
+	calls := make(panicListener, 4)
+	m.AddListener(calls, ListenerOptions{Async: true})
+	if _, err := m.Run(StateWaitPay, EventPay); err != nil {
+		t.Fatal(err)
+	}
+	// 退出旧状态 panic 后协程继续执行进入新状态
+	receiveCalls(t, calls, "enter")
+}
+
+func TestListenersAsyncRerunExit(t *testing.T) {
+	m, _, processor, _ := retryMachine(t, RetryPolicy{MaxAttempts: 3, RerunExit: true}, Transient(errTimeout), Transient(errTimeout))
+	async := make(asyncListener, 8)
+	m.AddListener(async, ListenerOptions{Async: true})
+	if _, err := m.Fire(context.Background(), "1", EventPay); err != nil || processor.exits != 3 {
+		t.Fatalf("重试流转错误：%v %d", err, processor.exits)
+	}
+	receiveCalls(t, async, "exit", "enter")
+}
+
+func TestListenersAsyncAfterCommit(t *testing.T) {
+	m, _ := listenerMachine(t)
+	async := make(asyncListener, 4)
+	m.AddListener(async, ListenerOptions{Async: true})
+	txCtx, done := WithAfterCommit(context.Background())
+	if _, err := m.RunContext(txCtx, StateWaitPay, EventPay); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case call := <-async:
+		t.Fatalf("提交前不应调用异步监听器：%s", call)
+	case <-time.After(20 * time.Millisecond):
+	}
+	done(errors.New("事务回滚"))
+	if _, err := m.RunContext(txCtx, StateWaitPay, EventPay); err != nil {
+		t.Fatal(err)
+	}
+	done(nil)
+	// 回滚的调用被丢弃，只收到提交的一次
+	receiveCalls(t, async, "exit", "enter")
+	if len(async) != 0 {
+		t.Fatalf("回滚后不应调用异步监听器：%d", len(async))
+	}
+}
@@ -0,0 +1,224 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoCollection 状态存储用到的集合方法，*mongo.Collection 实现了该接口，测试时可以替换
+type MongoCollection interface {
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+}
+
+// MongoIndexView 创建索引，*mongo.Collection 的 Indexes() 实现了该接口
+type MongoIndexView interface {
+	CreateMany(ctx context.Context, models []mongo.IndexModel, opts ...*options.CreateIndexesOptions) ([]string, error)
+}
+
+type mongoInstance struct {
+	ID        string    `bson:"_id"`
+	Machine   string    `bson:"machine"`
+	EntityID  string    `bson:"entity_id"`
+	Version   int       `bson:"version"`
+	State     State     `bson:"state"`
+	Revision  int64     `bson:"revision"`
+	EnteredAt time.Time `bson:"entered_at"`
+
+	History  map[string]State `bson:"history,omitempty"` // BSON 文档的键只能是字符串
+	Deferred []DeferredEvent  `bson:"deferred,omitempty"`
+}
+
+func (doc mongoInstance) instance() Instance {
+	inst := Instance{
+		ID:        doc.EntityID,
+		Machine:   doc.Machine,
+		Version:   doc.Version,
+		State:     doc.State,
+		Revision:  doc.Revision,
+		EnteredAt: doc.EnteredAt,
+		Deferred:  doc.Deferred,
+	}
+	for key, remembered := range doc.History {
+		composite, err := strconv.ParseUint(key, 10, 8)
+		if err != nil {
+			continue
+		}
+		if inst.History == nil {
+			inst.History = make(map[State]State)
+		}
+		inst.History[State(composite)] = remembered
+	}
+	return inst
+}
+
+func mongoHistory(history map[State]State) map[string]State {
+	if len(history) == 0 {
+		return nil
+	}
+	doc := make(map[string]State, len(history))
+	for composite, remembered := range history {
+		doc[strconv.Itoa(int(composite))] = remembered
+	}
+	return doc
+}
+
+// mongoID 文档ID：状态机名称/实体ID
+func mongoID(machine, id string) string {
+	return machine + "/" + id
+}
+
+/** MongoDB 状态存储
+* 1. 每个实例一个文档，_id 为 状态机名称/实体ID
+* 2. 以 revision 字段做乐观锁，更新时通过 FindOneAndUpdate 匹配旧的修订号
+* 3. EnsureIndexes 创建 (machine, state, entered_at) 索引，用于查询 "处于状态X且早于T" 的实例
+**/
+type MongoStore struct {
+	Collection MongoCollection
+}
+
+func NewMongoStore(collection MongoCollection) *MongoStore {
+	return &MongoStore{Collection: collection}
+}
+
+// EnsureIndexes 创建状态查询索引，indexes 传入 collection.Indexes()
+func (m *MongoStore) EnsureIndexes(ctx context.Context, indexes MongoIndexView) error {
+	_, err := indexes.CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "machine", Value: 1}, {Key: "state", Value: 1}, {Key: "entered_at", Value: 1}},
+			Options: options.Index().SetName("idx_machine_state_entered"),
+		},
+	})
+	return err
+}
+
+func (m *MongoStore) Load(ctx context.Context, machine, id string) (Instance, error) {
+	var doc mongoInstance
+	err := m.Collection.FindOne(ctx, bson.M{"_id": mongoID(machine, id)}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Instance{}, ErrInstanceNotFound
+	}
+	if err != nil {
+		return Instance{}, err
+	}
+	return doc.instance(), nil
+}
+
+func (m *MongoStore) Save(ctx context.Context, inst *Instance) error {
+	if inst.Revision == 0 {
+		_, err := m.Collection.InsertOne(ctx, mongoInstance{
+			ID:        mongoID(inst.Machine, inst.ID),
+			Machine:   inst.Machine,
+			EntityID:  inst.ID,
+			Version:   inst.Version,
+			State:     inst.State,
+			Revision:  1,
+			EnteredAt: inst.EnteredAt,
+			History:   mongoHistory(inst.History),
+			Deferred:  inst.Deferred,
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrConflict
+		}
+		if err != nil {
+			return err
+		}
+		inst.Revision = 1
+		return nil
+	}
+	filter := bson.M{"_id": mongoID(inst.Machine, inst.ID), "revision": inst.Revision}
+	update := bson.M{"$set": bson.M{
+		"version":    inst.Version,
+		"state":      inst.State,
+		"revision":   inst.Revision + 1,
+		"entered_at": inst.EnteredAt,
+		"history":    mongoHistory(inst.History),
+		"deferred":   inst.Deferred,
+	}}
+	err := m.Collection.FindOneAndUpdate(ctx, filter, update).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	inst.Revision++
+	return nil
+}
+
+func (m *MongoStore) FindInState(ctx context.Context, machine string, state State, before time.Time) ([]Instance, error) {
+	filter := bson.M{
+		"machine":    machine,
+		"state":      state,
+		"entered_at": bson.M{"$lt": before},
+	}
+	cursor, err := m.Collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "entered_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var insts []Instance
+	for cursor.Next(ctx) {
+		var doc mongoInstance
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		insts = append(insts, doc.instance())
+	}
+	return insts, cursor.Err()
+}
+
+// MongoHistory MongoDB 流转历史，每条记录一个文档
+type MongoHistory struct {
+	Collection MongoCollection
+}
+
+func NewMongoHistory(collection MongoCollection) *MongoHistory {
+	return &MongoHistory{Collection: collection}
+}
+
+// EnsureIndexes 创建按实例查询历史的索引
+func (m *MongoHistory) EnsureIndexes(ctx context.Context, indexes MongoIndexView) error {
+	_, err := indexes.CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "machine", Value: 1}, {Key: "entity_id", Value: 1}, {Key: "at", Value: 1}},
+			Options: options.Index().SetName("idx_machine_entity_at"),
+		},
+	})
+	return err
+}
+
+func (m *MongoHistory) Record(ctx context.Context, records ...TransitionRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(records))
+	for i, r := range records {
+		docs[i] = r
+	}
+	_, err := m.Collection.InsertMany(ctx, docs)
+	return err
+}
+
+func (m *MongoHistory) History(ctx context.Context, machine, id string) ([]TransitionRecord, error) {
+	filter := bson.M{"machine": machine, "entity_id": id}
+	cursor, err := m.Collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var records []TransitionRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
@@ -0,0 +1,239 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeCollection 内存集合，条件只支持等值与 $lt，更新只支持 $set
+type fakeCollection struct {
+	locker sync.Mutex
+	docs   []bson.M
+	models []mongo.IndexModel
+}
+
+// toM 通过 BSON 编解码统一字段类型
+func toM(v interface{}) bson.M {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	var m bson.M
+	if err := bson.Unmarshal(data, &m); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func (c *fakeCollection) match(doc bson.M, filter interface{}) bool {
+	for key, want := range toM(filter) {
+		if cond, ok := want.(bson.M); ok {
+			lt, ok := cond["$lt"].(primitive.DateTime)
+			got, _ := doc[key].(primitive.DateTime)
+			if !ok || got >= lt {
+				return false
+			}
+			continue
+		}
+		if !reflect.DeepEqual(doc[key], want) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *fakeCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	for _, doc := range c.docs {
+		if c.match(doc, filter) {
+			return mongo.NewSingleResultFromDocument(doc, nil, nil)
+		}
+	}
+	return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+}
+
+func (c *fakeCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	for _, doc := range c.docs {
+		if c.match(doc, filter) {
+			before := bson.M{}
+			for k, v := range doc {
+				before[k] = v
+			}
+			for k, v := range toM(update)["$set"].(bson.M) {
+				doc[k] = v
+			}
+			return mongo.NewSingleResultFromDocument(before, nil, nil)
+		}
+	}
+	return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+}
+
+func (c *fakeCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	var docs []bson.M
+	for _, doc := range c.docs {
+		if c.match(doc, filter) {
+			docs = append(docs, doc)
+		}
+	}
+	for _, opt := range opts {
+		if sortKeys, ok := opt.Sort.(bson.D); ok && len(sortKeys) > 0 {
+			key := sortKeys[0].Key
+			sort.SliceStable(docs, func(i, j int) bool {
+				return docs[i][key].(primitive.DateTime) < docs[j][key].(primitive.DateTime)
+			})
+		}
+	}
+	results := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		results[i] = doc
+	}
+	return mongo.NewCursorFromDocuments(results, nil, nil)
+}
+
+func (c *fakeCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	doc := toM(document)
+	if id, ok := doc["_id"]; ok {
+		for _, existing := range c.docs {
+			if existing["_id"] == id {
+				return nil, mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "duplicate key"}}}
+			}
+		}
+	}
+	c.docs = append(c.docs, doc)
+	return &mongo.InsertOneResult{InsertedID: doc["_id"]}, nil
+}
+
+func (c *fakeCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	for _, document := range documents {
+		if _, err := c.InsertOne(ctx, document); err != nil {
+			return nil, err
+		}
+	}
+	return &mongo.InsertManyResult{}, nil
+}
+
+func (c *fakeCollection) CreateMany(ctx context.Context, models []mongo.IndexModel, opts ...*options.CreateIndexesOptions) ([]string, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.models = append(c.models, models...)
+	names := make([]string, len(models))
+	for i, model := range models {
+		names[i] = *model.Options.Name
+	}
+	return names, nil
+}
+
+func TestMongoStoreOptimisticConcurrency(t *testing.T) {
+	ctx := context.Background()
+	store := NewMongoStore(&fakeCollection{})
+	inst := Instance{ID: "1001", Machine: SubMachineName, State: StateSubWaitPay, EnteredAt: time.Now()}
+	if err := store.Save(ctx, &inst); err != nil {
+		t.Fatal(err)
+	}
+	duplicate := Instance{ID: "1001", Machine: SubMachineName, State: StateSubWaitPay}
+	if err := store.Save(ctx, &duplicate); !errors.Is(err, ErrConflict) {
+		t.Fatalf("重复创建应返回冲突：%v", err)
+	}
+
+	first, err := store.Load(ctx, SubMachineName, "1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := first
+	first.State = StateSubWaitConfirm
+	if err := store.Save(ctx, &first); err != nil {
+		t.Fatal(err)
+	}
+	second.State = StateSubCanceled
+	if err := store.Save(ctx, &second); !errors.Is(err, ErrConflict) {
+		t.Fatalf("修订号过期应返回冲突：%v", err)
+	}
+	loaded, err := store.Load(ctx, SubMachineName, "1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.State != StateSubWaitConfirm || loaded.Revision != 2 {
+		t.Fatalf("实例错误：%+v", loaded)
+	}
+	if _, err := store.Load(ctx, SubMachineName, "404"); !errors.Is(err, ErrInstanceNotFound) {
+		t.Fatalf("实例不存在应返回 ErrInstanceNotFound：%v", err)
+	}
+}
+
+func TestMongoStoreFindInState(t *testing.T) {
+	ctx := context.Background()
+	collection := &fakeCollection{}
+	store := NewMongoStore(collection)
+	if err := store.EnsureIndexes(ctx, collection); err != nil {
+		t.Fatal(err)
+	}
+	if len(collection.models) != 1 {
+		t.Fatalf("索引数量错误：%d", len(collection.models))
+	}
+	now := time.Now()
+	for i, age := range []time.Duration{72 * time.Hour, 50 * time.Hour, time.Hour} {
+		inst := Instance{ID: string(rune('a' + i)), Machine: SubMachineName, State: StateSubWaitShip, EnteredAt: now.Add(-age)}
+		if err := store.Save(ctx, &inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := Instance{ID: "d", Machine: SubMachineName, State: StateSubWaitPay, EnteredAt: now.Add(-72 * time.Hour)}
+	if err := store.Save(ctx, &other); err != nil {
+		t.Fatal(err)
+	}
+	insts, err := store.FindInState(ctx, SubMachineName, StateSubWaitShip, now.Add(-48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insts) != 2 || insts[0].ID != "a" || insts[1].ID != "b" {
+		t.Fatalf("查询结果错误：%+v", insts)
+	}
+}
+
+func TestMongoHistory(t *testing.T) {
+	ctx := context.Background()
+	history := NewMongoHistory(&fakeCollection{})
+	m := mainFlow().
+		Options(Options{Processor: testProcessor{}, Store: NewMongoStore(&fakeCollection{}), History: history, Quiet: true}).
+		MustBuild()
+
+	if _, err := m.Start(ctx, "1001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Fire(ctx, "1001", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Fire(ctx, "1001", EventCancel); err == nil {
+		t.Fatal("待确认状态不能取消")
+	}
+	if _, err := m.Fire(ctx, "1001", EventPayConfirm); err != nil {
+		t.Fatal(err)
+	}
+	records, err := history.History(ctx, MainMachineName, "1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("历史记录数量错误：%+v", records)
+	}
+	if records[0].To != StateWaitConfirm || records[1].Error == "" || records[2].To != StatePayied {
+		t.Fatalf("历史记录错误：%+v", records)
+	}
+}
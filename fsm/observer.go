@@ -0,0 +1,281 @@
+package fsm
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TransitionEvent 状态变更通知
+type TransitionEvent struct {
+	Machine  string    `json:"machine"`
+	EntityID string    `json:"entity_id"`
+	From     State     `json:"from"`
+	Event    Event     `json:"event"`
+	To       State     `json:"to"`
+	At       time.Time `json:"at"`
+}
+
+// Filter 订阅过滤条件，字段为空表示不限制
+type Filter struct {
+	Machine string  `desc:"状态机名称"`
+	Events  []Event `desc:"事件"`
+	From    []State `desc:"旧状态"`
+	To      []State `desc:"新状态"`
+}
+
+// Entered 订阅进入指定状态的通知，如 "子订单进入待收货"
+func Entered(machine string, states ...State) Filter {
+	return Filter{Machine: machine, To: states}
+}
+
+func (f Filter) Match(e TransitionEvent) bool {
+	if f.Machine != "" && f.Machine != e.Machine {
+		return false
+	}
+	if len(f.Events) > 0 && !containsEvent(f.Events, e.Event) {
+		return false
+	}
+	if len(f.From) > 0 && !containsState(f.From, e.From) {
+		return false
+	}
+	if len(f.To) > 0 && !containsState(f.To, e.To) {
+		return false
+	}
+	return true
+}
+
+func containsEvent(events []Event, event Event) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func containsState(states []State, state State) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// SlowConsumer 订阅者消费过慢（缓冲已满）时的处理策略
+type SlowConsumer int
+
+const (
+	// SlowConsumerDrop 丢弃新通知并计数
+	SlowConsumerDrop SlowConsumer = iota
+	// SlowConsumerDisconnect 关闭订阅
+	SlowConsumerDisconnect
+)
+
+// Subscription 订阅，通过 C 接收通知，订阅关闭后 C 被关闭
+type Subscription struct {
+	C <-chan TransitionEvent
+
+	ch      chan TransitionEvent
+	filter  Filter
+	policy  SlowConsumer
+	dropped atomic.Uint64
+	locker  sync.Mutex
+	closed  bool
+	onClose func()
+}
+
+func newSubscription(filter Filter, buffer int, policy SlowConsumer, onClose func()) *Subscription {
+	ch := make(chan TransitionEvent, buffer)
+	return &Subscription{
+		C:       ch,
+		ch:      ch,
+		filter:  filter,
+		policy:  policy,
+		onClose: onClose,
+	}
+}
+
+// deliver 非阻塞投递，缓冲已满时按策略丢弃或关闭订阅
+func (s *Subscription) deliver(e TransitionEvent) {
+	if !s.filter.Match(e) {
+		return
+	}
+	s.locker.Lock()
+	if s.closed {
+		s.locker.Unlock()
+		return
+	}
+	select {
+	case s.ch <- e:
+		s.locker.Unlock()
+		return
+	default:
+	}
+	s.locker.Unlock()
+	s.dropped.Add(1)
+	if s.policy == SlowConsumerDisconnect {
+		log.Printf("订阅者消费过慢，关闭订阅，状态机：%s\n", s.filter.Machine)
+		s.Close()
+	}
+}
+
+// Dropped 因消费过慢被丢弃的通知数
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close 取消订阅并关闭 C
+func (s *Subscription) Close() {
+	s.locker.Lock()
+	if s.closed {
+		s.locker.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.ch)
+	s.locker.Unlock()
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
+
+// Notifier 状态变更通知，Notify 发布通知，Subscribe 按条件订阅
+type Notifier interface {
+	Notify(ctx context.Context, e TransitionEvent) error
+	Subscribe(filter Filter) (*Subscription, error)
+}
+
+// notify 流转成功后产生通知，放入上下文中的缓冲（见 commitBuffer），等待持久化成功后发布
+func (s *StateMachine) notify(ctx context.Context, from State, event Event, to State) {
+	if s.options.Notifier == nil {
+		return
+	}
+	e := TransitionEvent{
+		Machine: s.Name(),
+		From:    from,
+		Event:   event,
+		To:      to,
+		At:      time.Now(),
+	}
+	if inst, ok := InstanceFrom(ctx); ok {
+		e.EntityID = inst.ID
+	}
+	buffer, ok := commitFrom(ctx)
+	if !ok {
+		s.publish(ctx, s.options.Notifier, e)
+		return
+	}
+	buffer.addNotify(s, e)
+}
+
+func (s *StateMachine) publish(ctx context.Context, notifier Notifier, e TransitionEvent) {
+	if err := notifier.Notify(ctx, e); err != nil {
+		log.Printf("状态变更通知失败，状态机：%s，事件：%s，错误：%v\n", e.Machine, e.Event, err)
+	}
+}
+
+// LocalNotifier 进程内通知，发布时扇出到所有匹配的订阅者
+type LocalNotifier struct {
+	Buffer int          // 每个订阅者的缓冲大小
+	Policy SlowConsumer // 消费过慢时的策略
+
+	locker sync.RWMutex
+	subs   map[*Subscription]struct{}
+}
+
+func NewLocalNotifier(buffer int, policy SlowConsumer) *LocalNotifier {
+	return &LocalNotifier{
+		Buffer: buffer,
+		Policy: policy,
+		subs:   make(map[*Subscription]struct{}),
+	}
+}
+
+func (n *LocalNotifier) Notify(ctx context.Context, e TransitionEvent) error {
+	n.locker.RLock()
+	subs := make([]*Subscription, 0, len(n.subs))
+	for sub := range n.subs {
+		subs = append(subs, sub)
+	}
+	n.locker.RUnlock()
+	for _, sub := range subs {
+		sub.deliver(e)
+	}
+	return nil
+}
+
+func (n *LocalNotifier) Subscribe(filter Filter) (*Subscription, error) {
+	var sub *Subscription
+	sub = newSubscription(filter, n.Buffer, n.Policy, func() {
+		n.locker.Lock()
+		delete(n.subs, sub)
+		n.locker.Unlock()
+	})
+	n.locker.Lock()
+	n.subs[sub] = struct{}{}
+	n.locker.Unlock()
+	return sub, nil
+}
+
+// RedisNotifier 通过 Redis pub/sub 跨服务通知，每个状态机一个频道，通知序列化为 JSON
+type RedisNotifier struct {
+	Client *redis.Client
+	Prefix string       // 频道前缀，频道名为 前缀+状态机名称
+	Buffer int          // 每个订阅者的缓冲大小
+	Policy SlowConsumer // 消费过慢时的策略
+}
+
+func NewRedisNotifier(client *redis.Client) *RedisNotifier {
+	return &RedisNotifier{
+		Client: client,
+		Prefix: "fsm:transition:",
+		Buffer: 100,
+		Policy: SlowConsumerDrop,
+	}
+}
+
+func (n *RedisNotifier) Notify(ctx context.Context, e TransitionEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return n.Client.Publish(ctx, n.Prefix+e.Machine, data).Err()
+}
+
+// Subscribe 指定状态机时订阅该状态机的频道，否则订阅所有状态机的频道
+func (n *RedisNotifier) Subscribe(filter Filter) (*Subscription, error) {
+	ctx := context.Background()
+	var pubsub *redis.PubSub
+	if filter.Machine != "" {
+		pubsub = n.Client.Subscribe(ctx, n.Prefix+filter.Machine)
+	} else {
+		pubsub = n.Client.PSubscribe(ctx, n.Prefix+"*")
+	}
+	// 等待订阅确认，确保返回后不会漏掉通知
+	if _, err := pubsub.Receive(ctx); err != nil {
+		_ = pubsub.Close()
+		return nil, err
+	}
+	sub := newSubscription(filter, n.Buffer, n.Policy, func() {
+		_ = pubsub.Close()
+	})
+	go func() {
+		defer sub.Close()
+		for msg := range pubsub.Channel() {
+			var e TransitionEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				log.Printf("状态变更通知解析失败，频道：%s，错误：%v\n", msg.Channel, err)
+				continue
+			}
+			sub.deliver(e)
+		}
+	}()
+	return sub, nil
+}
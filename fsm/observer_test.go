@@ -0,0 +1,191 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingSave fail 为 true 时保存失败的状态存储
+type failingSave struct {
+	*MemoryStore
+	fail bool
+}
+
+func (s *failingSave) Save(ctx context.Context, inst *Instance) error {
+	if s.fail {
+		return errors.New("数据库不可用")
+	}
+	return s.MemoryStore.Save(ctx, inst)
+}
+
+// receive 在超时前从订阅中读取一条通知
+func receive(t *testing.T, sub *Subscription) (TransitionEvent, bool) {
+	t.Helper()
+	select {
+	case e, ok := <-sub.C:
+		return e, ok
+	case <-time.After(time.Second):
+		t.Fatal("未收到通知")
+		return TransitionEvent{}, false
+	}
+}
+
+// assertSilent 订阅中没有通知
+func assertSilent(t *testing.T, sub *Subscription, reason string) {
+	t.Helper()
+	select {
+	case e := <-sub.C:
+		t.Fatalf("%s：%+v", reason, e)
+	default:
+	}
+}
+
+func TestLocalNotifierFire(t *testing.T) {
+	ctx := context.Background()
+	notifier := NewLocalNotifier(10, SlowConsumerDrop)
+	m := mainMachine(t, Options{Store: NewMemoryStore(), Notifier: notifier}, nil)
+	sub, _ := notifier.Subscribe(Entered(MainMachineName, StateWaitConfirm))
+	other, _ := notifier.Subscribe(Entered(MainMachineName, StateCanceled))
+	m.Start(ctx, "1")
+	if _, err := m.Fire(ctx, "1", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := receive(t, sub); e.EntityID != "1" || e.From != StateWaitPay || e.Event != EventPay {
+		t.Fatalf("通知内容错误：%+v", e)
+	}
+	assertSilent(t, other, "不匹配的订阅不应收到通知")
+}
+
+func TestLocalNotifierSaveFailure(t *testing.T) {
+	ctx := context.Background()
+	notifier := NewLocalNotifier(10, SlowConsumerDrop)
+	store := &failingSave{MemoryStore: NewMemoryStore()}
+	m := mainMachine(t, Options{Store: store, Notifier: notifier}, nil)
+	sub, _ := notifier.Subscribe(Filter{})
+	m.Start(ctx, "1")
+	store.fail = true
+	if _, err := m.Fire(ctx, "1", EventPay); err == nil {
+		t.Fatal("保存失败时应返回错误")
+	}
+	assertSilent(t, sub, "保存失败时不应发布通知")
+}
+
+func TestLocalNotifierRunFailure(t *testing.T) {
+	ctx := context.Background()
+	notifier := NewLocalNotifier(10, SlowConsumerDrop)
+	// 支付后产生的取消在待确认状态下无法处理，整个流转失败
+	m := mainBuilder().
+		Options(Options{Processor: testProcessor{}, Notifier: notifier, Quiet: true}).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).
+		DoContext(func(ctx context.Context, from State, event Event, to State) error {
+			return Raise(ctx, EventCancel)
+		}).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+		MustBuild()
+	sub, _ := notifier.Subscribe(Filter{})
+	if _, err := m.RunContext(ctx, StateWaitPay, EventPay); err == nil {
+		t.Fatal("后续事件失败时应返回错误")
+	}
+	assertSilent(t, sub, "流转失败时不应发布通知")
+}
+
+func TestLocalNotifierAfterCommit(t *testing.T) {
+	ctx := context.Background()
+	notifier := NewLocalNotifier(10, SlowConsumerDrop)
+	m := mainMachine(t, Options{Store: NewMemoryStore(), Notifier: notifier}, nil)
+	sub, _ := notifier.Subscribe(Filter{})
+	m.Start(ctx, "1")
+	txCtx, done := WithAfterCommit(ctx)
+	if _, err := m.Fire(txCtx, "1", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	assertSilent(t, sub, "提交前不应发布通知")
+	done(nil)
+	if e, _ := receive(t, sub); e.To != StateWaitConfirm {
+		t.Fatalf("提交后应发布通知：%+v", e)
+	}
+}
+
+func TestLocalNotifierOutbox(t *testing.T) {
+	ctx := context.Background()
+	notifier := NewLocalNotifier(10, SlowConsumerDrop)
+	m, session, _ := outboxMachine(t)
+	m = m.WithOptions(Options{Processor: testProcessor{}, Store: m.Options().Store, Notifier: notifier, Quiet: true})
+	sub, _ := notifier.Subscribe(Filter{})
+	if _, err := NewOutbox(session).Fire(ctx, m, "1001", EventCancel); err == nil {
+		t.Fatal("动作失败时应返回错误")
+	}
+	assertSilent(t, sub, "回滚时不应发布通知")
+	if _, err := NewOutbox(session).Fire(ctx, m, "1001", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := receive(t, sub); e.To != StateWaitConfirm {
+		t.Fatalf("提交后应发布通知：%+v", e)
+	}
+}
+
+func TestLocalNotifierSlowConsumerDrop(t *testing.T) {
+	ctx := context.Background()
+	notifier := NewLocalNotifier(1, SlowConsumerDrop)
+	sub, _ := notifier.Subscribe(Filter{})
+	for i := 0; i < 3; i++ {
+		notifier.Notify(ctx, TransitionEvent{Machine: MainMachineName, EntityID: "1"})
+	}
+	if sub.Dropped() != 2 || len(sub.C) != 1 {
+		t.Fatalf("缓冲已满时应丢弃并计数：%d %d", sub.Dropped(), len(sub.C))
+	}
+}
+
+func TestLocalNotifierSlowConsumerDisconnect(t *testing.T) {
+	ctx := context.Background()
+	notifier := NewLocalNotifier(1, SlowConsumerDisconnect)
+	sub, _ := notifier.Subscribe(Filter{})
+	for i := 0; i < 2; i++ {
+		notifier.Notify(ctx, TransitionEvent{Machine: MainMachineName, EntityID: "1"})
+	}
+	receive(t, sub)
+	if _, ok := receive(t, sub); ok {
+		t.Fatal("缓冲已满时应关闭订阅")
+	}
+	if len(notifier.subs) != 0 {
+		t.Fatal("关闭的订阅应从通知器中移除")
+	}
+}
+
+func TestRedisNotifier(t *testing.T) {
+	ctx := context.Background()
+	_, client := newFakeRedis(t)
+	notifier := NewRedisNotifier(client)
+	m := mainMachine(t, Options{Store: NewMemoryStore(), Notifier: notifier}, nil)
+
+	sub, err := notifier.Subscribe(Entered(MainMachineName, StateWaitConfirm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	all, err := notifier.Subscribe(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Close()
+
+	m.Start(ctx, "1")
+	m.Start(ctx, "2")
+	if _, err := m.Fire(ctx, "1", EventCancel); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Fire(ctx, "2", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := receive(t, sub); e.EntityID != "2" || e.To != StateWaitConfirm {
+		t.Fatalf("只应收到匹配的通知：%+v", e)
+	}
+	for _, want := range []string{"1", "2"} {
+		if e, _ := receive(t, all); e.EntityID != want {
+			t.Fatalf("按模式订阅应收到所有状态机的通知：%+v", e)
+		}
+	}
+}
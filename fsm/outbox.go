@@ -0,0 +1,312 @@
+package fsm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Message 动作产生的后续消息，与状态变更在同一事务中写入发件箱
+type Message struct {
+	ID        string          `json:"id"`
+	Machine   string          `json:"machine"`
+	EntityID  string          `json:"entity_id"`
+	Topic     string          `json:"topic"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// outboxBuffer 一次流转中产生的消息
+type outboxBuffer struct {
+	locker   sync.Mutex
+	messages []Message
+}
+
+func (b *outboxBuffer) merge(child *outboxBuffer) {
+	child.locker.Lock()
+	messages := child.messages
+	child.locker.Unlock()
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	b.messages = append(b.messages, messages...)
+}
+
+// Emit 在动作中产生一条后续消息，消息会在状态变更提交时写入发件箱
+// 只能在 Outbox.Fire 执行的 ContextAction 中调用
+func Emit(ctx context.Context, topic string, payload interface{}) error {
+	buffer, ok := ctx.Value(outboxKey).(*outboxBuffer)
+	if !ok {
+		return fmt.Errorf("未开启发件箱，无法发送消息：%s", topic)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("消息序列化失败：%w", err)
+	}
+	msg := Message{
+		ID:        newMessageID(),
+		Topic:     topic,
+		Payload:   data,
+		CreatedAt: time.Now(),
+	}
+	if inst, ok := InstanceFrom(ctx); ok {
+		msg.Machine = inst.Machine
+		msg.EntityID = inst.ID
+	}
+	buffer.locker.Lock()
+	buffer.messages = append(buffer.messages, msg)
+	buffer.locker.Unlock()
+	return TracePayload(ctx, msg)
+}
+
+// newMessageID 随机消息ID，用于消费端去重
+func newMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+/** 发件箱，默认表结构：
+* CREATE TABLE fsm_outbox (
+*   id              BIGINT AUTO_INCREMENT PRIMARY KEY,
+*   message_id      CHAR(32)     NOT NULL UNIQUE,
+*   machine         VARCHAR(64)  NOT NULL,
+*   entity_id       VARCHAR(64)  NOT NULL,
+*   topic           VARCHAR(128) NOT NULL,
+*   payload         TEXT         NOT NULL,
+*   attempts        INT          NOT NULL DEFAULT 0,
+*   created_at      DATETIME(3)  NOT NULL,
+*   next_attempt_at DATETIME(3)  NOT NULL,
+*   published_at    DATETIME(3)  NULL,
+*   KEY idx_pending (published_at, next_attempt_at)
+* );
+**/
+type Outbox struct {
+	Session *dbr.Session
+	Table   string
+}
+
+func NewOutbox(session *dbr.Session) *Outbox {
+	return &Outbox{Session: session, Table: "fsm_outbox"}
+}
+
+/** 在一个事务中执行事件
+* 1. 开启事务，并通过上下文传递给状态存储与动作
+* 2. 执行状态机 Fire，动作通过 Emit 产生消息
+* 3. 把消息写入发件箱表
+* 4. 提交事务，任一步骤失败则回滚，消息不会被发送；流转记录在提交或回滚后写入，状态变更通知在提交后发布
+* 状态机的 Store 需要使用同一个数据库（如 SQLStore），否则状态变更不在事务中
+**/
+func (o *Outbox) Fire(ctx context.Context, m *StateMachine, id string, event Event) (State, error) {
+	tx, err := o.Session.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	buffer := &outboxBuffer{}
+	ctx, done := WithAfterCommit(context.WithValue(WithTx(ctx, tx), outboxKey, buffer))
+	to, err := m.Fire(ctx, id, event)
+	if err == nil {
+		err = o.insert(ctx, tx, buffer.messages)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	done(err)
+	if err != nil {
+		return 0, err
+	}
+	return to, nil
+}
+
+func (o *Outbox) insert(ctx context.Context, runner dbr.SessionRunner, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	stmt := runner.InsertInto(o.Table).
+		Columns("message_id", "machine", "entity_id", "topic", "payload", "attempts", "created_at", "next_attempt_at")
+	for _, msg := range messages {
+		stmt.Values(msg.ID, msg.Machine, msg.EntityID, msg.Topic, string(msg.Payload), 0, msg.CreatedAt, msg.CreatedAt)
+	}
+	_, err := stmt.ExecContext(ctx)
+	return err
+}
+
+// Publisher 消息发布接口，消息至少投递一次，同一消息ID可能重复发布，消费端需要按消息ID去重
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+/** RedisPublisher 通过 Redis pub/sub 发布消息，频道为消息的 Topic
+* 1. 发布前检查消息ID的去重标记，已标记的消息不再发布
+* 2. 发布成功后才写入去重标记，发布失败或写入标记前崩溃时消息会被重试，不会丢失
+* 3. 写入标记前崩溃会导致重复发布，消费端按消息ID去重
+**/
+type RedisPublisher struct {
+	Client   *redis.Client
+	DedupTTL time.Duration
+}
+
+func NewRedisPublisher(client *redis.Client) *RedisPublisher {
+	return &RedisPublisher{Client: client, DedupTTL: 24 * time.Hour}
+}
+
+func (p *RedisPublisher) Publish(ctx context.Context, msg Message) error {
+	key := "fsm:outbox:" + msg.ID
+	n, err := p.Client.Exists(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		// 已经发布过
+		return nil
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := p.Client.Publish(ctx, msg.Topic, data).Err(); err != nil {
+		return err
+	}
+	// 消息已发布，标记失败只会使重试时重复发布，不返回错误
+	if err := p.Client.Set(ctx, key, 1, p.DedupTTL).Err(); err != nil {
+		log.Printf("发件箱消息去重标记写入失败，消息：%s，错误：%v\n", msg.ID, err)
+	}
+	return nil
+}
+
+/** Relay 发件箱中继，轮询未发布的消息并发布，失败时按指数退避重试
+* 1. 发布前领取消息：把 next_attempt_at 推迟一个租期，只有仍然到期的消息才能领取成功，
+*    多个中继同时运行时同一条消息在租期内只会被一个中继发布
+* 2. 发布超过租期仍未完成时消息可以被其他中继重新领取，租期应大于单条消息的发布耗时
+**/
+type Relay struct {
+	Session     *dbr.Session
+	Table       string
+	Publisher   Publisher
+	BatchSize   uint64        // 每次读取的消息数
+	Interval    time.Duration // 轮询间隔
+	MaxAttempts int           // 最大发布次数，超过后不再重试
+	Backoff     time.Duration // 首次重试间隔，之后每次翻倍
+	Lease       time.Duration // 领取消息的租期
+}
+
+func NewRelay(session *dbr.Session, publisher Publisher) *Relay {
+	return &Relay{
+		Session:     session,
+		Table:       "fsm_outbox",
+		Publisher:   publisher,
+		BatchSize:   100,
+		Interval:    time.Second,
+		MaxAttempts: 10,
+		Backoff:     time.Second,
+		Lease:       30 * time.Second,
+	}
+}
+
+type outboxRow struct {
+	ID        int64     `db:"id"`
+	MessageID string    `db:"message_id"`
+	Machine   string    `db:"machine"`
+	EntityID  string    `db:"entity_id"`
+	Topic     string    `db:"topic"`
+	Payload   string    `db:"payload"`
+	Attempts  int       `db:"attempts"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// RunOnce 发布一批到期的消息，返回成功发布的数量
+func (r *Relay) RunOnce(ctx context.Context) (int, error) {
+	var rows []outboxRow
+	_, err := r.Session.Select("id", "message_id", "machine", "entity_id", "topic", "payload", "attempts", "created_at").
+		From(r.Table).
+		Where("published_at IS NULL AND attempts < ? AND next_attempt_at <= ?", r.MaxAttempts, time.Now()).
+		OrderBy("id").
+		Limit(r.BatchSize).
+		LoadContext(ctx, &rows)
+	if err != nil {
+		return 0, err
+	}
+	published := 0
+	for _, row := range rows {
+		claimed, err := r.claim(ctx, row.ID)
+		if err != nil {
+			return published, err
+		}
+		if !claimed {
+			// 已被其他中继领取
+			continue
+		}
+		msg := Message{
+			ID:        row.MessageID,
+			Machine:   row.Machine,
+			EntityID:  row.EntityID,
+			Topic:     row.Topic,
+			Payload:   json.RawMessage(row.Payload),
+			CreatedAt: row.CreatedAt,
+		}
+		if err := r.Publisher.Publish(ctx, msg); err != nil {
+			log.Printf("发件箱消息发布失败，消息：%s，次数：%d，错误：%v\n", msg.ID, row.Attempts+1, err)
+			backoff := r.Backoff << uint(min(row.Attempts, maxBackoffShift))
+			_, err = r.Session.Update(r.Table).
+				Set("attempts", row.Attempts+1).
+				Set("next_attempt_at", time.Now().Add(backoff)).
+				Where("id = ?", row.ID).
+				ExecContext(ctx)
+			if err != nil {
+				return published, err
+			}
+			continue
+		}
+		_, err = r.Session.Update(r.Table).
+			Set("attempts", row.Attempts+1).
+			Set("published_at", time.Now()).
+			Where("id = ?", row.ID).
+			ExecContext(ctx)
+		if err != nil {
+			return published, err
+		}
+		published++
+	}
+	return published, nil
+}
+
+// claim 领取到期未发布的消息，领取成功后租期内不会被其他中继读取
+func (r *Relay) claim(ctx context.Context, id int64) (bool, error) {
+	now := time.Now()
+	result, err := r.Session.Update(r.Table).
+		Set("next_attempt_at", now.Add(r.Lease)).
+		Where("id = ? AND published_at IS NULL AND next_attempt_at <= ?", id, now).
+		ExecContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// Run 持续轮询发件箱，直到上下文取消
+func (r *Relay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.RunOnce(ctx); err != nil {
+			log.Printf("发件箱中继执行失败：%v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package fsm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+/** outboxMachine 使用替身数据库的主订单状态机，实例 1001 已创建
+* 1. 支付动作发送 order.paid 消息
+* 2. 取消动作发送 order.canceled 消息后失败
+**/
+func outboxMachine(t *testing.T) (*StateMachine, *dbr.Session, *fakeDB) {
+	t.Helper()
+	session, db := newFakeSession(t)
+	m := mainBuilder().
+		Options(Options{Processor: testProcessor{}, Store: NewSQLStore(session), Quiet: true}).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).
+		DoContext(func(ctx context.Context, from State, event Event, to State) error {
+			return Emit(ctx, "order.paid", map[string]int{"amount": 100})
+		}).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).
+		DoContext(func(ctx context.Context, from State, event Event, to State) error {
+			if err := Emit(ctx, "order.canceled", nil); err != nil {
+				return err
+			}
+			return errors.New("库存服务不可用")
+		}).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+		MustBuild()
+	if _, err := m.Start(context.Background(), "1001"); err != nil {
+		t.Fatal(err)
+	}
+	return m, session, db
+}
+
+// outboxRows 发件箱表中的行
+func outboxRows(db *fakeDB) []map[string]string {
+	db.locker.Lock()
+	defer db.locker.Unlock()
+	return db.tables["fsm_outbox"]
+}
+
+func TestOutboxEmitRequiresOutbox(t *testing.T) {
+	ctx := context.Background()
+	if err := Emit(ctx, "logistics.ship", nil); err == nil || !strings.Contains(err.Error(), "未开启发件箱") {
+		t.Fatalf("没有发件箱时 Emit 应失败：%v", err)
+	}
+}
+
+func TestOutboxCommit(t *testing.T) {
+	ctx := context.Background()
+	m, session, db := outboxMachine(t)
+	if to, err := NewOutbox(session).Fire(ctx, m, "1001", EventPay); err != nil || to != StateWaitConfirm {
+		t.Fatalf("流转失败：%d %v", to, err)
+	}
+	rows := outboxRows(db)
+	if len(rows) != 1 || rows[0]["topic"] != "'order.paid'" || rows[0]["entity_id"] != "'1001'" {
+		t.Fatalf("消息未写入发件箱：%+v", rows)
+	}
+	if inst, _ := m.Options().Store.Load(ctx, MainMachineName, "1001"); inst.State != StateWaitConfirm {
+		t.Fatalf("状态未保存：%+v", inst)
+	}
+}
+
+func TestOutboxRollback(t *testing.T) {
+	ctx := context.Background()
+	m, session, db := outboxMachine(t)
+	if _, err := NewOutbox(session).Fire(ctx, m, "1001", EventCancel); err == nil {
+		t.Fatal("动作失败时应返回错误")
+	}
+	if rows := outboxRows(db); len(rows) != 0 {
+		t.Fatalf("回滚后不应写入消息：%+v", rows)
+	}
+	if inst, _ := m.Options().Store.Load(ctx, MainMachineName, "1001"); inst.State != StateWaitPay {
+		t.Fatalf("回滚后状态不应改变：%+v", inst)
+	}
+}
+
+// outboxRelay 发件箱中已有一条支付消息的中继，重试间隔为 0
+func outboxRelay(t *testing.T) (*Relay, *fakePublisher, *fakeDB) {
+	t.Helper()
+	m, session, db := outboxMachine(t)
+	if _, err := NewOutbox(session).Fire(context.Background(), m, "1001", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	publisher := &fakePublisher{}
+	relay := NewRelay(session, publisher)
+	relay.Backoff = 0
+	return relay, publisher, db
+}
+
+func TestRelayPublish(t *testing.T) {
+	ctx := context.Background()
+	relay, publisher, db := outboxRelay(t)
+	if n, err := relay.RunOnce(ctx); err != nil || n != 1 {
+		t.Fatalf("发布数量错误：%d %v", n, err)
+	}
+	var payload map[string]int
+	if len(publisher.messages) != 1 || publisher.messages[0].Topic != "order.paid" ||
+		json.Unmarshal(publisher.messages[0].Payload, &payload) != nil || payload["amount"] != 100 {
+		t.Fatalf("发布的消息错误：%+v", publisher.messages)
+	}
+	if rows := outboxRows(db); rows[0]["published_at"] == "" || rows[0]["attempts"] != "1" {
+		t.Fatalf("消息应标记为已发布：%+v", rows)
+	}
+	if n, _ := relay.RunOnce(ctx); n != 0 || len(publisher.messages) != 1 {
+		t.Fatal("已发布的消息不应再次发布")
+	}
+}
+
+func TestRelayRetry(t *testing.T) {
+	ctx := context.Background()
+	relay, publisher, db := outboxRelay(t)
+	publisher.err = errors.New("broker down")
+	if n, err := relay.RunOnce(ctx); err != nil || n != 0 {
+		t.Fatalf("发布失败时数量错误：%d %v", n, err)
+	}
+	if rows := outboxRows(db); rows[0]["published_at"] != "" || rows[0]["attempts"] != "1" {
+		t.Fatalf("发布失败应记录次数：%+v", rows)
+	}
+	publisher.err = nil
+	if n, _ := relay.RunOnce(ctx); n != 1 || len(publisher.messages) != 1 {
+		t.Fatalf("到期后应重试：%d", n)
+	}
+}
+
+func TestRelayMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	relay, publisher, _ := outboxRelay(t)
+	relay.MaxAttempts = 1
+	publisher.err = errors.New("broker down")
+	relay.RunOnce(ctx)
+	publisher.err = nil
+	if n, _ := relay.RunOnce(ctx); n != 0 || len(publisher.messages) != 0 {
+		t.Fatal("超过最大次数后不应重试")
+	}
+}
+
+func TestRelayClaim(t *testing.T) {
+	ctx := context.Background()
+	relay, publisher, _ := outboxRelay(t)
+	// 另一个中继已领取消息，租期内不会重复发布
+	other := NewRelay(relay.Session, &fakePublisher{})
+	if claimed, err := other.claim(ctx, 1); err != nil || !claimed {
+		t.Fatalf("领取失败：%v %v", claimed, err)
+	}
+	if claimed, _ := relay.claim(ctx, 1); claimed {
+		t.Fatal("已领取的消息不能再次领取")
+	}
+	if n, _ := relay.RunOnce(ctx); n != 0 || len(publisher.messages) != 0 {
+		t.Fatal("租期内其他中继不应发布")
+	}
+}
+
+func TestRelayLeaseExpired(t *testing.T) {
+	ctx := context.Background()
+	relay, publisher, _ := outboxRelay(t)
+	// 领取后崩溃的中继，租期已经结束
+	crashed := NewRelay(relay.Session, &fakePublisher{})
+	crashed.Lease = -time.Second
+	if claimed, err := crashed.claim(ctx, 1); err != nil || !claimed {
+		t.Fatalf("领取失败：%v %v", claimed, err)
+	}
+	if n, _ := relay.RunOnce(ctx); n != 1 || len(publisher.messages) != 1 {
+		t.Fatal("租期结束后应由其他中继发布")
+	}
+}
+
+func TestRedisPublisherDedup(t *testing.T) {
+	ctx := context.Background()
+	msg := Message{ID: "m1", Topic: "order.paid", Payload: json.RawMessage(`{}`)}
+	r, client := newFakeRedis(t)
+	publisher := NewRedisPublisher(client)
+	for i := 0; i < 2; i++ {
+		if err := publisher.Publish(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if published := r.Published(); len(published) != 1 || !strings.HasPrefix(published[0], "order.paid:") {
+		t.Fatalf("同一消息只应发布一次：%v", published)
+	}
+}
+
+func TestRedisPublisherFailureKeepsMessage(t *testing.T) {
+	ctx := context.Background()
+	msg := Message{ID: "m1", Topic: "order.paid", Payload: json.RawMessage(`{}`)}
+	r, client := newFakeRedis(t)
+	publisher := NewRedisPublisher(client)
+	r.locker.Lock()
+	r.failPublish = "broker down"
+	r.locker.Unlock()
+	if err := publisher.Publish(ctx, msg); err == nil {
+		t.Fatal("发布失败时应返回错误")
+	}
+	if n, _ := client.Exists(ctx, "fsm:outbox:m1").Result(); n != 0 {
+		t.Fatal("发布失败时不应写入去重标记")
+	}
+	r.locker.Lock()
+	r.failPublish = ""
+	r.locker.Unlock()
+	if err := publisher.Publish(ctx, msg); err != nil || len(r.Published()) != 1 {
+		t.Fatalf("重试时应发布：%v %v", err, r.Published())
+	}
+}
@@ -0,0 +1,107 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrCascade 后续事件执行失败，此时触发的事件已经完成，返回的状态是实际到达的状态，使用 errors.Is 判断
+var ErrCascade = errors.New("后续事件执行失败")
+
+/** 后续事件（run-to-completion）
+* 1. 动作中不能直接调用 Run 触发同一状态机的事件，否则会因为锁而死锁
+* 2. 上下文动作通过 Raise 把后续事件放入本次执行的队列，动作成功后由当前流转返回，释放锁之后再依次执行
+* 3. 后续事件产生的事件继续执行，深度加一，超过 MaxCascadeDepth 时中止，用于发现死循环
+* 4. 后续事件失败时不再执行剩余的事件，返回已经到达的状态与 ErrCascade；重新投递的延迟事件失败时除外，见 redeliveryFailed
+* 5. 重新投递的延迟事件及其产生的后续事件，以延迟时的操作人身份执行
+* 6. 只有上下文动作执行时才创建队列，没有后续事件的流转不分配内存
+**/
+type eventQueue struct {
+	locker sync.Mutex
+	events []Event
+}
+
+// queuedEvent 等待执行的后续事件，depth 为级联深度，触发的事件为 0
+type queuedEvent struct {
+	event    Event
+	depth    int
+	actor    *Actor         // 执行时的操作人，为空时使用上下文中的操作人
+	deferred *DeferredEvent // 重新投递的延迟事件，失败时不中止流转
+}
+
+func (q *eventQueue) push(event Event) {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	q.events = append(q.events, event)
+}
+
+// take 取出全部事件
+func (q *eventQueue) take() []Event {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	events := q.events
+	q.events = nil
+	return events
+}
+
+// Raise 在上下文动作中产生同一状态机的后续事件，当前流转完成后执行
+func Raise(ctx context.Context, event Event) error {
+	queue, ok := ctx.Value(queueKey).(*eventQueue)
+	if !ok {
+		return fmt.Errorf("不在状态流转中，无法产生后续事件：%s", event)
+	}
+	queue.push(event)
+	return nil
+}
+
+func (s *StateMachine) maxCascadeDepth() int {
+	if s.options.MaxCascadeDepth > 0 {
+		return s.options.MaxCascadeDepth
+	}
+	return 10
+}
+
+// drain 依次执行后续事件，任一事件失败时中止，返回已经到达的状态与 ErrCascade
+func (s *StateMachine) drain(ctx context.Context, state State, queue []queuedEvent) (State, error) {
+	for i := range queue {
+		queue[i].depth = 1
+	}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if next.depth > s.maxCascadeDepth() {
+			return state, s.depthError(next.event)
+		}
+		runCtx := ctx
+		if next.actor != nil {
+			runCtx = WithActor(ctx, *next.actor)
+		}
+		to, followUps, err := s.transit(runCtx, state, next.event)
+		if err != nil && next.deferred != nil {
+			s.redeliveryFailed(runCtx, state, next, err)
+			continue
+		}
+		if err != nil {
+			return state, cascadeError(next.event, err)
+		}
+		state = to
+		for _, f := range followUps {
+			f.depth = next.depth + 1
+			if f.actor == nil {
+				f.actor = next.actor
+			}
+			queue = append(queue, f)
+		}
+	}
+	return state, nil
+}
+
+func (s *StateMachine) depthError(event Event) error {
+	return fmt.Errorf("%w：级联超过最大深度 %d：%s", ErrCascade, s.maxCascadeDepth(), event)
+}
+
+func cascadeError(event Event, err error) error {
+	return fmt.Errorf("%w：%s：%w", ErrCascade, event, err)
+}
@@ -0,0 +1,74 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// raiseMachine 支付动作产生 raised 中的后续事件，待确认时提醒再产生提醒，实例 1001 已创建
+func raiseMachine(t *testing.T, options Options, raised ...Event) *StateMachine {
+	t.Helper()
+	raise := func(ctx context.Context, from State, event Event, to State) error {
+		for _, e := range raised {
+			if err := Raise(ctx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	options.Processor, options.Quiet = testProcessor{}, true
+	if options.Store == nil {
+		options.Store = NewMemoryStore()
+	}
+	m := mainBuilder().
+		Options(options).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).DoContext(raise).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+		From(StateWaitConfirm).On("remind").To(StateWaitConfirm).
+		DoContext(func(ctx context.Context, from State, event Event, to State) error {
+			return Raise(ctx, "remind")
+		}).
+		MustBuild()
+	if _, err := m.Start(context.Background(), "1001"); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestEventQueueRaiseOutsideRun(t *testing.T) {
+	ctx := context.Background()
+	if err := Raise(ctx, EventPay); err == nil {
+		t.Fatal("不在流转中时 Raise 应返回错误")
+	}
+}
+
+func TestEventQueueRunToCompletion(t *testing.T) {
+	m := raiseMachine(t, Options{}, EventPayConfirm)
+	if to, err := m.Run(StateWaitPay, EventPay); err != nil || to != StatePayied {
+		t.Fatalf("后续事件应在当前流转完成后执行：%d %v", to, err)
+	}
+}
+
+func TestEventQueueMaxDepth(t *testing.T) {
+	m := raiseMachine(t, Options{MaxCascadeDepth: 3}, "remind")
+	to, err := m.Run(StateWaitPay, EventPay)
+	if !errors.Is(err, ErrCascade) || to != StateWaitConfirm {
+		t.Fatalf("级联超过最大深度时应返回已到达的状态与 ErrCascade：%d %v", to, err)
+	}
+}
+
+func TestEventQueueCascadeError(t *testing.T) {
+	ctx := context.Background()
+	// 待确认状态不能取消，支付已经完成
+	store := NewMemoryStore()
+	m := raiseMachine(t, Options{Store: store}, EventCancel)
+	to, err := m.Fire(ctx, "1001", EventPay)
+	if !errors.Is(err, ErrCascade) || !errors.Is(err, ErrUnhandledEvent) || to != StateWaitConfirm {
+		t.Fatalf("后续事件失败时应返回已到达的状态与 ErrCascade：%d %v", to, err)
+	}
+	if inst, _ := store.Load(ctx, MainMachineName, "1001"); inst.State != StateWaitConfirm {
+		t.Fatalf("Fire 应保存已到达的状态：%+v", inst)
+	}
+}
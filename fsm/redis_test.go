@@ -0,0 +1,204 @@
+package fsm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/** 本地 Redis 替身
+* 1. 使用 RESP2 协议，HELLO 返回错误使客户端回退到 RESP2
+* 2. 支持 GET / SET（NX）/ EXISTS / DEL / PUBLISH / SUBSCRIBE / PSUBSCRIBE / PING，过期时间被忽略
+* 3. failPublish 不为空时 PUBLISH 返回该错误
+**/
+type fakeRedis struct {
+	locker      sync.Mutex
+	values      map[string]string
+	subs        map[*fakeRedisConn][]string
+	published   []string
+	failPublish string
+}
+
+type fakeRedisConn struct {
+	locker     sync.Mutex
+	w          *bufio.Writer
+	patterns   bool
+	subscribed bool
+}
+
+// newFakeRedis 启动 Redis 替身并返回连接它的客户端，测试结束时关闭
+func newFakeRedis(t *testing.T) (*fakeRedis, *redis.Client) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{values: make(map[string]string), subs: make(map[*fakeRedisConn][]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	client := redis.NewClient(&redis.Options{Addr: listener.Addr().String(), Protocol: 2, DisableIndentity: true})
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = listener.Close()
+	})
+	return r, client
+}
+
+// Published 已发布的消息，格式为 频道:内容
+func (r *fakeRedis) Published() []string {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	return append([]string(nil), r.published...)
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &fakeRedisConn{w: bufio.NewWriter(conn)}
+	defer func() {
+		r.locker.Lock()
+		delete(r.subs, c)
+		r.locker.Unlock()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		r.exec(c, args)
+	}
+}
+
+// readCommand 读取一条 RESP 数组形式的命令
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (r *fakeRedis) exec(c *fakeRedisConn, args []string) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "HELLO":
+		c.write("-ERR unknown command 'HELLO'\r\n")
+	case "PING":
+		if c.subscribed {
+			c.write(array("pong", ""))
+		} else {
+			c.write("+PONG\r\n")
+		}
+	case "GET":
+		if v, ok := r.values[args[1]]; ok {
+			c.write(bulk(v))
+		} else {
+			c.write("$-1\r\n")
+		}
+	case "SET":
+		_, exists := r.values[args[1]]
+		for _, opt := range args[3:] {
+			if strings.ToUpper(opt) == "NX" && exists {
+				c.write("$-1\r\n")
+				return
+			}
+		}
+		r.values[args[1]] = args[2]
+		c.write("+OK\r\n")
+	case "EXISTS", "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := r.values[key]; ok {
+				n++
+				if strings.ToUpper(args[0]) == "DEL" {
+					delete(r.values, key)
+				}
+			}
+		}
+		c.write(fmt.Sprintf(":%d\r\n", n))
+	case "PUBLISH":
+		if r.failPublish != "" {
+			c.write("-ERR " + r.failPublish + "\r\n")
+			return
+		}
+		r.published = append(r.published, args[1]+":"+args[2])
+		n := 0
+		for sub, names := range r.subs {
+			for _, name := range names {
+				if sub.patterns {
+					if ok, _ := path.Match(name, args[1]); ok {
+						sub.write(array("pmessage", name, args[1], args[2]))
+						n++
+					}
+				} else if name == args[1] {
+					sub.write(array("message", args[1], args[2]))
+					n++
+				}
+			}
+		}
+		c.write(fmt.Sprintf(":%d\r\n", n))
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		kind := strings.ToLower(args[0])
+		c.subscribed, c.patterns = true, kind == "psubscribe"
+		for _, name := range args[1:] {
+			r.subs[c] = append(r.subs[c], name)
+			c.write(fmt.Sprintf("*3\r\n%s%s:%d\r\n", bulk(kind), bulk(name), len(r.subs[c])))
+		}
+	default:
+		c.write("+OK\r\n")
+	}
+}
+
+func (c *fakeRedisConn) write(reply string) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	_, _ = c.w.WriteString(reply)
+	_ = c.w.Flush()
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func array(items ...string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(items))
+	for _, item := range items {
+		reply += bulk(item)
+	}
+	return reply
+}
@@ -0,0 +1,74 @@
+package fsm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// 内置状态机名称
+const (
+	MainMachineName      = "主订单状态机"
+	SubMachineName       = "子订单状态机"
+	AfterSaleMachineName = "售后状态机"
+)
+
+// 状态机注册表，注册后的状态机定义不可再修改
+var registry = struct {
+	locker   sync.RWMutex
+	machines map[string]*StateMachine
+}{
+	machines: make(map[string]*StateMachine),
+}
+
+func init() {
+	MustRegister(MainStateMachine)
+	MustRegister(SubStateMachine)
+	MustRegister(AfterSaleStateMachine)
+}
+
+// Register 按状态机名称注册，注册时冻结状态机定义，名称重复时返回错误
+func Register(m *StateMachine) error {
+	if m == nil || m.Graph == nil {
+		return fmt.Errorf("状态机不能为空")
+	}
+	name := m.Name()
+	if name == "" {
+		return fmt.Errorf("状态机名称不能为空")
+	}
+	registry.locker.Lock()
+	defer registry.locker.Unlock()
+	if _, ok := registry.machines[name]; ok {
+		return fmt.Errorf("状态机已注册：%s", name)
+	}
+	m.Graph.freeze()
+	registry.machines[name] = m
+	return nil
+}
+
+// MustRegister 注册失败时 panic，用于包初始化
+func MustRegister(m *StateMachine) {
+	if err := Register(m); err != nil {
+		panic(err)
+	}
+}
+
+// Get 按名称获取已注册的状态机
+func Get(name string) (*StateMachine, bool) {
+	registry.locker.RLock()
+	defer registry.locker.RUnlock()
+	m, ok := registry.machines[name]
+	return m, ok
+}
+
+// List 已注册的状态机名称，按名称排序
+func List() []string {
+	registry.locker.RLock()
+	defer registry.locker.RUnlock()
+	names := make([]string, 0, len(registry.machines))
+	for name := range registry.machines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
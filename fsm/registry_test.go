@@ -0,0 +1,77 @@
+package fsm
+
+import (
+	"context"
+	"testing"
+)
+
+// mustPanic fn 应 panic
+func mustPanic(t *testing.T, name string, fn func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("%s 应 panic", name)
+		}
+	}()
+	fn()
+}
+
+// unregister 测试结束后从全局注册表中移除状态机，重复运行测试时可以再次注册
+func unregister(t *testing.T, name string) {
+	t.Cleanup(func() {
+		registry.locker.Lock()
+		defer registry.locker.Unlock()
+		delete(registry.machines, name)
+	})
+}
+
+func TestRegistryBuiltin(t *testing.T) {
+	for _, name := range []string{MainMachineName, SubMachineName, AfterSaleMachineName} {
+		if m, ok := Get(name); !ok || m.Name() != name {
+			t.Fatalf("内置状态机未注册：%s", name)
+		}
+	}
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	m := NewStateMachine().SetName("注册测试").SetStates(mainStates)
+	unregister(t, "注册测试")
+	if err := Register(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register(NewStateMachine().SetName("注册测试")); err == nil {
+		t.Fatal("名称重复时应返回错误")
+	}
+	if err := Register(NewStateMachine()); err == nil {
+		t.Fatal("名称为空时应返回错误")
+	}
+	if got, _ := Get("注册测试"); got != m {
+		t.Fatal("重复注册不应覆盖已注册的状态机")
+	}
+}
+
+func TestRegistryFrozen(t *testing.T) {
+	for name, fn := range map[string]func(){
+		"SetStates":      func() { MainStateMachine.SetStates(mainStates) },
+		"SetTransitions": func() { MainStateMachine.SetTransitions(transitions) },
+		"SetOptions":     func() { MainStateMachine.SetOptions(Options{Quiet: true}) },
+		"SetLabels":      func() { MainStateMachine.SetLabels(LocaleEnUS, mainLabels[LocaleEnUS]) },
+	} {
+		mustPanic(t, name, fn)
+	}
+}
+
+func TestRegistryWithOptions(t *testing.T) {
+	store := NewMemoryStore()
+	m := MainStateMachine.WithOptions(Options{Store: store, Quiet: true})
+	if m.Graph != MainStateMachine.Graph || MainStateMachine.Options().Store != nil {
+		t.Fatal("新状态机应共享图表且不影响原状态机")
+	}
+	if _, err := m.Start(context.Background(), "1001"); err != nil {
+		t.Fatal(err)
+	}
+	if inst, err := store.Load(context.Background(), MainMachineName, "1001"); err != nil || inst.State != StateWaitPay {
+		t.Fatalf("新状态机应使用新配置：%+v %v", inst, err)
+	}
+	mustPanic(t, "WithOptions 后修改", func() { m.SetOptions(Options{}) })
+}
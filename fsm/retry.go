@@ -0,0 +1,129 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	// maxBackoffShift 重试间隔最多翻倍的次数，避免移位溢出
+	maxBackoffShift = 16
+	// defaultMaxBackoff 未设置 MaxBackoff 时的最大重试间隔
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// RetryableError 错误可以实现该接口，声明自己是否可以重试
+type RetryableError interface {
+	Retryable() bool
+}
+
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string   { return e.err.Error() }
+func (e transientError) Unwrap() error   { return e.err }
+func (e transientError) Retryable() bool { return true }
+
+// Transient 把错误标记为临时错误，配置了重试策略时会被重试
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return transientError{err: err}
+}
+
+/** 转变器动作的重试策略
+* 1. MaxAttempts 最多执行次数（包含首次），小于等于 1 时不重试
+* 2. 第 n 次重试前等待 Backoff * 2^(n-1)，翻倍最多 16 次，不超过 MaxBackoff（默认 30 秒），并按 Jitter 比例随机减少
+* 3. 错误实现了 RetryableError 时由错误自己决定；否则与 RetryOn 中任一错误 errors.Is 匹配时重试
+* 4. RerunExit 为 true 时每次重试都重新执行 ExitOldState，否则只在首次执行
+* 5. 等待重试期间继续持有实体的锁（没有实例时为状态机的锁），同一实体的其他流转会被阻塞，单次等待不超过 MaxBackoff
+*    每次尝试使用独立的后续事件队列与发件箱缓冲，失败的尝试中 Raise / Emit 的事件与消息被丢弃
+* 6. 事务模式下重试不会回滚失败尝试已经执行的写入（没有使用保存点），动作需要保证在同一事务中可以重复执行，
+*    或者在动作中自行使用 SAVEPOINT 回滚失败的部分
+* 每次失败的尝试都会记录到流转历史中；声明了重试策略的转变器，动作最终失败时流转失败，非事务模式下同样如此
+**/
+type RetryPolicy struct {
+	MaxAttempts int           `desc:"最多执行次数"`
+	Backoff     time.Duration `desc:"首次重试间隔"`
+	MaxBackoff  time.Duration `desc:"最大重试间隔，默认 30 秒"`
+	Jitter      float64       `desc:"随机抖动比例 0~1"`
+	RetryOn     []error       `desc:"可重试的错误"`
+	RerunExit   bool          `desc:"重试时是否重新执行 ExitOldState"`
+}
+
+// Retryable 判断错误是否可以重试
+func (p *RetryPolicy) Retryable(err error) bool {
+	var retryable RetryableError
+	if errors.As(err, &retryable) {
+		return retryable.Retryable()
+	}
+	for _, target := range p.RetryOn {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// allow 第 attempt 次执行失败后是否继续重试
+func (p *RetryPolicy) allow(err error, attempt int) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	return p.Retryable(err)
+}
+
+func (p *RetryPolicy) rerunExit() bool {
+	return p != nil && p.RerunExit
+}
+
+// backoff 第 attempt 次执行失败后不计抖动的等待时间
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	d := p.Backoff << uint(min(attempt-1, maxBackoffShift))
+	if d > maxBackoff || (p.Backoff > 0 && d <= 0) {
+		d = maxBackoff
+	}
+	return d
+}
+
+// maxWait 重试全部用尽时最长的等待时间
+func (p *RetryPolicy) maxWait() time.Duration {
+	var total time.Duration
+	for attempt := 1; p != nil && attempt < p.MaxAttempts; attempt++ {
+		total += p.backoff(attempt)
+	}
+	return total
+}
+
+// delay 第 attempt 次执行失败后的等待时间
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.backoff(attempt)
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// wait 等待重试，上下文取消时返回上下文错误
+func (p *RetryPolicy) wait(ctx context.Context, attempt int) error {
+	d := p.delay(attempt)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
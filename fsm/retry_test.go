@@ -0,0 +1,190 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errTimeout = errors.New("支付网关超时")
+
+// permanentError 声明不可重试的错误，即使包装了 RetryOn 中的错误
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string   { return e.err.Error() }
+func (e permanentError) Unwrap() error   { return e.err }
+func (e permanentError) Retryable() bool { return false }
+
+// exitCounter 记录 ExitOldState 执行次数的处理器
+type exitCounter struct {
+	exits int
+}
+
+func (p *exitCounter) ExitOldState(from, to State) error { p.exits++; return nil }
+
+func (p *exitCounter) EnterNewState(to State, event Event) error { return nil }
+
+/** retryMachine 支付动作按 errs 依次返回错误的主订单状态机，实例 1 已创建
+* 1. errs 用完后动作成功，calls 为动作执行次数
+* 2. 记录流转历史，处理器记录 ExitOldState 的执行次数
+**/
+func retryMachine(t *testing.T, policy RetryPolicy, errs ...error) (m *StateMachine, calls *int, processor *exitCounter, history *MemoryHistory) {
+	t.Helper()
+	calls, processor, history = new(int), &exitCounter{}, NewMemoryHistory()
+	m = mainBuilder().
+		Options(Options{Processor: processor, Store: NewMemoryStore(), History: history, Quiet: true}).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).Retry(policy).
+		Do(func(from State, event Event, to State) error {
+			*calls++
+			if *calls <= len(errs) {
+				return errs[*calls-1]
+			}
+			return nil
+		}).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+		MustBuild()
+	if _, err := m.Start(context.Background(), "1"); err != nil {
+		t.Fatal(err)
+	}
+	return m, calls, processor, history
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	ctx := context.Background()
+	m, calls, _, history := retryMachine(t, RetryPolicy{MaxAttempts: 3}, Transient(errTimeout), Transient(errTimeout))
+	if to, err := m.Fire(ctx, "1", EventPay); err != nil || to != StateWaitConfirm || *calls != 3 {
+		t.Fatalf("临时错误应重试直到成功：%d %v %d", to, err, *calls)
+	}
+	records := history.Records()
+	if len(records) != 3 {
+		t.Fatalf("每次尝试都应记录历史：%+v", records)
+	}
+	for i, r := range records {
+		failed := i < 2
+		if r.Attempt != i+1 || (r.Error != "") != failed || (r.To == StateWaitPay) != failed {
+			t.Fatalf("第 %d 次尝试的记录错误：%+v", i+1, r)
+		}
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	ctx := context.Background()
+	m, calls, _, _ := retryMachine(t, RetryPolicy{MaxAttempts: 2}, Transient(errTimeout), Transient(errTimeout))
+	if _, err := m.Fire(ctx, "1", EventPay); !errors.Is(err, errTimeout) || *calls != 2 {
+		t.Fatalf("超过最多执行次数后应返回错误：%v %d", err, *calls)
+	}
+}
+
+func TestRetryRetryable(t *testing.T) {
+	ctx := context.Background()
+	policy := RetryPolicy{MaxAttempts: 3, RetryOn: []error{errTimeout}}
+	for _, c := range []struct {
+		name  string
+		err   error
+		calls int
+	}{
+		{"not_retryable", errors.New("余额不足"), 1},
+		{"retry_on", errTimeout, 2},
+		{"retry_on_wrapped", errors.Join(errors.New("扣款失败"), errTimeout), 2},
+		{"retryable_error", Transient(errors.New("连接重置")), 2},
+		{"retryable_error_overrides", permanentError{errTimeout}, 1},
+	} {
+		m, calls, _, _ := retryMachine(t, policy, c.err)
+		m.Fire(ctx, "1", EventPay)
+		if *calls != c.calls {
+			t.Fatalf("%s：执行次数错误：%d", c.name, *calls)
+		}
+	}
+}
+
+func TestRetryRerunExit(t *testing.T) {
+	ctx := context.Background()
+	for _, rerun := range []bool{false, true} {
+		m, _, processor, _ := retryMachine(t, RetryPolicy{MaxAttempts: 3, RerunExit: rerun}, Transient(errTimeout), Transient(errTimeout))
+		if _, err := m.Fire(ctx, "1", EventPay); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]int{false: 1, true: 3}[rerun]; processor.exits != want {
+			t.Fatalf("RerunExit=%v 时 ExitOldState 执行次数错误：%d", rerun, processor.exits)
+		}
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx := context.Background()
+	m, calls, _, _ := retryMachine(t, RetryPolicy{MaxAttempts: 3, Backoff: time.Hour}, Transient(errTimeout))
+	canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.Fire(canceled, "1", EventPay); !errors.Is(err, context.DeadlineExceeded) || *calls != 1 {
+		t.Fatalf("等待重试时上下文取消应返回上下文错误：%v %d", err, *calls)
+	}
+}
+
+func TestRetryAttemptBuffers(t *testing.T) {
+	ctx := context.Background()
+	// 每次支付都发送消息并产生支付确认，首次失败的尝试产生的事件与消息应被丢弃
+	session, db := newFakeSession(t)
+	calls := 0
+	m := mainBuilder().
+		Options(Options{Processor: testProcessor{}, Store: NewSQLStore(session), Quiet: true}).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).Retry(RetryPolicy{MaxAttempts: 2}).
+		DoContext(func(ctx context.Context, from State, event Event, to State) error {
+			calls++
+			if err := Emit(ctx, "order.paid", calls); err != nil {
+				return err
+			}
+			if err := Raise(ctx, EventPayConfirm); err != nil {
+				return err
+			}
+			if calls == 1 {
+				return Transient(errTimeout)
+			}
+			return nil
+		}).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Do(nop).
+		MustBuild()
+	if _, err := m.Start(ctx, "1001"); err != nil {
+		t.Fatal(err)
+	}
+	if to, err := NewOutbox(session).Fire(ctx, m, "1001", EventPay); err != nil || to != StatePayied {
+		t.Fatalf("支付确认只应执行一次：%d %v", to, err)
+	}
+	if rows := outboxRows(db); len(rows) != 1 || rows[0]["payload"] != "'2'" {
+		t.Fatalf("只应写入成功的尝试发送的消息：%+v", rows)
+	}
+}
+
+func TestRetryDelayBackoff(t *testing.T) {
+	for _, c := range []struct {
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{RetryPolicy{Backoff: time.Millisecond}, 1, time.Millisecond},
+		{RetryPolicy{Backoff: time.Millisecond}, 3, 4 * time.Millisecond},
+		{RetryPolicy{Backoff: time.Millisecond, MaxBackoff: 3 * time.Millisecond}, 3, 3 * time.Millisecond},
+		// 翻倍次数有上限，很大的次数不会溢出
+		{RetryPolicy{Backoff: time.Microsecond}, 100, time.Microsecond << maxBackoffShift},
+		{RetryPolicy{Backoff: time.Millisecond, MaxBackoff: time.Second}, 100, time.Second},
+		// 未设置最大间隔时使用默认值
+		{RetryPolicy{Backoff: time.Second}, 10, defaultMaxBackoff},
+	} {
+		if got := c.policy.delay(c.attempt); got != c.want {
+			t.Fatalf("%+v 第 %d 次的间隔错误：%v", c.policy, c.attempt, got)
+		}
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	policy := RetryPolicy{Backoff: 100 * time.Millisecond, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if got := policy.delay(1); got < 50*time.Millisecond || got > 100*time.Millisecond {
+			t.Fatalf("抖动后的间隔超出范围：%v", got)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package fsm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// SchemaVersion 导出文档的格式版本，格式有不兼容的变更时加一
+const SchemaVersion = 1
+
+// SetPayloadSchemas 设置事件参数的 JSON Schema，导出给前端校验表单
+func (s *StateMachine) SetPayloadSchemas(schemas map[Event]json.RawMessage) *StateMachine {
+	s.Graph.mustNotFrozen()
+	s.Graph.payloads = schemas
+	return s
+}
+
+// PayloadSchema 事件参数的 JSON Schema，没有参数时为空
+func (g *StateGraph) PayloadSchema(event Event) json.RawMessage {
+	return g.payloads[event]
+}
+
+// StateSchema 导出的状态
+type StateSchema struct {
+	ID        State             `json:"id"`
+	Name      string            `json:"name"`
+	Labels    map[Locale]string `json:"labels"`
+	Terminal  bool              `json:"terminal"`
+	Composite bool              `json:"composite,omitempty"`
+	Initial   *State            `json:"initial,omitempty" desc:"复合状态的初始子状态"`
+	Parent    *State            `json:"parent,omitempty" desc:"所属的复合状态"`
+}
+
+// EventSchema 导出的事件
+type EventSchema struct {
+	Name        Event             `json:"name"`
+	Labels      map[Locale]string `json:"labels"`
+	Permissions []string          `json:"permissions,omitempty"`
+	Payload     json.RawMessage   `json:"payload,omitempty" desc:"参数的 JSON Schema"`
+}
+
+// TransitionSchema 导出的转变器，Targets 为实际可能进入的具体状态
+type TransitionSchema struct {
+	From        State    `json:"from"`
+	Event       Event    `json:"event"`
+	To          State    `json:"to"`
+	Targets     []State  `json:"targets"`
+	History     string   `json:"history,omitempty" desc:"历史伪状态：shallow 或 deep"`
+	Permissions []string `json:"permissions,omitempty"`
+	Guarded     bool     `json:"guarded,omitempty" desc:"有守卫，运行时才能确定是否允许"`
+}
+
+/** 状态机导出文档
+* 1. 供前端判断各状态下可以执行的操作，所有列表按状态值、事件名排序，相同定义导出的内容完全一致
+* 2. SchemaVersion 为文档格式版本；Version 为内容摘要，定义变化时改变，客户端可以据此缓存
+* 3. 名称包含状态机设置的所有语言，没有设置语言时使用 DefaultLocale
+**/
+type MachineSchema struct {
+	SchemaVersion int                `json:"schema_version"`
+	Machine       string             `json:"machine"`
+	Version       string             `json:"version"`
+	Locales       []Locale           `json:"locales"`
+	Start         State              `json:"start"`
+	States        []StateSchema      `json:"states"`
+	Events        []EventSchema      `json:"events"`
+	Transitions   []TransitionSchema `json:"transitions"`
+}
+
+// schemaLocales 导出的语言
+func (g *StateGraph) schemaLocales() []Locale {
+	if locales := g.Locales(); len(locales) > 0 {
+		return locales
+	}
+	return []Locale{DefaultLocale}
+}
+
+// Schema 导出状态机文档
+func (s *StateMachine) Schema() (MachineSchema, error) {
+	g := s.Graph
+	schema := MachineSchema{
+		SchemaVersion: SchemaVersion,
+		Machine:       s.Name(),
+		Locales:       g.schemaLocales(),
+		Start:         g.start,
+		States:        []StateSchema{},
+		Events:        []EventSchema{},
+		Transitions:   []TransitionSchema{},
+	}
+	states := make([]State, 0, len(g.states))
+	for state := range g.states {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+	for _, state := range states {
+		st := StateSchema{
+			ID:       state,
+			Name:     g.states[state],
+			Labels:   make(map[Locale]string, len(schema.Locales)),
+			Terminal: g.IsEnd(state),
+		}
+		for _, locale := range schema.Locales {
+			st.Labels[locale] = g.StateLabel(locale, state)
+		}
+		if composite, ok := g.composites[state]; ok {
+			initial := composite.Initial
+			st.Composite, st.Initial = true, &initial
+		}
+		if parent, ok := g.Parent(state); ok {
+			st.Parent = &parent
+		}
+		schema.States = append(schema.States, st)
+	}
+	for _, event := range g.events() {
+		ev := EventSchema{
+			Name:        event,
+			Labels:      make(map[Locale]string, len(schema.Locales)),
+			Permissions: g.permissions[event],
+			Payload:     g.payloads[event],
+		}
+		for _, locale := range schema.Locales {
+			ev.Labels[locale] = g.EventLabel(locale, event)
+		}
+		schema.Events = append(schema.Events, ev)
+	}
+	for _, from := range states {
+		events := make([]Event, 0, len(g.transitions[from]))
+		for event := range g.transitions[from] {
+			events = append(events, event)
+		}
+		sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+		for _, event := range events {
+			transition := g.transitions[from][event]
+			ts := TransitionSchema{
+				From:        from,
+				Event:       event,
+				To:          transition.To,
+				Targets:     g.targets(from, event),
+				Permissions: transition.Permissions,
+				Guarded:     transition.Guard != nil,
+			}
+			switch transition.History {
+			case ShallowHistory:
+				ts.History = "shallow"
+			case DeepHistory:
+				ts.History = "deep"
+			}
+			if ts.Targets == nil {
+				ts.Targets = []State{}
+			}
+			schema.Transitions = append(schema.Transitions, ts)
+		}
+	}
+	content, err := json.Marshal(schema)
+	if err != nil {
+		return MachineSchema{}, fmt.Errorf("状态机导出失败：%s：%w", s.Name(), err)
+	}
+	sum := sha256.Sum256(content)
+	schema.Version = hex.EncodeToString(sum[:8])
+	return schema, nil
+}
+
+// AllowedEvent 状态下允许的事件
+// To 为流转后实际进入的状态，目标为复合状态时是其初始子状态；历史伪状态可能进入多个状态时，To 为复合状态，Targets 列出可能的状态
+type AllowedEvent struct {
+	Event       Event           `json:"event"`
+	Label       string          `json:"label"`
+	To          State           `json:"to"`
+	ToLabel     string          `json:"to_label"`
+	Targets     []State         `json:"targets,omitempty"`
+	Permissions []string        `json:"permissions,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Guarded     bool            `json:"guarded,omitempty"`
+}
+
+// AllowedEvents 状态下允许的事件及指定语言下的名称，用于接口直接返回
+// 上下文中有操作人时只返回操作人有权触发的事件，没有操作人时只返回未声明权限的事件；守卫需要运行时判断，只标记 Guarded
+func (s *StateMachine) AllowedEvents(ctx context.Context, state State, locale Locale) []AllowedEvent {
+	_, hasActor := ActorFrom(ctx)
+	allowed := []AllowedEvent{}
+	for _, event := range s.Graph.AvailableEvents(state) {
+		transition, result := s.Graph.lookup(state, event)
+		if result != lookupOK {
+			continue
+		}
+		permissions := s.Graph.Permissions(state, event)
+		if len(permissions) > 0 && (!hasActor || s.authorize(ctx, transition) != nil) {
+			continue
+		}
+		e := AllowedEvent{
+			Event:       event,
+			Label:       s.Graph.EventLabel(locale, event),
+			To:          transition.To,
+			Permissions: permissions,
+			Payload:     s.Graph.payloads[event],
+			Guarded:     transition.Guard != nil,
+		}
+		if targets := s.Graph.targets(state, event); len(targets) == 1 {
+			e.To = targets[0]
+		} else {
+			e.Targets = targets
+		}
+		e.ToLabel = s.Graph.StateLabel(locale, e.To)
+		allowed = append(allowed, e)
+	}
+	return allowed
+}
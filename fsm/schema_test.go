@@ -0,0 +1,108 @@
+package fsm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	schema, err := SubStateMachine.Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := SubStateMachine.Schema()
+	first, _ := json.Marshal(schema)
+	second, _ := json.Marshal(again)
+	if !bytes.Equal(first, second) || schema.Version == "" || schema.SchemaVersion != SchemaVersion {
+		t.Fatalf("导出内容应稳定：%s", schema.Version)
+	}
+
+	states := map[State]StateSchema{}
+	for _, st := range schema.States {
+		states[st.ID] = st
+	}
+	if st := states[StateSubWaitShip]; st.Labels[LocaleEnUS] != "Awaiting shipment" || st.Labels[LocaleZhCN] != "待发货" || st.Terminal {
+		t.Fatalf("状态导出错误：%+v", st)
+	}
+	if !states[StateSubCompleted].Terminal || !states[StateSubAfterSale].Composite ||
+		*states[StateSubAfterSale].Initial != StateSubAfterSaleRefund || *states[StateSubAfterSaleRefund].Parent != StateSubAfterSale {
+		t.Fatalf("结束状态或复合状态导出错误：%+v", schema.States)
+	}
+	for _, ev := range schema.Events {
+		if ev.Name == EventSubShip && (len(ev.Payload) == 0 || ev.Labels[LocaleEnUS] != "Ship") {
+			t.Fatalf("事件导出错误：%+v", ev)
+		}
+		if ev.Name == EventSubPayConfirm && (len(ev.Permissions) != 1 || ev.Permissions[0] != RoleSystem) {
+			t.Fatalf("事件权限导出错误：%+v", ev)
+		}
+	}
+	for _, ts := range schema.Transitions {
+		if ts.Event == EventSubCancelAfterSale && (ts.History != "deep" || len(ts.Targets) == 0) {
+			t.Fatalf("历史伪状态导出错误：%+v", ts)
+		}
+	}
+
+	// 定义变化时版本改变
+	build := func(label string) *StateMachine {
+		labels := Labels{States: map[State]string{0: "待支付", 1: label}, Events: map[Event]string{EventPay: "支付"}}
+		return NewBuilder("导出").
+			States(map[State]string{0: "wait_pay", 1: "payied"}).
+			Start(0).
+			End(1).
+			Labels(LocaleZhCN, labels).
+			Payload(EventPay, json.RawMessage(`{"type":"object"}`)).
+			From(0).On(EventPay).To(1).Do(nop).
+			MustBuild()
+	}
+	a, _ := build("已支付").Schema()
+	b, _ := build("已付款").Schema()
+	if a.Version == b.Version {
+		t.Fatal("定义变化时版本应改变")
+	}
+	if _, err := NewBuilder("导出").States(map[State]string{0: "a"}).Start(0).Payload(EventPay, json.RawMessage(`{`)).Build(); err == nil {
+		t.Fatal("应检查 JSON Schema 格式")
+	}
+}
+
+func TestAllowedEvents(t *testing.T) {
+	ctx := context.Background()
+	if events := AfterSaleStateMachine.AllowedEvents(ctx, StateAfterSaleWaitReview, LocaleEnUS); len(events) != 0 {
+		t.Fatalf("没有操作人时不应返回声明了权限的事件：%+v", events)
+	}
+	ctx = WithActor(ctx, Actor{ID: "u1", Roles: []string{"customer"}})
+	if events := AfterSaleStateMachine.AllowedEvents(ctx, StateAfterSaleWaitReview, LocaleZhCN); len(events) != 0 {
+		t.Fatalf("无权的事件不应返回：%+v", events)
+	}
+	ctx = WithActor(ctx, Actor{ID: "u2", Roles: []string{RoleCSSupervisor}})
+	if events := AfterSaleStateMachine.AllowedEvents(ctx, StateAfterSaleWaitReview, LocaleZhCN); len(events) != 2 || events[0].Label != "通过" {
+		t.Fatalf("客服主管应可以审批：%+v", events)
+	}
+	events := AfterSaleStateMachine.AllowedEvents(ctx, StateAfterSaleWaitReview, LocaleEnUS)
+	for _, e := range events {
+		if e.Event == EventAfterSaleReject && (e.Label != "Reject" || e.ToLabel != "Rejected" || len(e.Payload) == 0) {
+			t.Fatalf("允许的事件名称错误：%+v", e)
+		}
+	}
+	if events := AfterSaleStateMachine.AllowedEvents(ctx, StateAfterSaleComplete, LocaleZhCN); events == nil || len(events) != 0 {
+		t.Fatalf("结束状态应返回空列表：%+v", events)
+	}
+
+	// 目标为复合状态时返回实际进入的初始子状态
+	const (
+		stateNew State = iota
+		stateFulfil
+		statePicking
+	)
+	m := NewBuilder("履约").
+		States(map[State]string{stateNew: "new", stateFulfil: "fulfil", statePicking: "picking"}).
+		Composite(stateFulfil, statePicking, statePicking).
+		Start(stateNew).
+		End(statePicking).
+		From(stateNew).On("start").To(stateFulfil).Do(nop).
+		MustBuild()
+	if events := m.AllowedEvents(context.Background(), stateNew, LocaleZhCN); len(events) != 1 || events[0].To != statePicking {
+		t.Fatalf("应返回实际进入的状态：%+v", events)
+	}
+}
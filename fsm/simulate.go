@@ -0,0 +1,213 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrGuardRejected 守卫拒绝流转，使用 errors.Is 判断
+var ErrGuardRejected = errors.New("守卫拒绝流转")
+
+// GuardError 守卫拒绝错误
+type GuardError struct {
+	Machine string
+	From    State
+	Event   Event
+	To      State
+}
+
+func (e *GuardError) Error() string {
+	return fmt.Sprintf("%s：状态机：%s，%d -(%s)-> %d", ErrGuardRejected, e.Machine, e.From, e.Event, e.To)
+}
+
+func (e *GuardError) Unwrap() error {
+	return ErrGuardRejected
+}
+
+// 试运行中守卫的结果
+const (
+	GuardNone     = "none"     // 没有守卫
+	GuardPassed   = "passed"   // 守卫通过
+	GuardRejected = "rejected" // 守卫拒绝
+	GuardSkipped  = "skipped"  // 权限等检查未通过，守卫未执行
+)
+
+// PlanStep 试运行的一步，Depth 为 0 时是触发的事件，大于 0 时是后续事件
+type PlanStep struct {
+	From        State    `json:"from"`
+	Event       Event    `json:"event"`
+	To          State    `json:"to"`
+	Depth       int      `json:"depth"`
+	Permissions []string `json:"permissions,omitempty"`
+	Guard       string   `json:"guard"`
+	Hooks       []string `json:"hooks,omitempty" desc:"将会执行的钩子，按执行顺序"`
+	Deferred    bool     `json:"deferred,omitempty" desc:"事件被延迟，状态不变"`
+	Ignored     bool     `json:"ignored,omitempty" desc:"事件未处理，按 Unhandled 策略忽略"`
+	FollowUps   []Event  `json:"follow_ups,omitempty" desc:"产生的后续事件"`
+	Redelivered bool     `json:"redelivered,omitempty" desc:"重新投递的延迟事件，失败时不影响流转"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// Plan 试运行结果，To 为所有后续事件执行完成后的状态
+type Plan struct {
+	Machine  string     `json:"machine"`
+	EntityID string     `json:"entity_id,omitempty"`
+	From     State      `json:"from"`
+	Event    Event      `json:"event"`
+	To       State      `json:"to"`
+	Steps    []PlanStep `json:"steps"`
+	Error    string     `json:"error,omitempty"`
+}
+
+/** 试运行
+* 1. 与 Run 相同地查找转变器、检查权限、计算新状态并执行守卫，守卫不能有副作用
+* 2. 不执行处理器、监听器与动作，只列出将会执行的钩子（异步监听器不列出）；不加锁，不保存实例，不写流转历史与死信
+* 3. 后续事件：转变器通过 Raises 声明的事件，以及实例中新状态可以处理的延迟事件，依次继续推演
+*    延迟事件与 Fire 一样检查事件声明的权限，重新投递时以延迟时的操作人身份推演，失败时不影响流转，没有死信处理器时重新延迟
+* 4. 动作中没有声明就通过 Raise 产生的事件无法预知
+* 5. 流转会失败时，返回的计划包含失败的步骤，同时返回与 Run 相同的错误
+**/
+func (s *StateMachine) Simulate(ctx context.Context, from State, event Event) (Plan, error) {
+	return s.simulate(ctx, nil, from, event)
+}
+
+// SimulateFire 使用状态存储中的实例试运行，实例的历史状态与延迟事件参与推演，实例本身不会被修改
+func (s *StateMachine) SimulateFire(ctx context.Context, id string, event Event) (Plan, error) {
+	inst, err := s.load(ctx, id)
+	if err != nil {
+		return Plan{}, err
+	}
+	inst = inst.clone()
+	return s.simulate(ctx, &inst, inst.State, event)
+}
+
+func (s *StateMachine) simulate(ctx context.Context, inst *Instance, from State, event Event) (Plan, error) {
+	plan := Plan{Machine: s.Name(), From: from, Event: event, To: from}
+	if inst != nil {
+		ctx = withInstance(ctx, inst)
+		plan.EntityID = inst.ID
+	}
+	queue := []queuedEvent{{event: event}}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if next.depth > s.maxCascadeDepth() {
+			err := s.depthError(next.event)
+			plan.Error = err.Error()
+			return plan, err
+		}
+		stepCtx := ctx
+		if next.actor != nil {
+			stepCtx = WithActor(ctx, *next.actor)
+		}
+		step, followUps, err := s.simulateStep(stepCtx, inst, plan.To, next.event)
+		step.Depth = next.depth
+		step.Redelivered = next.deferred != nil
+		plan.Steps = append(plan.Steps, step)
+		if err != nil && next.deferred != nil {
+			if s.options.DeadLetter == nil {
+				_ = s.deferEvent(inst, *next.deferred)
+			}
+			continue
+		}
+		if err != nil {
+			if next.depth > 0 {
+				err = cascadeError(next.event, err)
+			}
+			plan.Error = err.Error()
+			return plan, err
+		}
+		plan.To = step.To
+		for _, f := range followUps {
+			f.depth = next.depth + 1
+			if f.actor == nil {
+				f.actor = next.actor
+			}
+			queue = append(queue, f)
+		}
+	}
+	return plan, nil
+}
+
+// simulateStep 推演一步，与 transit 的处理顺序一致，返回推演的步骤及后续事件
+func (s *StateMachine) simulateStep(ctx context.Context, inst *Instance, from State, event Event) (PlanStep, []queuedEvent, error) {
+	step := PlanStep{
+		From:        from,
+		Event:       event,
+		To:          from,
+		Permissions: s.Graph.Permissions(from, event),
+		Guard:       GuardNone,
+	}
+	transition, to, err := s.prepare(ctx, from, event)
+	if found, result := s.Graph.lookup(from, event); result == lookupOK && found.Guard != nil {
+		switch {
+		case err == nil:
+			step.Guard = GuardPassed
+		case errors.Is(err, ErrGuardRejected):
+			step.Guard = GuardRejected
+		default:
+			step.Guard = GuardSkipped
+		}
+	}
+	if errors.Is(err, ErrUnhandledEvent) {
+		if inst != nil && s.Graph.Deferrable(from, event) {
+			deferred, err := s.newDeferred(ctx, from, event)
+			if err == nil {
+				err = s.deferEvent(inst, deferred)
+			}
+			if err != nil {
+				step.Error = err.Error()
+				return step, nil, err
+			}
+			step.Deferred = true
+			return step, nil, nil
+		}
+		if s.options.Unhandled != UnhandledReturnError {
+			step.Ignored = true
+			return step, nil, nil
+		}
+	}
+	if err != nil {
+		step.Error = err.Error()
+		return step, nil, err
+	}
+	step.To = to
+	syncListeners := 0
+	for _, l := range s.listeners.load() {
+		if !l.options.Async {
+			syncListeners++
+		}
+	}
+	step.Hooks = append(step.Hooks, HookExitOldState)
+	for i := 0; i < syncListeners; i++ {
+		step.Hooks = append(step.Hooks, HookListenerExitOldState)
+	}
+	if transition.Processor != nil {
+		step.Hooks = append(step.Hooks, HookTransitionExitOldState)
+	}
+	if transition.Action != nil || transition.ContextAction != nil {
+		step.Hooks = append(step.Hooks, HookAction)
+	}
+	step.Hooks = append(step.Hooks, HookEnterNewState)
+	for i := 0; i < syncListeners; i++ {
+		step.Hooks = append(step.Hooks, HookListenerEnterNewState)
+	}
+	if transition.Processor != nil {
+		step.Hooks = append(step.Hooks, HookTransitionEnterNewState)
+	}
+	var followUps []queuedEvent
+	for _, e := range transition.Raises {
+		step.FollowUps = append(step.FollowUps, e)
+		followUps = append(followUps, queuedEvent{event: e})
+	}
+	if inst != nil {
+		s.remember(ctx, from, to)
+		inst.State = to
+		if deferred, ok := s.undefer(inst, to); ok {
+			step.FollowUps = append(step.FollowUps, deferred.Event)
+			followUps = append(followUps, redelivered(deferred))
+		}
+	}
+	return step, followUps, nil
+}
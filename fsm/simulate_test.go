@@ -0,0 +1,151 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	articleDraft State = iota
+	articleReview
+	articleApproved
+	articlePublished
+	articleRejected
+)
+
+// article 文章状态机测试夹具，approve 控制审核守卫，calls 记录动作执行次数
+type article struct {
+	*StateMachine
+	approve bool
+	calls   int32
+}
+
+/** articleMachine 文章状态机
+* 1. 草稿 -(提交)-> 审核中 -(通过)-> 已通过 -(发布)-> 已发布，审核中 -(拒绝)-> 已拒绝
+* 2. 通过受守卫控制，并在动作中抛出发布事件
+* 3. 草稿时延迟通过事件
+**/
+func articleMachine(t *testing.T) *article {
+	t.Helper()
+	a := &article{approve: true}
+	action := func(from State, event Event, to State) error {
+		atomic.AddInt32(&a.calls, 1)
+		return nil
+	}
+	m, err := NewBuilder("文章状态机").
+		States(map[State]string{articleDraft: "draft", articleReview: "review", articleApproved: "approved",
+			articlePublished: "published", articleRejected: "rejected"}).
+		Start(articleDraft).
+		End(articlePublished, articleRejected).
+		Options(Options{Processor: testProcessor{}, Store: NewMemoryStore(), Quiet: true}).
+		Defer(articleDraft, "approve").
+		From(articleDraft).On("submit").To(articleReview).With(testProcessor{}).Do(action).
+		From(articleReview).On("approve").To(articleApproved).
+		When(func(ctx context.Context, from State, event Event, to State) bool { return a.approve }).
+		Raises("publish").
+		DoContext(func(ctx context.Context, from State, event Event, to State) error {
+			atomic.AddInt32(&a.calls, 1)
+			return Raise(ctx, "publish")
+		}).
+		From(articleReview).On("reject").To(articleRejected).Do(action).
+		From(articleApproved).On("publish").To(articlePublished).Do(action).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.StateMachine = m
+	return a
+}
+
+func TestSimulateHooks(t *testing.T) {
+	ctx := context.Background()
+	a := articleMachine(t)
+	plan, err := a.Simulate(ctx, articleDraft, "submit")
+	if err != nil || plan.To != articleReview || len(plan.Steps) != 1 {
+		t.Fatalf("试运行结果错误：%+v %v", plan, err)
+	}
+	hooks := []string{HookExitOldState, HookTransitionExitOldState, HookAction, HookEnterNewState, HookTransitionEnterNewState}
+	if !reflect.DeepEqual(plan.Steps[0].Hooks, hooks) || plan.Steps[0].Guard != GuardNone {
+		t.Fatalf("钩子错误：%+v", plan.Steps[0])
+	}
+}
+
+func TestSimulateFollowUps(t *testing.T) {
+	ctx := context.Background()
+	a := articleMachine(t)
+	plan, err := a.Simulate(ctx, articleReview, "approve")
+	if err != nil || plan.To != articlePublished || len(plan.Steps) != 2 || plan.Steps[0].Guard != GuardPassed ||
+		!reflect.DeepEqual(plan.Steps[0].FollowUps, []Event{"publish"}) || plan.Steps[1].Depth != 1 {
+		t.Fatalf("后续事件推演错误：%+v %v", plan, err)
+	}
+	if atomic.LoadInt32(&a.calls) != 0 {
+		t.Fatalf("试运行不应执行动作：%d", a.calls)
+	}
+}
+
+func TestSimulateGuardRejected(t *testing.T) {
+	ctx := context.Background()
+	a := articleMachine(t)
+	a.approve = false
+	plan, err := a.Simulate(ctx, articleReview, "approve")
+	if !errors.Is(err, ErrGuardRejected) || plan.To != articleReview || plan.Steps[0].Guard != GuardRejected || plan.Error == "" {
+		t.Fatalf("守卫拒绝错误：%+v %v", plan, err)
+	}
+	if _, err := a.Run(articleReview, "approve"); !errors.Is(err, ErrGuardRejected) {
+		t.Fatalf("Run 应被守卫拒绝：%v", err)
+	}
+}
+
+func TestSimulateInstance(t *testing.T) {
+	ctx := context.Background()
+	a := articleMachine(t)
+	if _, err := a.Start(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Simulate(ctx, articleDraft, "approve"); !errors.Is(err, ErrUnhandledEvent) {
+		t.Fatalf("没有实例时不能延迟事件：%v", err)
+	}
+	plan, err := a.SimulateFire(ctx, "1", "approve")
+	if err != nil || plan.To != articleDraft || !plan.Steps[0].Deferred {
+		t.Fatalf("事件应被延迟：%+v %v", plan, err)
+	}
+	if _, err := a.Fire(ctx, "1", "approve"); err != nil {
+		t.Fatal(err)
+	}
+	plan, err = a.SimulateFire(ctx, "1", "submit")
+	if err != nil || plan.To != articlePublished || len(plan.Steps) != 3 || plan.Steps[1].Event != "approve" || plan.Steps[2].Depth != 2 {
+		t.Fatalf("延迟事件推演错误：%+v %v", plan, err)
+	}
+	inst, _ := a.Options().Store.Load(ctx, "文章状态机", "1")
+	if inst.State != articleDraft || len(inst.Deferred) != 1 || atomic.LoadInt32(&a.calls) != 0 {
+		t.Fatalf("试运行不应修改实例：%+v", inst)
+	}
+
+	// 实际执行与试运行结果一致
+	if to, err := a.Fire(ctx, "1", "submit"); err != nil || to != plan.To || atomic.LoadInt32(&a.calls) != 3 {
+		t.Fatalf("实际执行结果与试运行不一致：%d %v", to, err)
+	}
+}
+
+func TestSimulateRedeliveryFailure(t *testing.T) {
+	ctx := context.Background()
+	m, _, _ := redeliveryMachine(t, Options{})
+	if _, err := m.Fire(WithActor(ctx, customerActor), "1001", EventPayConfirm); err != nil {
+		t.Fatal(err)
+	}
+	// 重新投递以延迟时的用户身份推演，无权执行，不影响触发的支付
+	plan, err := m.SimulateFire(WithActor(ctx, systemActor), "1001", EventPay)
+	if err != nil || plan.To != StateWaitConfirm || len(plan.Steps) != 2 {
+		t.Fatalf("重新投递失败不应影响推演结果：%+v %v", plan, err)
+	}
+	if step := plan.Steps[1]; !step.Redelivered || !strings.Contains(step.Error, ErrPermissionDenied.Error()) {
+		t.Fatalf("重新投递的步骤错误：%+v", step)
+	}
+	if to, err := m.Fire(WithActor(ctx, systemActor), "1001", EventPay); err != nil || to != plan.To {
+		t.Fatalf("实际执行结果与试运行不一致：%d %v", to, err)
+	}
+}
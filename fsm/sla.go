@@ -0,0 +1,261 @@
+package fsm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock 时钟，测试时替换为假时钟
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock 系统时钟
+var SystemClock Clock = systemClock{}
+
+// SetSLA 设置各状态的 SLA，实例停留超过该时长视为超时
+func (s *StateMachine) SetSLA(slas map[State]time.Duration) *StateMachine {
+	s.Graph.mustNotFrozen()
+	s.Graph.slas = slas
+	return s
+}
+
+// SLA 状态的 SLA
+func (g *StateGraph) SLA(state State) (time.Duration, bool) {
+	sla, ok := g.slas[state]
+	return sla, ok && sla > 0
+}
+
+// SLABreach 超过 SLA 的实例
+type SLABreach struct {
+	Machine    string        `json:"machine"`
+	EntityID   string        `json:"entity_id"`
+	State      State         `json:"state"`
+	StateDesc  string        `json:"state_desc"`
+	SLA        time.Duration `json:"sla"`
+	EnteredAt  time.Time     `json:"entered_at"`
+	Age        time.Duration `json:"age"`
+	DetectedAt time.Time     `json:"detected_at"`
+}
+
+// SLACount 超时实例按状态与停留时长分段的数量
+type SLACount struct {
+	Machine string `json:"machine"`
+	State   State  `json:"state"`
+	Bucket  string `json:"bucket"`
+	Count   int    `json:"count"`
+}
+
+/** 停滞实例 SLA 监控
+* 1. 定期扫描每个状态机声明了 SLA 的状态，通过状态存储的 StateQuerier 查询进入时间早于 now-SLA 的实例
+* 2. 新发现的超时实例回调 OnBreach，并通过 Publisher 发布到 Topic；同一实例在同一次进入状态期间只告警一次，
+*    发布失败时下次扫描只重试发布，不再回调 OnBreach，也不再作为新发现的实例返回
+* 3. 每次扫描后按 状态 x 停留时长分段 统计超时实例数量，通过 Counts 获取
+* 4. 时间取自 Clock，测试时使用假时钟
+* 5. 扫描串行执行；回调与发布时不持有统计数据的锁，回调中可以调用 Counts，但不能调用 Scan
+**/
+type SLAMonitor struct {
+	Machines  []*StateMachine                             `desc:"监控的状态机，状态存储需要实现 StateQuerier"`
+	Clock     Clock                                       `desc:"时钟，默认 SystemClock"`
+	Interval  time.Duration                               `desc:"扫描间隔，默认 1 分钟"`
+	Buckets   []time.Duration                             `desc:"停留时长分段，默认 24h/48h/72h/168h"`
+	OnBreach  func(ctx context.Context, breach SLABreach) `desc:"超时回调"`
+	Publisher Publisher                                   `desc:"超时事件发布"`
+	Topic     string                                      `desc:"超时事件主题，默认 fsm.sla.breach"`
+
+	scanning sync.Mutex          // 串行化扫描，保护 alerted
+	alerted  map[string]slaAlert // 已告警的实例，只在扫描中访问
+
+	locker    sync.Mutex // 保护统计数据
+	counts    []SLACount
+	scannedAt time.Time
+}
+
+func NewSLAMonitor(machines ...*StateMachine) *SLAMonitor {
+	return &SLAMonitor{
+		Machines: machines,
+		Clock:    SystemClock,
+		Interval: time.Minute,
+		Buckets:  []time.Duration{24 * time.Hour, 48 * time.Hour, 72 * time.Hour, 168 * time.Hour},
+		Topic:    "fsm.sla.breach",
+	}
+}
+
+// slaAlert 超时实例的告警进度，回调与发布分别记录
+type slaAlert struct {
+	notified  bool
+	published bool
+}
+
+func (m *SLAMonitor) now() time.Time {
+	if m.Clock == nil {
+		return time.Now()
+	}
+	return m.Clock.Now()
+}
+
+// bucket 停留时长所在的分段及其序号
+func (m *SLAMonitor) bucket(age time.Duration) (int, string) {
+	buckets := m.Buckets
+	if len(buckets) == 0 {
+		return 0, "all"
+	}
+	if age < buckets[0] {
+		return 0, "<" + formatAge(buckets[0])
+	}
+	for i := len(buckets) - 1; ; i-- {
+		if age < buckets[i] {
+			continue
+		}
+		if i == len(buckets)-1 {
+			return i + 1, ">=" + formatAge(buckets[i])
+		}
+		return i + 1, formatAge(buckets[i]) + "~" + formatAge(buckets[i+1])
+	}
+}
+
+func formatAge(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return d.String()
+}
+
+// Scan 扫描一次，返回本次新发现的超时实例
+func (m *SLAMonitor) Scan(ctx context.Context) ([]SLABreach, error) {
+	m.scanning.Lock()
+	defer m.scanning.Unlock()
+	now := m.now()
+	alerted := make(map[string]slaAlert)
+	counts := make(map[SLACount]int)
+	order := make(map[string]int)
+	var breaches []SLABreach
+	for _, machine := range m.Machines {
+		querier, ok := machine.options.Store.(StateQuerier)
+		if !ok {
+			return nil, fmt.Errorf("状态机的状态存储不支持按状态查询：%s", machine.Name())
+		}
+		states := make([]State, 0, len(machine.Graph.slas))
+		for state := range machine.Graph.slas {
+			states = append(states, state)
+		}
+		sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+		for _, state := range states {
+			sla, ok := machine.Graph.SLA(state)
+			if !ok {
+				continue
+			}
+			insts, err := querier.FindInState(ctx, machine.Name(), state, now.Add(-sla))
+			if err != nil {
+				return nil, err
+			}
+			for _, inst := range insts {
+				breach := SLABreach{
+					Machine:    machine.Name(),
+					EntityID:   inst.ID,
+					State:      state,
+					StateDesc:  machine.GetStateDesc(state),
+					SLA:        sla,
+					EnteredAt:  inst.EnteredAt,
+					Age:        now.Sub(inst.EnteredAt),
+					DetectedAt: now,
+				}
+				index, bucket := m.bucket(breach.Age)
+				order[bucket] = index
+				counts[SLACount{Machine: breach.Machine, State: state, Bucket: bucket}]++
+				key := fmt.Sprintf("%s/%s/%d/%d", breach.Machine, inst.ID, state, inst.EnteredAt.UnixNano())
+				alert := m.alerted[key]
+				if !alert.notified {
+					breaches = append(breaches, breach)
+					if m.OnBreach != nil {
+						m.OnBreach(ctx, breach)
+					}
+				}
+				alert.notified = true
+				alert.published = alert.published || m.publish(ctx, breach)
+				alerted[key] = alert
+			}
+		}
+	}
+	m.alerted = alerted
+	list := make([]SLACount, 0, len(counts))
+	for count, n := range counts {
+		count.Count = n
+		list = append(list, count)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Machine != b.Machine {
+			return a.Machine < b.Machine
+		}
+		if a.State != b.State {
+			return a.State < b.State
+		}
+		return order[a.Bucket] < order[b.Bucket]
+	})
+	m.locker.Lock()
+	m.counts, m.scannedAt = list, now
+	m.locker.Unlock()
+	return breaches, nil
+}
+
+// publish 发布超时事件，发布失败返回 false
+func (m *SLAMonitor) publish(ctx context.Context, breach SLABreach) bool {
+	if m.Publisher == nil {
+		return true
+	}
+	payload, err := json.Marshal(breach)
+	if err != nil {
+		log.Printf("SLA 超时事件序列化失败：%v\n", err)
+		return false
+	}
+	msg := Message{
+		ID:        newMessageID(),
+		Machine:   breach.Machine,
+		EntityID:  breach.EntityID,
+		Topic:     m.Topic,
+		Payload:   payload,
+		CreatedAt: breach.DetectedAt,
+	}
+	if err := m.Publisher.Publish(ctx, msg); err != nil {
+		log.Printf("SLA 超时事件发布失败，实例：%s，错误：%v\n", breach.EntityID, err)
+		return false
+	}
+	return true
+}
+
+// Counts 最近一次扫描的超时实例数量及扫描时间
+func (m *SLAMonitor) Counts() ([]SLACount, time.Time) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	return append([]SLACount(nil), m.counts...), m.scannedAt
+}
+
+// Run 按 Interval 定期扫描，直到上下文取消
+func (m *SLAMonitor) Run(ctx context.Context) error {
+	clock := m.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	for {
+		if _, err := m.Scan(ctx); err != nil {
+			log.Printf("SLA 扫描失败：%v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(m.Interval):
+		}
+	}
+}
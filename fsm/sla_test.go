@@ -0,0 +1,154 @@
+package fsm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now   time.Time
+	ticks chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time                         { return c.now }
+func (c *fakeClock) After(d time.Duration) <-chan time.Time { return c.ticks }
+
+type fakePublisher struct {
+	err      error
+	messages []Message
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, msg Message) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.messages = append(p.messages, msg)
+	return nil
+}
+
+// slaMonitor 待确认 SLA 为 48 小时的主订单状态机，实例分别已停留 10、50、60、200 小时
+func slaMonitor(t *testing.T) (*SLAMonitor, *fakeClock) {
+	t.Helper()
+	store := NewMemoryStore()
+	m := mainMachine(t, Options{Store: store}, func(b *Builder) { b.SLA(StateWaitConfirm, 48*time.Hour) })
+	clock := &fakeClock{now: time.Date(2024, 1, 10, 0, 0, 0, 0, time.Local)}
+	for id, age := range map[string]time.Duration{
+		"1001": 10 * time.Hour,
+		"1002": 50 * time.Hour,
+		"1003": 60 * time.Hour,
+		"1004": 200 * time.Hour,
+	} {
+		inst := Instance{ID: id, Machine: MainMachineName, State: StateWaitConfirm, EnteredAt: clock.now.Add(-age)}
+		if err := store.Save(context.Background(), &inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	monitor := NewSLAMonitor(m)
+	monitor.Clock = clock
+	return monitor, clock
+}
+
+func TestSLAMonitorBuiltin(t *testing.T) {
+	if sla, ok := SubStateMachine.Graph.SLA(StateSubWaitShip); !ok || sla != 48*time.Hour {
+		t.Fatalf("子订单待发货 SLA 错误：%v", sla)
+	}
+	if sla, ok := AfterSaleStateMachine.Graph.SLA(StateAfterSaleWaitReview); !ok || sla != 24*time.Hour {
+		t.Fatalf("售后待审核 SLA 错误：%v", sla)
+	}
+}
+
+func TestSLAMonitorPublishRetry(t *testing.T) {
+	ctx := context.Background()
+	monitor, _ := slaMonitor(t)
+	publisher := &fakePublisher{err: errors.New("broker down")}
+	monitor.Publisher = publisher
+	called := 0
+	monitor.OnBreach = func(ctx context.Context, breach SLABreach) { called++ }
+	breaches, err := monitor.Scan(ctx)
+	if err != nil || len(breaches) != 3 || len(publisher.messages) != 0 {
+		t.Fatalf("扫描结果错误：%+v %v", breaches, err)
+	}
+	publisher.err = nil
+	if breaches, _ = monitor.Scan(ctx); len(breaches) != 0 || len(publisher.messages) != 3 {
+		t.Fatalf("发布失败后应只重试发布：%+v %d", breaches, len(publisher.messages))
+	}
+	if called != 3 {
+		t.Fatalf("重试发布时不应再次回调：%d", called)
+	}
+	var breach SLABreach
+	if err := json.Unmarshal(publisher.messages[0].Payload, &breach); err != nil || breach.EntityID != "1004" ||
+		breach.Age != 200*time.Hour || publisher.messages[0].Topic != "fsm.sla.breach" {
+		t.Fatalf("超时事件错误：%+v %v", breach, err)
+	}
+}
+
+func TestSLAMonitorAlertOnce(t *testing.T) {
+	ctx := context.Background()
+	monitor, clock := slaMonitor(t)
+	var called []string
+	monitor.OnBreach = func(ctx context.Context, breach SLABreach) {
+		// 回调时不持有统计数据的锁
+		monitor.Counts()
+		called = append(called, breach.EntityID)
+	}
+	if breaches, _ := monitor.Scan(ctx); len(breaches) != 3 {
+		t.Fatalf("扫描结果错误：%+v", breaches)
+	}
+	if breaches, _ := monitor.Scan(ctx); len(breaches) != 0 {
+		t.Fatalf("已告警的实例不应再告警：%+v", breaches)
+	}
+	clock.now = clock.now.Add(40 * time.Hour)
+	if breaches, _ := monitor.Scan(ctx); len(breaches) != 1 || breaches[0].EntityID != "1001" {
+		t.Fatalf("只应告警新超时的实例：%+v", breaches)
+	}
+	if len(called) != 4 {
+		t.Fatalf("回调次数错误：%v", called)
+	}
+}
+
+func TestSLAMonitorCounts(t *testing.T) {
+	ctx := context.Background()
+	monitor, clock := slaMonitor(t)
+	clock.now = clock.now.Add(40 * time.Hour)
+	monitor.Scan(ctx)
+	counts, scannedAt := monitor.Counts()
+	want := []SLACount{
+		{Machine: MainMachineName, State: StateWaitConfirm, Bucket: "48h~72h", Count: 1},
+		{Machine: MainMachineName, State: StateWaitConfirm, Bucket: "72h~168h", Count: 2},
+		{Machine: MainMachineName, State: StateWaitConfirm, Bucket: ">=168h", Count: 1},
+	}
+	if !scannedAt.Equal(clock.now) || len(counts) != len(want) {
+		t.Fatalf("分段统计错误：%+v", counts)
+	}
+	for i := range want {
+		if counts[i] != want[i] {
+			t.Fatalf("分段统计错误：%+v", counts)
+		}
+	}
+
+	// 实例离开状态后不再统计
+	if _, err := monitor.Machines[0].Fire(ctx, "1004", EventPayConfirm); err != nil {
+		t.Fatal(err)
+	}
+	monitor.Scan(ctx)
+	if counts, _ = monitor.Counts(); len(counts) != 2 || counts[1].Bucket != "72h~168h" {
+		t.Fatalf("离开状态的实例不应统计：%+v", counts)
+	}
+}
+
+func TestSLAMonitorRun(t *testing.T) {
+	ctx := context.Background()
+	monitor, clock := slaMonitor(t)
+	clock.ticks = make(chan time.Time)
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- monitor.Run(runCtx) }()
+	clock.ticks <- clock.now
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run 应随上下文退出：%v", err)
+	}
+}
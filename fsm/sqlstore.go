@@ -0,0 +1,173 @@
+package fsm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+/** SQL 状态存储，默认表结构：
+* CREATE TABLE fsm_instance (
+*   machine    VARCHAR(64)  NOT NULL,
+*   entity_id  VARCHAR(64)  NOT NULL,
+*   version    INT          NOT NULL DEFAULT 0,
+*   state      TINYINT      NOT NULL,
+*   revision   BIGINT       NOT NULL,
+*   entered_at DATETIME(3)  NOT NULL,
+*   history    TEXT         NOT NULL,
+*   deferred   TEXT         NOT NULL,
+*   PRIMARY KEY (machine, entity_id),
+*   KEY idx_state_entered (machine, state, entered_at)
+* );
+* 上下文中存在事务时使用该事务读写，保证状态变更与业务写入在同一事务中
+* 新建实例时主键已存在返回 ErrConflict
+* 已有的表需要先补充复合状态的历史（history）与延迟事件（deferred）两列，旧数据为空字符串，读取时视为没有记录：
+* ALTER TABLE fsm_instance
+*   ADD COLUMN history  TEXT         NOT NULL,
+*   ADD COLUMN deferred TEXT         NOT NULL;
+* 没有历史记录的实例执行历史伪状态的转变器时，按转变器的 Fallback 返回，见 Transition.Fallback
+**/
+type SQLStore struct {
+	Session *dbr.Session
+	Table   string
+}
+
+func NewSQLStore(session *dbr.Session) *SQLStore {
+	return &SQLStore{Session: session, Table: "fsm_instance"}
+}
+
+type instanceRow struct {
+	Machine   string    `db:"machine"`
+	EntityID  string    `db:"entity_id"`
+	Version   int       `db:"version"`
+	State     State     `db:"state"`
+	Revision  int64     `db:"revision"`
+	EnteredAt time.Time `db:"entered_at"`
+	History   string    `db:"history"`
+	Deferred  string    `db:"deferred"`
+}
+
+func (row instanceRow) instance() (Instance, error) {
+	inst := Instance{
+		ID:        row.EntityID,
+		Machine:   row.Machine,
+		Version:   row.Version,
+		State:     row.State,
+		Revision:  row.Revision,
+		EnteredAt: row.EnteredAt,
+	}
+	if row.History != "" {
+		if err := json.Unmarshal([]byte(row.History), &inst.History); err != nil {
+			return Instance{}, fmt.Errorf("实例历史状态解析失败：%s：%w", row.EntityID, err)
+		}
+	}
+	if row.Deferred != "" {
+		if err := json.Unmarshal([]byte(row.Deferred), &inst.Deferred); err != nil {
+			return Instance{}, fmt.Errorf("实例延迟事件解析失败：%s：%w", row.EntityID, err)
+		}
+	}
+	return inst, nil
+}
+
+// encodeColumn 历史状态、延迟事件序列化为 JSON，为空时保存空字符串
+func encodeColumn(v interface{}, empty bool) (string, error) {
+	if empty {
+		return "", nil
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (s *SQLStore) Load(ctx context.Context, machine, id string) (Instance, error) {
+	var row instanceRow
+	err := runnerFrom(ctx, s.Session).
+		Select("machine", "entity_id", "version", "state", "revision", "entered_at", "history", "deferred").
+		From(s.Table).
+		Where("machine = ? AND entity_id = ?", machine, id).
+		LoadOneContext(ctx, &row)
+	if errors.Is(err, dbr.ErrNotFound) {
+		return Instance{}, ErrInstanceNotFound
+	}
+	if err != nil {
+		return Instance{}, err
+	}
+	return row.instance()
+}
+
+func (s *SQLStore) FindInState(ctx context.Context, machine string, state State, before time.Time) ([]Instance, error) {
+	var rows []instanceRow
+	_, err := runnerFrom(ctx, s.Session).
+		Select("machine", "entity_id", "version", "state", "revision", "entered_at", "history", "deferred").
+		From(s.Table).
+		Where("machine = ? AND state = ? AND entered_at < ?", machine, state, before).
+		OrderBy("entered_at").
+		LoadContext(ctx, &rows)
+	if err != nil {
+		return nil, err
+	}
+	insts := make([]Instance, len(rows))
+	for i, row := range rows {
+		if insts[i], err = row.instance(); err != nil {
+			return nil, err
+		}
+	}
+	return insts, nil
+}
+
+func (s *SQLStore) Save(ctx context.Context, inst *Instance) error {
+	runner := runnerFrom(ctx, s.Session)
+	history, err := encodeColumn(inst.History, len(inst.History) == 0)
+	if err != nil {
+		return err
+	}
+	deferred, err := encodeColumn(inst.Deferred, len(inst.Deferred) == 0)
+	if err != nil {
+		return err
+	}
+	if inst.Revision == 0 {
+		_, err := runner.InsertInto(s.Table).
+			Pair("machine", inst.Machine).
+			Pair("entity_id", inst.ID).
+			Pair("version", inst.Version).
+			Pair("state", inst.State).
+			Pair("revision", 1).
+			Pair("entered_at", inst.EnteredAt).
+			Pair("history", history).
+			Pair("deferred", deferred).
+			ExecContext(ctx)
+		if err != nil {
+			// 插入失败时实例已存在，视为并发创建
+			if _, loadErr := s.Load(ctx, inst.Machine, inst.ID); loadErr == nil {
+				return ErrConflict
+			}
+			return err
+		}
+		inst.Revision = 1
+		return nil
+	}
+	res, err := runner.Update(s.Table).
+		Set("version", inst.Version).
+		Set("state", inst.State).
+		Set("revision", inst.Revision+1).
+		Set("entered_at", inst.EnteredAt).
+		Set("history", history).
+		Set("deferred", deferred).
+		Where("machine = ? AND entity_id = ? AND revision = ?", inst.Machine, inst.ID, inst.Revision).
+		ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrConflict
+	}
+	inst.Revision++
+	return nil
+}
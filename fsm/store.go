@@ -0,0 +1,169 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInstanceNotFound 实例不存在
+	ErrInstanceNotFound = errors.New("实例不存在")
+	// ErrConflict 实例已被并发修改
+	ErrConflict = errors.New("实例已被修改")
+)
+
+/** 状态存储接口
+* 1. Load 读取实例，不存在时返回 ErrInstanceNotFound
+* 2. Save 保存实例，Revision 为 0 表示新建；否则只有存储中的修订号与 Revision 一致时才更新，
+*    不一致时返回 ErrConflict，保存成功后 Revision 加一
+**/
+type StateStore interface {
+	Load(ctx context.Context, machine, id string) (Instance, error)
+	Save(ctx context.Context, inst *Instance) error
+}
+
+// StateQuerier 按状态查询实例：处于 state 且进入时间早于 before 的实例
+type StateQuerier interface {
+	FindInState(ctx context.Context, machine string, state State, before time.Time) ([]Instance, error)
+}
+
+// MemoryStore 内存状态存储，用于测试及单机场景
+type MemoryStore struct {
+	locker    sync.RWMutex
+	instances map[[2]string]Instance
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		instances: make(map[[2]string]Instance),
+	}
+}
+
+func (m *MemoryStore) Load(ctx context.Context, machine, id string) (Instance, error) {
+	m.locker.RLock()
+	defer m.locker.RUnlock()
+	inst, ok := m.instances[[2]string{machine, id}]
+	if !ok {
+		return Instance{}, ErrInstanceNotFound
+	}
+	return inst.clone(), nil
+}
+
+func (m *MemoryStore) Save(ctx context.Context, inst *Instance) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	key := [2]string{inst.Machine, inst.ID}
+	current, ok := m.instances[key]
+	if ok != (inst.Revision > 0) || current.Revision != inst.Revision {
+		return ErrConflict
+	}
+	inst.Revision++
+	m.instances[key] = inst.clone()
+	return nil
+}
+
+func (m *MemoryStore) FindInState(ctx context.Context, machine string, state State, before time.Time) ([]Instance, error) {
+	m.locker.RLock()
+	defer m.locker.RUnlock()
+	var insts []Instance
+	for _, inst := range m.instances {
+		if inst.Machine == machine && inst.State == state && inst.EnteredAt.Before(before) {
+			insts = append(insts, inst)
+		}
+	}
+	sort.Slice(insts, func(i, j int) bool { return insts[i].EnteredAt.Before(insts[j].EnteredAt) })
+	return insts, nil
+}
+
+// Start 创建处于开始状态的实例并保存
+func (s *StateMachine) Start(ctx context.Context, id string) (Instance, error) {
+	if s.options.Store == nil {
+		return Instance{}, fmt.Errorf("状态机未设置状态存储：%s", s.Name())
+	}
+	inst := Instance{
+		ID:        id,
+		Machine:   s.Name(),
+		Version:   s.options.Version,
+		State:     s.Graph.start,
+		EnteredAt: time.Now(),
+	}
+	if err := s.options.Store.Save(ctx, &inst); err != nil {
+		return Instance{}, err
+	}
+	return inst, nil
+}
+
+/** 读取实例当前状态执行事件，流转成功后保存新状态
+* 后续事件失败（ErrCascade）时触发的事件已经完成，保存实际到达的状态，并与错误一起返回
+* 上下文中设置了幂等键且状态机配置了 Idempotency 时：
+* 1. 先预留该键，已处理过的键直接返回首次的结果，仍在处理中的键返回 ErrIdempotencyPending
+* 2. 预留成功后执行流转，成功后保存结果，失败时释放预留，相同的键可以重试
+* 3. 保存结果失败时返回错误，状态已经流转，预留在过期前仍然阻止重复处理；在事务中执行时整体回滚
+**/
+func (s *StateMachine) Fire(ctx context.Context, id string, event Event) (State, error) {
+	key, ok := IdempotencyKeyFrom(ctx)
+	if !ok || s.options.Idempotency == nil {
+		return s.fire(ctx, id, event)
+	}
+	result, reserved, err := s.options.Idempotency.Reserve(ctx, s.Name(), id, key, event, s.idempotencyLease())
+	if err != nil {
+		return 0, err
+	}
+	if !reserved {
+		return result.replay(key, event)
+	}
+	to, err := s.fire(ctx, id, event)
+	if err != nil && !errors.Is(err, ErrCascade) {
+		if releaseErr := s.options.Idempotency.Release(ctx, s.Name(), id, key); releaseErr != nil {
+			return 0, errors.Join(err, fmt.Errorf("幂等键释放失败：%w", releaseErr))
+		}
+		return 0, err
+	}
+	result = IdempotentResult{Event: event, To: to, At: time.Now()}
+	if putErr := s.options.Idempotency.Put(ctx, s.Name(), id, key, result, s.idempotencyTTL()); putErr != nil {
+		return to, errors.Join(err, fmt.Errorf("状态已流转为 %d，幂等键保存失败：%w", to, putErr))
+	}
+	return to, err
+}
+
+// load 读取实例，实例绑定的版本必须与状态机版本一致
+func (s *StateMachine) load(ctx context.Context, id string) (Instance, error) {
+	if s.options.Store == nil {
+		return Instance{}, fmt.Errorf("状态机未设置状态存储：%s", s.Name())
+	}
+	inst, err := s.options.Store.Load(ctx, s.Name(), id)
+	if err != nil {
+		return Instance{}, err
+	}
+	if inst.Version != s.options.Version {
+		return Instance{}, fmt.Errorf("%w：实例 %s 版本 %d，状态机版本 %d", ErrVersionMismatch, id, inst.Version, s.options.Version)
+	}
+	return inst, nil
+}
+
+func (s *StateMachine) fire(ctx context.Context, id string, event Event) (State, error) {
+	inst, err := s.load(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	runCtx, buffer := withCommitBuffer(ctx)
+	to, cascadeErr := s.RunContext(context.WithValue(withInstance(runCtx, &inst), historyKey, true), inst.State, event)
+	if cascadeErr != nil && !errors.Is(cascadeErr, ErrCascade) {
+		buffer.flush(ctx, cascadeErr)
+		return 0, cascadeErr
+	}
+	if to != inst.State {
+		inst.State = to
+		inst.EnteredAt = time.Now()
+	}
+	if err = s.options.Store.Save(ctx, &inst); err != nil {
+		buffer.flush(ctx, err)
+		return 0, err
+	}
+	buffer.flush(ctx, nil)
+	return to, cascadeErr
+}
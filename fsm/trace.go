@@ -0,0 +1,299 @@
+package fsm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 跟踪的钩子名称
+const (
+	HookRun                     = "Run"                      // 整个流转
+	HookExitOldState            = "ExitOldState"             // 状态机处理器退出旧状态
+	HookListenerExitOldState    = "Listener.ExitOldState"    // 同步监听器退出旧状态，每个监听器一条
+	HookTransitionExitOldState  = "Transition.ExitOldState"  // 转变器处理器退出旧状态
+	HookAction                  = "Action"                   // 转变器动作，每次尝试一条
+	HookEnterNewState           = "EnterNewState"            // 状态机处理器进入新状态
+	HookListenerEnterNewState   = "Listener.EnterNewState"   // 同步监听器进入新状态，每个监听器一条
+	HookTransitionEnterNewState = "Transition.EnterNewState" // 转变器处理器进入新状态
+)
+
+/** 跟踪片段
+* 1. 每次流转产生一条 Hook 为 Run 的片段，以及每个钩子各一条片段，Step 相同
+* 2. 处理器的错误即使在非事务模式下被忽略，也会记录在片段中
+* 3. 动作中通过 TracePayload 或 Emit 记录的数据保存在 Action 片段的 Payloads 中
+**/
+type Span struct {
+	Step     int64             `json:"step"`
+	Machine  string            `json:"machine"`
+	EntityID string            `json:"entity_id"`
+	From     State             `json:"from"`
+	Event    Event             `json:"event"`
+	To       State             `json:"to"`
+	Hook     string            `json:"hook"`
+	Attempt  int               `json:"attempt,omitempty"`
+	Start    time.Time         `json:"start"`
+	Duration time.Duration     `json:"duration"`
+	Error    string            `json:"error,omitempty"`
+	Payloads []json.RawMessage `json:"payloads,omitempty"`
+}
+
+// Tracer 跟踪片段记录
+type Tracer interface {
+	Span(ctx context.Context, span Span)
+}
+
+var traceStep int64 // 流转编号
+
+// stepTrace 一次流转的跟踪，未设置 Tracer 时为 nil，所有方法都是空操作
+type stepTrace struct {
+	tracer Tracer
+	ctx    context.Context
+	base   Span
+}
+
+func (s *StateMachine) startTrace(ctx context.Context, from State, event Event) *stepTrace {
+	if s.options.Tracer == nil {
+		return nil
+	}
+	t := &stepTrace{
+		tracer: s.options.Tracer,
+		ctx:    ctx,
+		base: Span{
+			Step:    atomic.AddInt64(&traceStep, 1),
+			Machine: s.Name(),
+			From:    from,
+			Event:   event,
+			To:      from,
+			Start:   time.Now(),
+		},
+	}
+	if inst, ok := InstanceFrom(ctx); ok {
+		t.base.EntityID = inst.ID
+	}
+	return t
+}
+
+// now 未跟踪时不取时间
+func (t *stepTrace) now() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// target 记录目标状态
+func (t *stepTrace) target(to State) {
+	if t != nil {
+		t.base.To = to
+	}
+}
+
+// hook 记录一次钩子执行
+func (t *stepTrace) hook(hook string, attempt int, start time.Time, err error, payloads []json.RawMessage) {
+	if t == nil {
+		return
+	}
+	span := t.base
+	span.Hook = hook
+	span.Attempt = attempt
+	span.Start = start
+	span.Duration = time.Since(start)
+	span.Payloads = payloads
+	if err != nil {
+		span.Error = err.Error()
+	}
+	t.tracer.Span(t.ctx, span)
+}
+
+// finish 记录整个流转
+func (t *stepTrace) finish(attempt int, err error) {
+	if t == nil {
+		return
+	}
+	t.hook(HookRun, attempt, t.base.Start, err, nil)
+}
+
+// tracePayloads 动作执行期间记录的数据
+type tracePayloads struct {
+	locker   sync.Mutex
+	payloads []json.RawMessage
+}
+
+// withPayloads 跟踪时在动作的上下文中放入数据缓冲
+func (t *stepTrace) withPayloads(ctx context.Context) (context.Context, *tracePayloads) {
+	if t == nil {
+		return ctx, nil
+	}
+	payloads := &tracePayloads{}
+	return context.WithValue(ctx, traceKey, payloads), payloads
+}
+
+func (p *tracePayloads) take() []json.RawMessage {
+	if p == nil {
+		return nil
+	}
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	payloads := p.payloads
+	p.payloads = nil
+	return payloads
+}
+
+// TracePayload 在动作中记录数据到跟踪片段，未开启跟踪时忽略
+func TracePayload(ctx context.Context, payload interface{}) error {
+	p, ok := ctx.Value(traceKey).(*tracePayloads)
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("跟踪数据序列化失败：%w", err)
+	}
+	p.locker.Lock()
+	p.payloads = append(p.payloads, data)
+	p.locker.Unlock()
+	return nil
+}
+
+// MemoryTracer 内存跟踪记录，Limit 大于 0 时只保留最近的片段
+type MemoryTracer struct {
+	locker sync.RWMutex
+	spans  []Span
+	Limit  int `desc:"最多保留的片段数"`
+}
+
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{}
+}
+
+func (t *MemoryTracer) Span(ctx context.Context, span Span) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.spans = append(t.spans, span)
+	if t.Limit > 0 && len(t.spans) > t.Limit {
+		t.spans = append(t.spans[:0:0], t.spans[len(t.spans)-t.Limit:]...)
+	}
+}
+
+// Trace 实例的全部片段，按开始时间排序
+func (t *MemoryTracer) Trace(machine, id string) []Span {
+	t.locker.RLock()
+	defer t.locker.RUnlock()
+	var spans []Span
+	for _, span := range t.spans {
+		if span.Machine == machine && span.EntityID == id {
+			spans = append(spans, span)
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].Start.Before(spans[j].Start) })
+	return spans
+}
+
+// TimelineStep 时间线中的一次流转及其钩子片段
+type TimelineStep struct {
+	Span
+	Hooks []Span
+}
+
+// Timeline 按流转分组片段，按流转开始时间排序
+func Timeline(spans []Span) []TimelineStep {
+	index := map[int64]int{}
+	var steps []TimelineStep
+	for _, span := range spans {
+		i, ok := index[span.Step]
+		if !ok {
+			i = len(steps)
+			index[span.Step] = i
+			steps = append(steps, TimelineStep{Span: Span{Step: span.Step, Machine: span.Machine, EntityID: span.EntityID,
+				From: span.From, Event: span.Event, To: span.To, Hook: HookRun, Start: span.Start}})
+		}
+		if span.Hook == HookRun {
+			hooks := steps[i].Hooks
+			steps[i].Span = span
+			steps[i].Hooks = hooks
+			continue
+		}
+		steps[i].Hooks = append(steps[i].Hooks, span)
+	}
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Start.Before(steps[j].Start) })
+	return steps
+}
+
+type transitionKey struct {
+	from  State
+	event Event
+}
+
+/** MermaidPath 在状态机图上叠加实例的流转路径
+* 1. 输出 Mermaid stateDiagram-v2，包含状态机的全部状态与转变器，历史伪状态展开为所有可能返回的状态，
+*    状态与事件使用状态机语言下的名称
+* 2. 实例经过的状态使用 visited 样式，当前所在状态使用 current 样式
+* 3. 经过的转变器在事件后标注流转序号，失败的流转标注 ✗
+**/
+func (s *StateMachine) MermaidPath(spans []Span) string {
+	g := s.Graph
+	steps := Timeline(spans)
+	taken := map[transitionKey][]string{}
+	visited := map[State]bool{}
+	var current State
+	for i, step := range steps {
+		mark := fmt.Sprintf("#%d", i+1)
+		if step.Error != "" {
+			mark += "✗"
+		} else {
+			visited[step.From] = true
+			visited[step.To] = true
+			current = step.To
+		}
+		key := transitionKey{from: step.From, event: step.Event}
+		taken[key] = append(taken[key], mark)
+	}
+
+	states := make([]State, 0, len(g.states))
+	for state := range g.states {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+
+	var b strings.Builder
+	b.WriteString("stateDiagram-v2\n")
+	for _, state := range states {
+		fmt.Fprintf(&b, "    s%d : %s\n", state, g.StateLabel(s.locale(), state))
+	}
+	fmt.Fprintf(&b, "    [*] --> s%d\n", g.start)
+	for _, from := range states {
+		// 复合状态的转变器展开到子状态上
+		if g.IsComposite(from) {
+			continue
+		}
+		for _, event := range g.availableEvents(from) {
+			label := s.GetEventDesc(event)
+			if marks := taken[transitionKey{from: from, event: event}]; len(marks) > 0 {
+				label += " " + strings.Join(marks, ",")
+			}
+			for _, to := range g.targets(from, event) {
+				fmt.Fprintf(&b, "    s%d --> s%d : %s\n", from, to, label)
+			}
+		}
+	}
+	for _, state := range g.end {
+		fmt.Fprintf(&b, "    s%d --> [*]\n", state)
+	}
+	b.WriteString("    classDef visited fill:#d4f4dd,stroke:#2e7d32\n")
+	b.WriteString("    classDef current fill:#ffe082,stroke:#f57f17,stroke-width:2px\n")
+	for _, state := range states {
+		switch {
+		case len(steps) > 0 && state == current && visited[state]:
+			fmt.Fprintf(&b, "    class s%d current\n", state)
+		case visited[state]:
+			fmt.Fprintf(&b, "    class s%d visited\n", state)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package fsm
+
+import (
+	"html/template"
+	"io"
+	"time"
+)
+
+// timelineBar 时间线中的一个钩子条
+type timelineBar struct {
+	Span
+	Left  float64 // 相对流转开始的偏移百分比
+	Width float64 // 占流转耗时的百分比
+}
+
+type timelineRow struct {
+	Index int
+	TimelineStep
+	FromDesc  string
+	EventDesc string
+	ToDesc    string
+	Bars      []timelineBar
+}
+
+type timelineView struct {
+	Machine  string
+	EntityID string
+	Rows     []timelineRow
+	Mermaid  string
+}
+
+// WriteTimelineHTML 输出实例的时间线报告，单个 HTML 文件，不依赖外部资源
+// 流转路径只输出 Mermaid 源码，不渲染图形，复制到 Mermaid 编辑器或支持 Mermaid 的文档中查看
+func (s *StateMachine) WriteTimelineHTML(w io.Writer, entityID string, spans []Span) error {
+	view := timelineView{
+		Machine:  s.Name(),
+		EntityID: entityID,
+		Mermaid:  s.MermaidPath(spans),
+	}
+	for i, step := range Timeline(spans) {
+		row := timelineRow{
+			Index:        i + 1,
+			TimelineStep: step,
+			FromDesc:     s.GetStateDesc(step.From),
+			EventDesc:    s.GetEventDesc(step.Event),
+			ToDesc:       s.GetStateDesc(step.To),
+		}
+		total := step.Duration
+		if total <= 0 {
+			total = time.Nanosecond
+		}
+		for _, hook := range step.Hooks {
+			bar := timelineBar{
+				Span:  hook,
+				Left:  100 * float64(hook.Start.Sub(step.Start)) / float64(total),
+				Width: 100 * float64(hook.Duration) / float64(total),
+			}
+			if bar.Width < 0.5 {
+				bar.Width = 0.5
+			}
+			if bar.Left+bar.Width > 100 {
+				bar.Left = 100 - bar.Width
+			}
+			row.Bars = append(row.Bars, bar)
+		}
+		view.Rows = append(view.Rows, row)
+	}
+	return timelineTemplate.Execute(w, view)
+}
+
+var timelineTemplate = template.Must(template.New("timeline").Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<title>{{.Machine}} {{.EntityID}} 流转时间线</title>
+<style>
+body { font-family: -apple-system, "PingFang SC", "Microsoft YaHei", sans-serif; margin: 24px; color: #222; }
+h1 { font-size: 20px; }
+.step { border: 1px solid #ddd; border-radius: 6px; margin-bottom: 16px; padding: 12px; }
+.step.failed { border-color: #e57373; background: #fff5f5; }
+.title { font-weight: bold; margin-bottom: 8px; }
+.meta { color: #666; font-size: 12px; margin-left: 8px; font-weight: normal; }
+.track { position: relative; height: 18px; background: #f3f3f3; margin: 4px 0; border-radius: 3px; }
+.bar { position: absolute; top: 0; height: 18px; border-radius: 3px; background: #64b5f6; }
+.bar.Action { background: #81c784; }
+.bar.error { background: #e57373; }
+table { border-collapse: collapse; width: 100%; font-size: 13px; margin-top: 8px; }
+th, td { border-bottom: 1px solid #eee; padding: 4px 8px; text-align: left; vertical-align: top; }
+.err { color: #c62828; }
+pre { background: #f7f7f7; padding: 8px; overflow-x: auto; font-size: 12px; margin: 0; }
+</style>
+</head>
+<body>
+<h1>{{.Machine}} · {{.EntityID}} 流转时间线</h1>
+{{range .Rows}}
+<div class="step{{if .Error}} failed{{end}}">
+	<div class="title">#{{.Index}} {{.FromDesc}} -({{.EventDesc}})-&gt; {{.ToDesc}}
+		<span class="meta">{{.Start.Format "2006-01-02 15:04:05.000"}} · 耗时 {{.Duration}}{{if .Attempt}} · 第 {{.Attempt}} 次执行{{end}}</span>
+	</div>
+	{{if .Error}}<div class="err">{{.Error}}</div>{{end}}
+	{{range .Bars}}
+	<div class="track" title="{{.Hook}} {{.Duration}}"><div class="bar {{.Hook}}{{if .Error}} error{{end}}" style="left: {{printf "%.2f" .Left}}%; width: {{printf "%.2f" .Width}}%"></div></div>
+	{{end}}
+	<table>
+		<tr><th>钩子</th><th>开始</th><th>耗时</th><th>错误</th><th>数据</th></tr>
+		{{range .Hooks}}
+		<tr>
+			<td>{{.Hook}}{{if .Attempt}} #{{.Attempt}}{{end}}</td>
+			<td>{{.Start.Format "15:04:05.000000"}}</td>
+			<td>{{.Duration}}</td>
+			<td class="err">{{.Error}}</td>
+			<td>{{range .Payloads}}<pre>{{printf "%s" .}}</pre>{{end}}</td>
+		</tr>
+		{{end}}
+	</table>
+</div>
+{{else}}
+<p>没有流转记录</p>
+{{end}}
+<h2>流转路径（Mermaid 源码）</h2>
+<p class="meta">报告不加载外部脚本，不渲染图形，复制以下源码到 Mermaid 编辑器查看</p>
+<pre>{{.Mermaid}}</pre>
+</body>
+</html>
+`))
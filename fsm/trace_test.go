@@ -0,0 +1,89 @@
+package fsm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+/** traceMachine 记录追踪的主订单状态机，实例 1001 已支付、支付确认失败
+* 1. 支付动作附加金额
+* 2. 进入新状态时处理器返回被忽略的错误
+* 3. 支付确认动作失败，声明了重试策略，错误不可重试
+**/
+func traceMachine(t *testing.T) (*StateMachine, *MemoryTracer) {
+	t.Helper()
+	ctx := context.Background()
+	tracer := NewMemoryTracer()
+	m := mainBuilder().
+		Options(Options{
+			Processor: testProcessor{enterErr: errors.New("通知失败")},
+			Store:     NewMemoryStore(),
+			Tracer:    tracer,
+			Quiet:     true,
+		}).
+		From(StateWaitPay).On(EventPay).To(StateWaitConfirm).
+		DoContext(func(ctx context.Context, from State, event Event, to State) error {
+			return TracePayload(ctx, map[string]int{"amount": 100})
+		}).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+		From(StateWaitConfirm).On(EventPayConfirm).To(StatePayied).Retry(RetryPolicy{MaxAttempts: 2, RetryOn: []error{errTimeout}}).
+		Do(func(from State, event Event, to State) error { return errors.New("渠道超时") }).
+		MustBuild()
+	if _, err := m.Start(ctx, "1001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Fire(ctx, "1001", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Fire(ctx, "1001", EventPayConfirm); err == nil {
+		t.Fatal("动作失败时流转应失败")
+	}
+	return m, tracer
+}
+
+func TestTracerTimeline(t *testing.T) {
+	_, tracer := traceMachine(t)
+	steps := Timeline(tracer.Trace(MainMachineName, "1001"))
+	if len(steps) != 2 {
+		t.Fatalf("流转数量错误：%+v", steps)
+	}
+	pay := steps[0]
+	if pay.Error != "" || pay.To != StateWaitConfirm || len(pay.Hooks) != 3 {
+		t.Fatalf("支付流转错误：%+v", pay)
+	}
+	if pay.Hooks[1].Hook != HookAction || string(pay.Hooks[1].Payloads[0]) != `{"amount":100}` {
+		t.Fatalf("动作片段错误：%+v", pay.Hooks[1])
+	}
+	if pay.Hooks[2].Hook != HookEnterNewState || pay.Hooks[2].Error != "通知失败" {
+		t.Fatalf("被忽略的处理器错误也应记录：%+v", pay.Hooks[2])
+	}
+	if steps[1].Error == "" || steps[1].Hooks[len(steps[1].Hooks)-1].Error != "渠道超时" {
+		t.Fatalf("失败流转错误：%+v", steps[1])
+	}
+}
+
+func TestTracerMermaid(t *testing.T) {
+	m, tracer := traceMachine(t)
+	mermaid := m.MermaidPath(tracer.Trace(MainMachineName, "1001"))
+	for _, want := range []string{"s0 --> s1 : pay #1", "s1 --> s2 : pay_confirm #2✗", "class s1 current", "class s0 visited"} {
+		if !strings.Contains(mermaid, want) {
+			t.Fatalf("Mermaid 缺少 %q：\n%s", want, mermaid)
+		}
+	}
+}
+
+func TestTracerHTML(t *testing.T) {
+	m, tracer := traceMachine(t)
+	var buf bytes.Buffer
+	if err := m.WriteTimelineHTML(&buf, "1001", tracer.Trace(MainMachineName, "1001")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1001 流转时间线", "渠道超时", "amount", "stateDiagram-v2"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("HTML 缺少 %q", want)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+package fsm
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+	"github.com/gocraft/dbr/v2/dialect"
+)
+
+/** 本地数据库替身
+* 1. 每张表是一组行，列值保存为 SQL 字面量
+* 2. 支持 dbr 按 MySQL 方言生成的 INSERT / UPDATE / SELECT，条件只支持 AND 连接的比较（=、<、<=、>、>=）与 IS NULL
+* 3. 事务在表的副本上执行，提交时替换，回滚时丢弃
+* 4. 插入时没有指定 id 列则按行号生成，模拟自增主键
+* 5. keys 中登记的表按唯一键检查插入，重复时返回错误；DELETE 同样只支持上述条件
+**/
+type fakeDB struct {
+	locker sync.Mutex
+	tables map[string][]map[string]string
+	keys   map[string][]string // 表 -> 唯一键列
+}
+
+func (db *fakeDB) clone() map[string][]map[string]string {
+	tables := make(map[string][]map[string]string, len(db.tables))
+	for name, rows := range db.tables {
+		for _, row := range rows {
+			copied := make(map[string]string, len(row))
+			for k, v := range row {
+				copied[k] = v
+			}
+			tables[name] = append(tables[name], copied)
+		}
+	}
+	return tables
+}
+
+var (
+	fakeDBs    = map[string]*fakeDB{}
+	fakeLocker sync.Mutex
+)
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeLocker.Lock()
+	defer fakeLocker.Unlock()
+	return &fakeConn{db: fakeDBs[name]}, nil
+}
+
+func init() {
+	sql.Register("fsmfake", fakeDriver{})
+}
+
+// newFakeSession 创建使用替身数据库的 dbr 会话
+func newFakeSession(t *testing.T) (*dbr.Session, *fakeDB) {
+	db := &fakeDB{tables: make(map[string][]map[string]string), keys: make(map[string][]string)}
+	fakeLocker.Lock()
+	fakeDBs[t.Name()] = db
+	fakeLocker.Unlock()
+	conn, err := sql.Open("fsmfake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetMaxOpenConns(1)
+	c := &dbr.Connection{DB: conn, Dialect: dialect.MySQL, EventReceiver: &dbr.NullEventReceiver{}}
+	return c.NewSession(nil), db
+}
+
+type fakeConn struct {
+	db *fakeDB
+	tx map[string][]map[string]string
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("不支持预处理")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.locker.Lock()
+	defer c.db.locker.Unlock()
+	c.tx = c.db.clone()
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.locker.Lock()
+	defer c.db.locker.Unlock()
+	c.db.tables, c.tx = c.tx, nil
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.tx = nil
+	return nil
+}
+
+// tables 事务中使用副本，否则直接使用数据库
+func (c *fakeConn) tables(fn func(tables map[string][]map[string]string)) {
+	c.db.locker.Lock()
+	defer c.db.locker.Unlock()
+	if c.tx != nil {
+		fn(c.tx)
+		return
+	}
+	fn(c.db.tables)
+}
+
+var (
+	insertRe = regexp.MustCompile("(?s)^INSERT INTO `?(\\w+)`? \\((.*?)\\) VALUES (.*)$")
+	deleteRe = regexp.MustCompile("(?s)^DELETE FROM `?(\\w+)`?(?: WHERE \\((.*)\\))?$")
+	updateRe = regexp.MustCompile("(?s)^UPDATE `?(\\w+)`? SET (.*?)(?: WHERE \\((.*)\\))?$")
+	selectRe = regexp.MustCompile("(?s)^SELECT (.*?) FROM `?(\\w+)`?(?: WHERE \\((.*?)\\))?(?: ORDER BY .*)?(?: LIMIT \\d+)?$")
+)
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if m := insertRe.FindStringSubmatch(query); m != nil {
+		columns := splitTop(m[2], ',')
+		var rows int64
+		var err error
+		c.tables(func(tables map[string][]map[string]string) {
+			for _, tuple := range splitTop(m[3], ',') {
+				values := splitTop(strings.TrimSuffix(strings.TrimPrefix(tuple, "("), ")"), ',')
+				row := make(map[string]string, len(columns))
+				for i, column := range columns {
+					row[strings.Trim(column, "`")] = values[i]
+				}
+				if _, ok := row["id"]; !ok {
+					row["id"] = strconv.Itoa(len(tables[m[1]]) + 1)
+				}
+				if c.duplicate(tables[m[1]], m[1], row) {
+					err = fmt.Errorf("唯一键重复：%s", m[1])
+					return
+				}
+				tables[m[1]] = append(tables[m[1]], row)
+				rows++
+			}
+		})
+		return driver.RowsAffected(rows), err
+	}
+	if m := deleteRe.FindStringSubmatch(query); m != nil {
+		var rows int64
+		c.tables(func(tables map[string][]map[string]string) {
+			kept := tables[m[1]][:0]
+			for _, row := range tables[m[1]] {
+				if matchWhere(row, m[2]) {
+					rows++
+				} else {
+					kept = append(kept, row)
+				}
+			}
+			tables[m[1]] = kept
+		})
+		return driver.RowsAffected(rows), nil
+	}
+	if m := updateRe.FindStringSubmatch(query); m != nil {
+		var rows int64
+		c.tables(func(tables map[string][]map[string]string) {
+			for _, row := range tables[m[1]] {
+				if !matchWhere(row, m[3]) {
+					continue
+				}
+				for _, pair := range splitTop(m[2], ',') {
+					kv := strings.SplitN(pair, "=", 2)
+					row[strings.Trim(strings.TrimSpace(kv[0]), "`")] = strings.TrimSpace(kv[1])
+				}
+				rows++
+			}
+		})
+		return driver.RowsAffected(rows), nil
+	}
+	return nil, fmt.Errorf("不支持的语句：%s", query)
+}
+
+// duplicate 插入的行与已有行的唯一键是否重复
+func (c *fakeConn) duplicate(rows []map[string]string, table string, row map[string]string) bool {
+	keys := c.db.keys[table]
+	if len(keys) == 0 {
+		return false
+	}
+	for _, existing := range rows {
+		same := true
+		for _, key := range keys {
+			same = same && existing[key] == row[key]
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	m := selectRe.FindStringSubmatch(query)
+	if m == nil {
+		return nil, fmt.Errorf("不支持的查询：%s", query)
+	}
+	columns := splitTop(m[1], ',')
+	for i := range columns {
+		columns[i] = strings.Trim(columns[i], "`")
+	}
+	rows := &fakeRows{columns: columns}
+	c.tables(func(tables map[string][]map[string]string) {
+		for _, row := range tables[m[2]] {
+			if matchWhere(row, m[3]) {
+				values := make([]driver.Value, len(columns))
+				for i, column := range columns {
+					values[i] = literal(column, row[column])
+				}
+				rows.rows = append(rows.rows, values)
+			}
+		}
+	})
+	return rows, nil
+}
+
+var condRe = regexp.MustCompile("^`?(\\w+)`? (IS NULL|IS NOT NULL|<=|>=|=|<|>) ?(.*)$")
+
+// matchWhere 只支持 a = 1 AND b <= 'x' AND c IS NULL 形式的条件
+func matchWhere(row map[string]string, where string) bool {
+	if where == "" {
+		return true
+	}
+	for _, cond := range strings.Split(where, " AND ") {
+		m := condRe.FindStringSubmatch(strings.TrimSpace(cond))
+		if m == nil {
+			return false
+		}
+		v, null := row[m[1]], row[m[1]] == "" || row[m[1]] == "NULL"
+		var ok bool
+		switch m[2] {
+		case "IS NULL":
+			ok = null
+		case "IS NOT NULL":
+			ok = !null
+		default:
+			ok = !null && compareLiteral(v, strings.TrimSpace(m[3]), m[2])
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// compareLiteral 比较两个 SQL 字面量，都是整数时按数值比较，否则按去掉引号的字符串比较
+func compareLiteral(a, b, op string) bool {
+	var c int
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case x < y:
+			c = -1
+		case x > y:
+			c = 1
+		}
+	} else {
+		c = strings.Compare(strings.Trim(a, "'"), strings.Trim(b, "'"))
+	}
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return c == 0
+}
+
+// splitTop 按分隔符切分，忽略引号与括号中的分隔符
+func splitTop(s string, sep byte) []string {
+	var parts []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '\'':
+			quoted = !quoted
+		case quoted:
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			depth--
+		case s[i] == sep && depth == 0:
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// unescaper 还原 MySQL 方言转义的字符串字面量
+var unescaper = strings.NewReplacer(`\'`, `'`, `\"`, `"`, `\\`, `\`)
+
+// literal SQL 字面量转换为驱动值，_at 结尾的列按时间解析
+func literal(column, v string) driver.Value {
+	if v == "" || v == "NULL" {
+		return nil
+	}
+	if strings.HasPrefix(v, "'") {
+		s := unescaper.Replace(strings.Trim(v, "'"))
+		if strings.HasSuffix(column, "_at") {
+			t, _ := time.Parse("2006-01-02 15:04:05.000000", s)
+			return t
+		}
+		return s
+	}
+	n, _ := strconv.ParseInt(v, 10, 64)
+	return n
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// newTxMachine 支付后在同一事务中更新业务表的子订单状态机
+func newTxMachine(t *testing.T, session *dbr.Session, processor EventProcessor) *StateMachine {
+	m, err := NewBuilder(SubMachineName).
+		States(subStates).
+		Composite(StateSubAfterSale, StateSubAfterSaleRefund, StateSubAfterSaleRefund, StateSubAfterSaleRefundAndReturn).
+		Start(StateSubWaitPay).
+		End(StateSubCompleted, StateSubCanceled).
+		Options(Options{Processor: processor, Store: NewSQLStore(session)}).
+		From(StateSubWaitPay).On(EventSubPay).To(StateSubWaitConfirm).
+		DoContext(func(ctx context.Context, from State, event Event, to State) error {
+			tx, ok := TxFrom(ctx)
+			if !ok {
+				return errors.New("不在事务中")
+			}
+			_, err := tx.Update("ebk_daily_rate").
+				Set("status", 3).
+				Where("daily_rate_id = ?", 12454428).
+				ExecContext(ctx)
+			return err
+		}).
+		From(StateSubWaitPay).On(EventSubCancel).To(StateSubCanceled).Do(SubCancel).
+		From(StateSubWaitConfirm).On(EventSubPayConfirm).To(StateSubWaitShip).Do(SubPayConfirm).
+		From(StateSubWaitShip).On(EventSubShip).To(StateSubWaitReceive).Do(SubShip).
+		From(StateSubWaitReceive).On(EventSubReceive).To(StateSubReceived).Do(SubReceive).
+		From(StateSubReceived).On(EventSubComplete).To(StateSubCompleted).Do(SubComplete).
+		From(StateSubWaitShip).On(EventSubRefund).To(StateSubAfterSaleRefund).Do(SubRefund).
+		From(StateSubAfterSaleRefund).On(EventSubAfterSaleComplete).To(StateSubCompleted).Do(SubAfterSaleComplete).
+		From(StateSubReceived).On(EventSubRefundAndReturn).To(StateSubAfterSaleRefundAndReturn).Do(SubRefundAndReturn).
+		From(StateSubAfterSaleRefundAndReturn).On(EventSubAfterSaleComplete).To(StateSubCompleted).Do(SubAfterSaleComplete).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Start(context.Background(), "1001"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = session.InsertInto("ebk_daily_rate").
+		Pair("daily_rate_id", 12454428).
+		Pair("status", 1).
+		Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func dailyRateStatus(t *testing.T, session *dbr.Session) int {
+	var status int
+	if err := session.Select("status").From("ebk_daily_rate").Where("daily_rate_id = ?", 12454428).LoadOne(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestSQLStoreOptimisticConcurrency(t *testing.T) {
+	ctx := context.Background()
+	session, db := newFakeSession(t)
+	db.keys["fsm_instance"] = []string{"machine", "entity_id"}
+	store := NewSQLStore(session)
+	inst := Instance{ID: "1001", Machine: SubMachineName, State: StateSubWaitPay, EnteredAt: time.Now()}
+	if err := store.Save(ctx, &inst); err != nil {
+		t.Fatal(err)
+	}
+	duplicate := Instance{ID: "1001", Machine: SubMachineName, State: StateSubWaitPay, EnteredAt: time.Now()}
+	if err := store.Save(ctx, &duplicate); !errors.Is(err, ErrConflict) {
+		t.Fatalf("重复创建应返回冲突：%v", err)
+	}
+	stale := inst
+	inst.State = StateSubWaitConfirm
+	if err := store.Save(ctx, &inst); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, &stale); !errors.Is(err, ErrConflict) {
+		t.Fatalf("修订号过期应返回冲突：%v", err)
+	}
+}
+
+func TestFireInTxCommit(t *testing.T) {
+	session, _ := newFakeSession(t)
+	m := newTxMachine(t, session, testProcessor{})
+	ctx := context.Background()
+
+	tx, err := session.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := m.Fire(WithTx(ctx, tx), "1001", EventSubPay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if to != StateSubWaitConfirm {
+		t.Fatalf("新状态错误：%d", to)
+	}
+	inst, err := m.Options().Store.Load(ctx, m.Name(), "1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.State != StateSubWaitConfirm || inst.Revision != 2 {
+		t.Fatalf("实例未更新：%+v", inst)
+	}
+	if status := dailyRateStatus(t, session); status != 3 {
+		t.Fatalf("业务数据未更新：%d", status)
+	}
+}
+
+func TestFireInTxRollbackOnHookFailure(t *testing.T) {
+	session, _ := newFakeSession(t)
+	m := newTxMachine(t, session, testProcessor{enterErr: errors.New("通知失败")})
+	ctx := context.Background()
+
+	tx, err := session.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Fire(WithTx(ctx, tx), "1001", EventSubPay); err == nil {
+		t.Fatal("处理器失败时应返回错误")
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	inst, err := m.Options().Store.Load(ctx, m.Name(), "1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.State != StateSubWaitPay || inst.Revision != 1 {
+		t.Fatalf("实例不应更新：%+v", inst)
+	}
+	if status := dailyRateStatus(t, session); status != 1 {
+		t.Fatalf("业务数据应回滚：%d", status)
+	}
+}
+
+func TestFireInSQLTx(t *testing.T) {
+	session, _ := newFakeSession(t)
+	m := newTxMachine(t, session, testProcessor{})
+	ctx := context.Background()
+
+	// 回滚 database/sql 的事务，状态与业务数据都不变
+	tx, err := session.Connection.DB.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Fire(WithSQLTx(ctx, tx), "1001", EventSubPay); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if inst, _ := m.Options().Store.Load(ctx, m.Name(), "1001"); inst.State != StateSubWaitPay || dailyRateStatus(t, session) != 1 {
+		t.Fatalf("回滚后实例与业务数据不应更新：%+v", inst)
+	}
+
+	tx, err = session.Connection.DB.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to, err := m.Fire(WithSQLTx(ctx, tx), "1001", EventSubPay); err != nil || to != StateSubWaitConfirm {
+		t.Fatalf("流转失败：%d %v", to, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if inst, _ := m.Options().Store.Load(ctx, m.Name(), "1001"); inst.State != StateSubWaitConfirm || inst.Revision != 2 {
+		t.Fatalf("提交后实例应更新：%+v", inst)
+	}
+	if status := dailyRateStatus(t, session); status != 3 {
+		t.Fatalf("业务数据未更新：%d", status)
+	}
+}
+
+func TestHistoryAfterCommit(t *testing.T) {
+	m, history := authMachine(t)
+	ctx := context.Background()
+
+	// 提交：流转记录在 done(nil) 后写入
+	txCtx, done := WithAfterCommit(ctx)
+	if _, err := m.Fire(txCtx, "1001", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	if records := history.Records(); len(records) != 0 {
+		t.Fatalf("提交前不应写入流转记录：%+v", records)
+	}
+	done(nil)
+	if records := history.Records(); len(records) != 1 || records[0].Error != "" {
+		t.Fatalf("提交后应写入流转记录：%+v", records)
+	}
+
+	// 回滚：权限拒绝与流转记录在 done(err) 后写入，成功的记录标记为失败
+	if _, err := m.Start(ctx, "1002"); err != nil {
+		t.Fatal(err)
+	}
+	txCtx, done = WithAfterCommit(WithActor(ctx, customerActor))
+	if _, err := m.Fire(txCtx, "1001", EventPayConfirm); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("用户不能确认支付：%v", err)
+	}
+	if _, err := m.Fire(txCtx, "1002", EventPay); err != nil {
+		t.Fatal(err)
+	}
+	if records := history.Records(); len(records) != 1 {
+		t.Fatalf("回滚前不应写入流转记录：%+v", records)
+	}
+	done(errors.New("事务回滚"))
+	records := history.Records()
+	if len(records) != 3 || !records[1].Denied || records[2].EntityID != "1002" || records[2].Error != "事务回滚" {
+		t.Fatalf("回滚后应写入流转记录并标记失败：%+v", records)
+	}
+}
@@ -0,0 +1,302 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrVersionMismatch 实例绑定的版本与状态机版本不一致，需要先迁移或使用对应版本的状态机
+var ErrVersionMismatch = errors.New("实例版本与状态机版本不一致")
+
+// Instance 状态机实例，实例创建时绑定所用的状态机版本
+type Instance struct {
+	ID      string `desc:"实体ID"`
+	Machine string `desc:"状态机名称"`
+	Version int    `desc:"状态机版本"`
+	State   State  `desc:"当前状态"`
+
+	History  map[State]State `desc:"复合状态 -> 进入前的状态，用于历史伪状态"`
+	Deferred []DeferredEvent `desc:"延迟的事件，进入可以处理的状态后重新投递"`
+
+	Revision  int64     `desc:"修订号，每次保存加一，用于乐观锁"`
+	EnteredAt time.Time `desc:"进入当前状态的时间"`
+}
+
+// clone 复制实例，历史状态不与原实例共享
+func (inst Instance) clone() Instance {
+	if inst.History != nil {
+		history := make(map[State]State, len(inst.History))
+		for composite, remembered := range inst.History {
+			history[composite] = remembered
+		}
+		inst.History = history
+	}
+	inst.Deferred = append([]DeferredEvent(nil), inst.Deferred...)
+	return inst
+}
+
+// Migration 版本迁移规则：把 From 版本的状态映射到 From+1 版本
+// 未出现在 Mapping 中的状态，如果在新版本中仍然存在，则保持不变
+type Migration struct {
+	From    int             `desc:"旧版本"`
+	Mapping map[State]State `desc:"旧状态 -> 新状态"`
+}
+
+// MigrationResult 单个实例的迁移结果
+type MigrationResult struct {
+	ID          string `desc:"实体ID"`
+	FromVersion int    `desc:"旧版本"`
+	ToVersion   int    `desc:"新版本"`
+	FromState   State  `desc:"旧状态"`
+	ToState     State  `desc:"新状态"`
+	Reason      string `desc:"无法迁移的原因"`
+}
+
+// MigrationReport 迁移报告，DryRun 时只生成报告不修改实例
+type MigrationReport struct {
+	Target   int               `desc:"目标版本"`
+	Migrated []MigrationResult `desc:"可迁移的实例"`
+	Unmapped []MigrationResult `desc:"无法迁移的实例"`
+}
+
+// VersionedMachine 同名状态机的多个版本
+// 新实例总是使用最新版本，已有实例按照绑定的版本运行，直到被迁移
+type VersionedMachine struct {
+	locker     sync.RWMutex
+	name       string
+	versions   map[int]*StateMachine
+	migrations map[int]Migration
+}
+
+func NewVersionedMachine(name string) *VersionedMachine {
+	return &VersionedMachine{
+		name:       name,
+		versions:   make(map[int]*StateMachine),
+		migrations: make(map[int]Migration),
+	}
+}
+
+func (v *VersionedMachine) Name() string {
+	return v.name
+}
+
+// Register 注册一个版本，版本号必须大于 0 且不能重复，并且与状态机的 Options.Version 一致
+func (v *VersionedMachine) Register(version int, m *StateMachine) error {
+	if version <= 0 {
+		return fmt.Errorf("版本号必须大于0：%d", version)
+	}
+	if m == nil || m.Graph == nil {
+		return fmt.Errorf("状态机不能为空")
+	}
+	if m.options.Version != version {
+		return fmt.Errorf("状态机 %s 配置的版本 %d 与注册版本 %d 不一致", v.name, m.options.Version, version)
+	}
+	v.locker.Lock()
+	defer v.locker.Unlock()
+	if _, ok := v.versions[version]; ok {
+		return fmt.Errorf("状态机 %s 版本已存在：%d", v.name, version)
+	}
+	v.versions[version] = m
+	return nil
+}
+
+// AddMigration 添加 from -> from+1 的状态映射规则，两个版本都需要先注册，旧状态与新状态必须分别存在于两个版本中
+func (v *VersionedMachine) AddMigration(from int, mapping map[State]State) error {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+	if _, ok := v.migrations[from]; ok {
+		return fmt.Errorf("状态机 %s 迁移规则已存在：%d -> %d", v.name, from, from+1)
+	}
+	old, ok := v.versions[from]
+	if !ok {
+		return fmt.Errorf("状态机 %s 版本不存在：%d", v.name, from)
+	}
+	next, ok := v.versions[from+1]
+	if !ok {
+		return fmt.Errorf("状态机 %s 版本不存在：%d", v.name, from+1)
+	}
+	var errs []error
+	for k, s := range mapping {
+		if _, ok := old.Graph.states[k]; !ok {
+			errs = append(errs, fmt.Errorf("旧状态 %d 在版本 %d 中不存在", k, from))
+		}
+		if _, ok := next.Graph.states[s]; !ok {
+			errs = append(errs, fmt.Errorf("新状态 %d 在版本 %d 中不存在", s, from+1))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("状态机 %s 迁移规则错误：%w", v.name, errors.Join(errs...))
+	}
+	copied := make(map[State]State, len(mapping))
+	for k, s := range mapping {
+		copied[k] = s
+	}
+	v.migrations[from] = Migration{From: from, Mapping: copied}
+	return nil
+}
+
+// Versions 已注册的版本号，升序
+func (v *VersionedMachine) Versions() []int {
+	v.locker.RLock()
+	defer v.locker.RUnlock()
+	versions := make([]int, 0, len(v.versions))
+	for version := range v.versions {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+func (v *VersionedMachine) Get(version int) (*StateMachine, bool) {
+	v.locker.RLock()
+	defer v.locker.RUnlock()
+	m, ok := v.versions[version]
+	return m, ok
+}
+
+// Latest 最新版本
+func (v *VersionedMachine) Latest() (int, *StateMachine, bool) {
+	versions := v.Versions()
+	if len(versions) == 0 {
+		return 0, nil, false
+	}
+	latest := versions[len(versions)-1]
+	m, ok := v.Get(latest)
+	return latest, m, ok
+}
+
+// Start 使用最新版本创建实例，实例处于该版本的开始状态
+func (v *VersionedMachine) Start(id string) (Instance, error) {
+	version, m, ok := v.Latest()
+	if !ok {
+		return Instance{}, fmt.Errorf("状态机 %s 没有注册任何版本", v.name)
+	}
+	return Instance{
+		ID:      id,
+		Machine: v.name,
+		Version: version,
+		State:   m.Graph.start,
+	}, nil
+}
+
+// Run 按实例绑定的版本执行事件，成功后更新实例状态
+func (v *VersionedMachine) Run(inst *Instance, event Event) error {
+	m, ok := v.Get(inst.Version)
+	if !ok {
+		return fmt.Errorf("状态机 %s 版本不存在：%d", v.name, inst.Version)
+	}
+	to, err := m.RunContext(withInstance(context.Background(), inst), inst.State, event)
+	if err != nil {
+		return err
+	}
+	inst.State = to
+	return nil
+}
+
+// Fire 读取实例，使用实例绑定版本的状态机执行事件并保存，实例通过最新版本的状态存储读取
+func (v *VersionedMachine) Fire(ctx context.Context, id string, event Event) (State, error) {
+	_, latest, ok := v.Latest()
+	if !ok {
+		return 0, fmt.Errorf("状态机 %s 没有注册任何版本", v.name)
+	}
+	if latest.options.Store == nil {
+		return 0, fmt.Errorf("状态机未设置状态存储：%s", v.name)
+	}
+	inst, err := latest.options.Store.Load(ctx, v.name, id)
+	if err != nil {
+		return 0, err
+	}
+	m, ok := v.Get(inst.Version)
+	if !ok {
+		return 0, fmt.Errorf("状态机 %s 版本不存在：%d", v.name, inst.Version)
+	}
+	return m.Fire(ctx, id, event)
+}
+
+// migrateStep 把实例从 version 迁移到 version+1，返回新状态
+func (v *VersionedMachine) migrateStep(version int, state State) (State, error) {
+	next, ok := v.versions[version+1]
+	if !ok {
+		return 0, fmt.Errorf("版本不存在：%d", version+1)
+	}
+	to := state
+	if migration, ok := v.migrations[version]; ok {
+		if mapped, ok := migration.Mapping[state]; ok {
+			to = mapped
+		}
+	}
+	if _, ok := next.Graph.states[to]; !ok {
+		return 0, fmt.Errorf("状态 %d 在版本 %d 中不存在且没有映射规则", state, version+1)
+	}
+	return to, nil
+}
+
+// migrate 逐个版本迁移单个实例，不修改实例
+func (v *VersionedMachine) migrate(inst Instance, target int) MigrationResult {
+	result := MigrationResult{
+		ID:          inst.ID,
+		FromVersion: inst.Version,
+		ToVersion:   target,
+		FromState:   inst.State,
+		ToState:     inst.State,
+	}
+	if inst.Version > target {
+		result.Reason = fmt.Sprintf("实例版本 %d 高于目标版本 %d", inst.Version, target)
+		return result
+	}
+	if _, ok := v.versions[inst.Version]; !ok {
+		result.Reason = fmt.Sprintf("实例版本不存在：%d", inst.Version)
+		return result
+	}
+	state := inst.State
+	for version := inst.Version; version < target; version++ {
+		to, err := v.migrateStep(version, state)
+		if err != nil {
+			result.Reason = err.Error()
+			return result
+		}
+		state = to
+	}
+	result.ToState = state
+	return result
+}
+
+// DryRun 生成迁移报告，列出可以迁移以及无法映射的实例，不修改任何实例
+func (v *VersionedMachine) DryRun(insts []Instance, target int) MigrationReport {
+	v.locker.RLock()
+	defer v.locker.RUnlock()
+	report := MigrationReport{Target: target}
+	for _, inst := range insts {
+		result := v.migrate(inst, target)
+		if result.Reason != "" {
+			report.Unmapped = append(report.Unmapped, result)
+		} else {
+			report.Migrated = append(report.Migrated, result)
+		}
+	}
+	return report
+}
+
+// Migrate 把实例迁移到目标版本，无法映射的实例保持原样并记录在报告中
+func (v *VersionedMachine) Migrate(insts []Instance, target int) ([]Instance, MigrationReport) {
+	v.locker.RLock()
+	defer v.locker.RUnlock()
+	report := MigrationReport{Target: target}
+	out := make([]Instance, len(insts))
+	for i, inst := range insts {
+		result := v.migrate(inst, target)
+		if result.Reason != "" {
+			report.Unmapped = append(report.Unmapped, result)
+		} else {
+			report.Migrated = append(report.Migrated, result)
+			inst.Version = result.ToVersion
+			inst.State = result.ToState
+		}
+		out[i] = inst
+	}
+	return out, report
+}
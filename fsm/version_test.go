@@ -0,0 +1,124 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// stateReviewing 版本 2 中代替待确认的审核中状态
+const stateReviewing State = 4
+
+/** versionedMachine 两个版本的主订单状态机，共享同一个状态存储
+* 1. 版本 1 同 mainFlow
+* 2. 版本 2 去掉待确认，支付后进入审核中
+**/
+func versionedMachine(t *testing.T, store StateStore) (*VersionedMachine, *StateMachine, *StateMachine) {
+	t.Helper()
+	v1 := mainFlow().Options(Options{Processor: testProcessor{}, Store: store, Version: 1, Quiet: true}).MustBuild()
+	v2 := NewBuilder(MainMachineName).
+		States(map[State]string{StateWaitPay: "wait_pay", StatePayied: "payied", StateCanceled: "canceled", stateReviewing: "reviewing"}).
+		Start(StateWaitPay).
+		End(StatePayied, StateCanceled).
+		Options(Options{Processor: testProcessor{}, Store: store, Version: 2, Quiet: true}).
+		From(StateWaitPay).On(EventPay).To(stateReviewing).Do(nop).
+		From(StateWaitPay).On(EventCancel).To(StateCanceled).Do(nop).
+		From(stateReviewing).On(EventPayConfirm).To(StatePayied).Do(nop).
+		MustBuild()
+	v := NewVersionedMachine(MainMachineName)
+	for version, m := range map[int]*StateMachine{1: v1, 2: v2} {
+		if err := v.Register(version, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return v, v1, v2
+}
+
+func TestVersionedMachineRegister(t *testing.T) {
+	v, v1, _ := versionedMachine(t, nil)
+	if err := v.Register(1, v1); err == nil {
+		t.Fatal("版本重复时应返回错误")
+	}
+	if err := v.Register(3, v1); err == nil {
+		t.Fatal("状态机配置的版本与注册版本不一致时应返回错误")
+	}
+	if err := v.Register(0, v1); err == nil {
+		t.Fatal("版本号必须大于 0")
+	}
+	if latest, _, _ := v.Latest(); latest != 2 {
+		t.Fatalf("最新版本错误：%d", latest)
+	}
+}
+
+func TestVersionedMachineAddMigration(t *testing.T) {
+	v, _, _ := versionedMachine(t, nil)
+	for _, c := range []struct {
+		name    string
+		from    int
+		mapping map[State]State
+	}{
+		{"missing_version", 2, map[State]State{StateWaitPay: StateWaitPay}},
+		{"missing_target", 1, map[State]State{StateWaitConfirm: State(9)}},
+		{"missing_source", 1, map[State]State{State(9): stateReviewing}},
+	} {
+		if err := v.AddMigration(c.from, c.mapping); err == nil {
+			t.Fatalf("%s：应返回错误", c.name)
+		}
+	}
+	if err := v.AddMigration(1, map[State]State{StateWaitConfirm: stateReviewing}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.AddMigration(1, nil); err == nil {
+		t.Fatal("迁移规则重复时应返回错误")
+	}
+}
+
+func TestVersionedMachineMigrate(t *testing.T) {
+	v, _, _ := versionedMachine(t, nil)
+	insts := []Instance{
+		{ID: "1", Version: 1, State: StateWaitPay},
+		{ID: "2", Version: 1, State: StateWaitConfirm},
+	}
+	if report := v.DryRun(insts, 2); len(report.Migrated) != 1 || len(report.Unmapped) != 1 || report.Unmapped[0].ID != "2" {
+		t.Fatalf("没有映射规则时应无法迁移：%+v", report)
+	}
+	if err := v.AddMigration(1, map[State]State{StateWaitConfirm: stateReviewing}); err != nil {
+		t.Fatal(err)
+	}
+	out, report := v.Migrate(insts, 2)
+	if len(report.Migrated) != 2 || out[1].Version != 2 || out[1].State != stateReviewing || insts[1].Version != 1 {
+		t.Fatalf("迁移结果错误：%+v %+v", out, report)
+	}
+}
+
+func TestVersionedMachineRun(t *testing.T) {
+	v, _, _ := versionedMachine(t, nil)
+	inst := Instance{ID: "1", Version: 1, State: StateWaitPay}
+	if err := v.Run(&inst, EventPay); err != nil || inst.State != StateWaitConfirm {
+		t.Fatalf("应按实例版本流转：%+v %v", inst, err)
+	}
+	if inst, _ := v.Start("2"); inst.Version != 2 {
+		t.Fatalf("新实例应使用最新版本：%+v", inst)
+	}
+}
+
+func TestVersionedMachineFire(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	v, v1, v2 := versionedMachine(t, store)
+	if _, err := v1.Start(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v2.Fire(ctx, "1", EventPay); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("其他版本的状态机不能处理实例：%v", err)
+	}
+	if _, err := v2.SimulateFire(ctx, "1", EventPay); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("其他版本的状态机不能试运行实例：%v", err)
+	}
+	if to, err := v.Fire(ctx, "1", EventPay); err != nil || to != StateWaitConfirm {
+		t.Fatalf("应使用实例绑定的版本：%d %v", to, err)
+	}
+	if inst, _ := store.Load(ctx, MainMachineName, "1"); inst.Version != 1 {
+		t.Fatalf("实例版本不应改变：%+v", inst)
+	}
+}